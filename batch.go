@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"io"
+)
+
+// PutBatch uses BatchPutter if putter implements it,
+// otherwise every content is stored one by one
+func PutBatch(ctx context.Context, putter Putter, rs []io.Reader) ([]PutResult, error) {
+	if batchPutter, ok := As[BatchPutter](putter); ok {
+		return batchPutter.PutBatch(ctx, rs)
+	}
+
+	results := make([]PutResult, len(rs))
+	for i, r := range rs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		hash, n, err := putter.Put(ctx, r)
+		results[i] = PutResult{Hash: hash, N: n, Err: err}
+	}
+
+	return results, nil
+}
+
+// GetBatch uses BatchGetter if getter implements it,
+// otherwise every hash is read one by one
+func GetBatch(ctx context.Context, getter Getter, hashes [][]byte) ([]GetResult, error) {
+	if batchGetter, ok := As[BatchGetter](getter); ok {
+		return batchGetter.GetBatch(ctx, hashes)
+	}
+
+	results := make([]GetResult, len(hashes))
+	for i, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			closeResults(results[:i])
+			return nil, err
+		}
+
+		rc, err := getter.Get(ctx, hash)
+		results[i] = GetResult{Reader: rc, Err: err}
+	}
+
+	return results, nil
+}
+
+// RemoveBatch uses BatchRemover if remover implements it,
+// otherwise every hash is removed one by one
+func RemoveBatch(ctx context.Context, remover Remover, hashes [][]byte) ([]error, error) {
+	if batchRemover, ok := As[BatchRemover](remover); ok {
+		return batchRemover.RemoveBatch(ctx, hashes)
+	}
+
+	errs := make([]error, len(hashes))
+	for i, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		errs[i] = remover.Remove(ctx, hash)
+	}
+
+	return errs, nil
+}
+
+func closeResults(results []GetResult) {
+	for _, result := range results {
+		if result.Reader != nil {
+			result.Reader.Close()
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/alinz/hash.go"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/merkle"
+)
+
+type Node struct {
+	Hash     hash.Value `json:"hash"`
+	Type     string     `json:"type"`
+	Side     string     `json:"side,omitempty"`
+	Size     int64      `json:"size,omitempty"` // stored size including the node header
+	Missing  bool       `json:"missing,omitempty"`
+	Shared   bool       `json:"shared,omitempty"` // already rendered with its children earlier in the tree
+	Error    string     `json:"error,omitempty"`
+	Children []*Node    `json:"children,omitempty"`
+}
+
+type Reference struct {
+	Parent hash.Value `json:"parent"`
+	Child  hash.Value `json:"child"`
+}
+
+type Unknown struct {
+	Hash  hash.Value `json:"hash"`
+	Error string     `json:"error"`
+}
+
+type Report struct {
+	Roots     []*Node      `json:"roots"`
+	Orphans   []hash.Value `json:"orphans"`
+	Dangling  []Reference  `json:"dangling"`
+	Unknown   []Unknown    `json:"unknown"`
+	Corrupted []Unknown    `json:"corrupted"` // cycles and trees deeper than merkle.MaxDepth
+}
+
+func (r *Report) addDangling(parent, child []byte) {
+	for _, ref := range r.Dangling {
+		if bytes.Equal(ref.Parent, parent) && bytes.Equal(ref.Child, child) {
+			return
+		}
+	}
+	r.Dangling = append(r.Dangling, Reference{Parent: parent, Child: child})
+}
+
+func (r *Report) addCorrupted(hashValue []byte, err error) {
+	for _, corrupted := range r.Corrupted {
+		if bytes.Equal(corrupted.Hash, hashValue) {
+			return
+		}
+	}
+	r.Corrupted = append(r.Corrupted, Unknown{Hash: hashValue, Error: err.Error()})
+}
+
+func (r *Report) Healthy() bool {
+	return len(r.Dangling) == 0 && len(r.Unknown) == 0 && len(r.Corrupted) == 0
+}
+
+// entry is the parsed content of a single stored node
+type entry struct {
+	fileType merkle.FileType
+	left     []byte
+	right    []byte
+	size     int64
+	err      error
+}
+
+type checker struct {
+	getter  storage.Getter
+	entries map[string]*entry
+	sizes   map[string]int64 // sizes known from the listing
+}
+
+func (c *checker) read(ctx context.Context, hashValue []byte) *entry {
+	key := hash.Format(hashValue)
+	if e, ok := c.entries[key]; ok {
+		return e
+	}
+
+	e := &entry{}
+	c.entries[key] = e
+
+	rc, err := c.getter.Get(ctx, hashValue)
+	if err != nil {
+		e.err = err
+		return e
+	}
+	defer rc.Close()
+
+	r, fileType, err := merkle.DetectFileType(rc)
+	if err != nil {
+		e.err = err
+		return e
+	}
+	e.fileType = fileType
+
+	switch fileType {
+	case merkle.DataType:
+		if size, ok := c.sizes[key]; ok && size >= 0 {
+			e.size = size
+		} else {
+			e.size, e.err = io.Copy(io.Discard, r)
+		}
+	case merkle.MetaType, merkle.RootType:
+		meta, err := merkle.ParseMetaFile(r)
+		if err != nil {
+			e.err = err
+			return e
+		}
+		e.size = merkle.MetaFileSize
+		if meta.HasLeft() {
+			e.left = meta.Left()
+		}
+		if meta.HasRight() {
+			e.right = meta.Right()
+		}
+	}
+
+	return e
+}
+
+// walk renders the tree of hashValue, path holds the ancestors of the
+// node and expanded the nodes already rendered with their children. A
+// shared subtree is rendered once, a crafted tree of shared children
+// would otherwise grow exponentially
+func (c *checker) walk(ctx context.Context, hashValue []byte, side merkle.NodeSide, path map[string]struct{}, expanded map[string]struct{}, reachable map[string]struct{}, report *Report) *Node {
+	node := &Node{Hash: hashValue}
+	if side != 0 {
+		node.Side = side.String()
+	}
+
+	key := hash.Format(hashValue)
+	reachable[key] = struct{}{}
+
+	e := c.read(ctx, hashValue)
+	if errors.Is(e.err, storage.ErrNotFound) {
+		node.Missing = true
+		return node
+	} else if e.err != nil {
+		node.Error = e.err.Error()
+		return node
+	}
+
+	node.Type = e.fileType.String()
+	node.Size = e.size
+
+	if e.left == nil && e.right == nil {
+		return node
+	}
+
+	if _, ok := expanded[key]; ok {
+		node.Shared = true
+		return node
+	}
+	expanded[key] = struct{}{}
+
+	if len(path) >= merkle.MaxDepth {
+		node.Error = merkle.ErrTooDeep.Error()
+		report.addCorrupted(hashValue, merkle.ErrTooDeep)
+		return node
+	}
+
+	path[key] = struct{}{}
+	defer delete(path, key)
+
+	for _, child := range []struct {
+		value []byte
+		side  merkle.NodeSide
+	}{
+		{e.left, merkle.LeftSide},
+		{e.right, merkle.RightSide},
+	} {
+		if child.value == nil {
+			continue
+		}
+
+		if _, ok := path[hash.Format(child.value)]; ok {
+			node.Error = merkle.ErrCycle.Error()
+			report.addCorrupted(hashValue, merkle.ErrCycle)
+			continue
+		}
+
+		childNode := c.walk(ctx, child.value, child.side, path, expanded, reachable, report)
+		if childNode.Missing {
+			report.addDangling(hashValue, child.value)
+		}
+		node.Children = append(node.Children, childNode)
+	}
+
+	return node
+}
+
+// Check lists every node in the store, walks the tree of each root and
+// reports nodes that can not be reached from any root, references to
+// nodes which no longer exist and files which are not merkle nodes. If
+// root is given, only that tree is rendered but orphans are still
+// calculated against every root in the store.
+func Check(ctx context.Context, getter storage.Getter, lister storage.Lister, root []byte) (*Report, error) {
+	c := &checker{
+		getter:  getter,
+		entries: make(map[string]*entry),
+		sizes:   make(map[string]int64),
+	}
+
+	var all []hash.Value
+
+	// sizes of the listing save reading data nodes to the end
+	for entry, err := range storage.Entries(ctx, lister) {
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, entry.Hash)
+		c.sizes[hash.Format(entry.Hash)] = entry.Size
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return hash.Format(all[i]) < hash.Format(all[j])
+	})
+
+	report := &Report{
+		Roots:     []*Node{},
+		Orphans:   []hash.Value{},
+		Dangling:  []Reference{},
+		Unknown:   []Unknown{},
+		Corrupted: []Unknown{},
+	}
+
+	var roots []hash.Value
+	for _, hashValue := range all {
+		e := c.read(ctx, hashValue)
+		if e.err != nil {
+			report.Unknown = append(report.Unknown, Unknown{Hash: hashValue, Error: e.err.Error()})
+			continue
+		}
+
+		if e.fileType == merkle.RootType {
+			roots = append(roots, hashValue)
+		}
+	}
+
+	reachable := make(map[string]struct{})
+	rootKey := hash.Format(root)
+	rendered := false
+
+	for _, value := range roots {
+		node := c.walk(ctx, value, 0, make(map[string]struct{}), make(map[string]struct{}), reachable, report)
+		if root == nil || hash.Format(value) == rootKey {
+			report.Roots = append(report.Roots, node)
+			rendered = true
+		}
+	}
+
+	// the requested root might not be stored as a root node, e.g. someone
+	// wants to look at a subtree, so walk it separately without affecting
+	// the orphans calculation
+	if root != nil && !rendered {
+		report.Roots = append(report.Roots, c.walk(ctx, root, 0, make(map[string]struct{}), make(map[string]struct{}), make(map[string]struct{}), report))
+	}
+
+	for _, hashValue := range all {
+		key := hash.Format(hashValue)
+		if _, ok := reachable[key]; ok {
+			continue
+		}
+		if c.entries[key].err != nil {
+			continue
+		}
+		report.Orphans = append(report.Orphans, hashValue)
+	}
+
+	return report, nil
+}
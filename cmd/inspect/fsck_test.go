@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/alinz/hash.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alinz/storage.go/local"
+	"github.com/alinz/storage.go/memory"
+	"github.com/alinz/storage.go/merkle"
+)
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+
+	backend := local.New(t.TempDir())
+	merkleStorage := merkle.New(backend, backend, backend, 1)
+
+	root, _, err := merkleStorage.Put(ctx, bytes.NewReader([]byte{1, 2, 3}))
+	assert.NoError(t, err)
+
+	t.Run("a fresh tree is healthy", func(t *testing.T) {
+		report, err := Check(ctx, backend, backend, nil)
+		assert.NoError(t, err)
+		assert.True(t, report.Healthy())
+		assert.Len(t, report.Roots, 1)
+		assert.Equal(t, hash.Value(root), report.Roots[0].Hash)
+		assert.Equal(t, "RootType", report.Roots[0].Type)
+
+		// intermediate meta nodes are rewritten while the tree grows
+		assert.NotEmpty(t, report.Orphans)
+
+		var buffer bytes.Buffer
+		assert.NoError(t, renderDot(&buffer, report))
+		assert.True(t, strings.HasPrefix(buffer.String(), "digraph merkle {"))
+	})
+
+	t.Run("missing nodes and unknown files are reported", func(t *testing.T) {
+		dataHash := hash.Bytes([]byte{byte(merkle.DataType), 3})
+		assert.NoError(t, backend.Remove(ctx, dataHash))
+
+		unknown, _, err := backend.Put(ctx, strings.NewReader("not a merkle node"))
+		assert.NoError(t, err)
+
+		report, err := Check(ctx, backend, backend, root)
+		assert.NoError(t, err)
+		assert.False(t, report.Healthy())
+
+		assert.Len(t, report.Dangling, 1)
+		assert.Equal(t, dataHash, report.Dangling[0].Child)
+
+		assert.Len(t, report.Unknown, 1)
+		assert.Equal(t, hash.Value(unknown), report.Unknown[0].Hash)
+	})
+
+	t.Run("shared children are expanded once", func(t *testing.T) {
+		backend := memory.New()
+
+		// every meta node points twice to the one below, a walk which
+		// expands every path reads 2^60 nodes
+		child, _, err := backend.Put(ctx, bytes.NewReader([]byte{byte(merkle.DataType), 1}))
+		assert.NoError(t, err)
+
+		for i := 0; i < 60; i++ {
+			fileType := merkle.MetaType
+			if i == 59 {
+				fileType = merkle.RootType
+			}
+			child, _, err = backend.Put(ctx, bytes.NewReader(metaNode(fileType, child, child)))
+			assert.NoError(t, err)
+		}
+
+		report, err := Check(ctx, backend, backend, nil)
+		assert.NoError(t, err)
+		assert.True(t, report.Healthy())
+		assert.Empty(t, report.Orphans)
+
+		node := report.Roots[0]
+		assert.Equal(t, int64(merkle.MetaFileSize), node.Size)
+		assert.Len(t, node.Children, 2)
+		assert.False(t, node.Children[0].Shared)
+		assert.True(t, node.Children[1].Shared)
+		assert.Empty(t, node.Children[1].Children)
+	})
+
+	t.Run("trees deeper than merkle.MaxDepth are corrupted", func(t *testing.T) {
+		backend := memory.New()
+
+		child, _, err := backend.Put(ctx, bytes.NewReader([]byte{byte(merkle.DataType), 1}))
+		assert.NoError(t, err)
+
+		for i := 0; i < merkle.MaxDepth+10; i++ {
+			child, _, err = backend.Put(ctx, bytes.NewReader(metaNode(merkle.MetaType, child, nil)))
+			assert.NoError(t, err)
+		}
+
+		report, err := Check(ctx, backend, backend, child)
+		assert.NoError(t, err)
+		assert.False(t, report.Healthy())
+		assert.Len(t, report.Corrupted, 1)
+		assert.Equal(t, merkle.ErrTooDeep.Error(), report.Corrupted[0].Error)
+	})
+
+	t.Run("cycles are corrupted", func(t *testing.T) {
+		// content addressed nodes can't point to themselves, a getter
+		// answering any hash with the same node can
+		root := hash.Bytes([]byte("root"))
+		getter := cyclic(metaNode(merkle.MetaType, root, nil))
+
+		report, err := Check(ctx, getter, memory.New(), root)
+		assert.NoError(t, err)
+		assert.False(t, report.Healthy())
+		assert.Len(t, report.Corrupted, 1)
+		assert.Equal(t, merkle.ErrCycle.Error(), report.Corrupted[0].Error)
+	})
+}
+
+// cyclic answers every hash with the same node
+type cyclic []byte
+
+func (c cyclic) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(c)), nil
+}
+
+func metaNode(fileType merkle.FileType, left, right []byte) []byte {
+	if right == nil {
+		right = make([]byte, 32)
+	}
+	node := append([]byte{byte(fileType)}, left...)
+	return append(node, right...)
+}
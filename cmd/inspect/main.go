@@ -1,64 +1,106 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
-	"path/filepath"
 
 	"github.com/alinz/hash.go"
 
-	"github.com/alinz/storage.go/merkle"
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/kv/boltdb"
+	"github.com/alinz/storage.go/kv/pogreb"
+	"github.com/alinz/storage.go/local"
+	"github.com/alinz/storage.go/sqlite"
 )
 
+type backend interface {
+	storage.Getter
+	storage.Lister
+}
+
+func open(kind string, path string) (backend, func() error, error) {
+	noop := func() error { return nil }
+
+	switch kind {
+	case "local":
+		return local.New(path), noop, nil
+	case "boltdb":
+		s, err := boltdb.New(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, s.Close, nil
+	case "pogreb":
+		s, err := pogreb.New(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, s.Close, nil
+	case "sqlite":
+		s, err := sqlite.NewFile(path, 1, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, s.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown backend %q", kind)
+	}
+}
+
 func main() {
+	var kind string
 	var path string
+	var rootString string
+	var format string
 
-	flag.StringVar(&path, "path", "", "path to any merkle's storage file")
+	flag.StringVar(&kind, "backend", "local", "storage backend: local, boltdb, pogreb or sqlite")
+	flag.StringVar(&path, "path", "", "path to any merkle's storage directory or database file")
+	flag.StringVar(&rootString, "root", "", "only render the tree of this root hash")
+	flag.StringVar(&format, "format", "text", "output format: text, json or dot")
 
 	flag.Parse()
 
-	files, err := ioutil.ReadDir(path)
-	if err != nil {
-		log.Fatal(err)
+	var render func(io.Writer, *Report) error
+	switch format {
+	case "text":
+		render = renderText
+	case "json":
+		render = renderJSON
+	case "dot":
+		render = renderDot
+	default:
+		log.Fatalf("unknown format %q", format)
 	}
 
-	for _, file := range files {
-		fmt.Println("File name: ", file.Name())
-		showInfo(filepath.Join(path, file.Name()))
-		fmt.Println("#####")
-		fmt.Println("")
+	var root []byte
+	if rootString != "" {
+		value, err := hash.ValueFromString(rootString)
+		if err != nil {
+			log.Fatal(err)
+		}
+		root = value
 	}
-}
 
-func showInfo(filepath string) {
-	file, err := os.Open(filepath)
+	s, closeFn, err := open(kind, path)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer file.Close()
 
-	r, fileType, err := merkle.DetectFileType(file)
+	report, err := Check(context.Background(), s, s, root)
+	closeFn()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fmt.Println("File Type: ", fileType.String())
-
-	switch fileType {
-	case merkle.DataType:
-
-	case merkle.RootType:
-		fallthrough
-	case merkle.MetaType:
-		meta, err := merkle.ParseMetaFile(r)
-		if err != nil {
-			log.Fatal(err)
-		}
+	if err := render(os.Stdout, report); err != nil {
+		log.Fatal(err)
+	}
 
-		fmt.Println("LEFT: ", hash.Format(meta.Left()))
-		fmt.Println("RIGHT: ", hash.Format(meta.Right()))
+	if !report.Healthy() {
+		os.Exit(1)
 	}
 }
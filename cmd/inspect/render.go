@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/alinz/hash.go"
+)
+
+func short(value hash.Value) string {
+	return value.Short()
+}
+
+func describe(node *Node) string {
+	switch {
+	case node.Missing:
+		return fmt.Sprintf("%s MISSING", short(node.Hash))
+	case node.Error != "":
+		return fmt.Sprintf("%s ERROR: %s", short(node.Hash), node.Error)
+	case node.Shared:
+		return fmt.Sprintf("%s %s (%d bytes, shared)", short(node.Hash), node.Type, node.Size)
+	default:
+		return fmt.Sprintf("%s %s (%d bytes)", short(node.Hash), node.Type, node.Size)
+	}
+}
+
+// printTree draws the tree sideways the same way Tree.String does, right
+// children on top and left children at the bottom
+func printTree(w io.Writer, node *Node, space int) {
+	const COUNT = 5
+
+	if node == nil {
+		return
+	}
+
+	space += COUNT
+
+	var left, right *Node
+	for _, child := range node.Children {
+		switch child.Side {
+		case "L":
+			left = child
+		case "R":
+			right = child
+		}
+	}
+
+	printTree(w, right, space)
+
+	fmt.Fprint(w, "\n")
+	fmt.Fprint(w, strings.Repeat("  ", space-COUNT))
+
+	side := node.Side
+	if side == "" {
+		side = "?"
+	}
+	fmt.Fprintf(w, "(%s)%s\n", side, describe(node))
+
+	printTree(w, left, space)
+}
+
+func renderText(w io.Writer, report *Report) error {
+	for _, root := range report.Roots {
+		fmt.Fprintf(w, "ROOT: %s\n", hash.Format(root.Hash))
+		printTree(w, root, 0)
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "Orphaned nodes: %d\n", len(report.Orphans))
+	for _, orphan := range report.Orphans {
+		fmt.Fprintf(w, "  %s\n", hash.Format(orphan))
+	}
+
+	fmt.Fprintf(w, "Dangling references: %d\n", len(report.Dangling))
+	for _, ref := range report.Dangling {
+		fmt.Fprintf(w, "  %s -> %s\n", hash.Format(ref.Parent), hash.Format(ref.Child))
+	}
+
+	fmt.Fprintf(w, "Unknown files: %d\n", len(report.Unknown))
+	for _, unknown := range report.Unknown {
+		fmt.Fprintf(w, "  %s: %s\n", hash.Format(unknown.Hash), unknown.Error)
+	}
+
+	fmt.Fprintf(w, "Corrupted nodes: %d\n", len(report.Corrupted))
+	for _, corrupted := range report.Corrupted {
+		fmt.Fprintf(w, "  %s: %s\n", hash.Format(corrupted.Hash), corrupted.Error)
+	}
+
+	return nil
+}
+
+func renderJSON(w io.Writer, report *Report) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+func renderDot(w io.Writer, report *Report) error {
+	fmt.Fprintln(w, "digraph merkle {")
+	fmt.Fprintln(w, "  node [shape=box, fontname=monospace];")
+
+	seen := make(map[string]struct{})
+
+	var visit func(node *Node)
+	visit = func(node *Node) {
+		id := hash.Format(node.Hash)
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+
+			attrs := ""
+			switch {
+			case node.Missing:
+				attrs = ", color=red, style=dashed"
+			case node.Error != "":
+				attrs = ", color=red"
+			case node.Type == "RootType":
+				attrs = ", style=bold"
+			}
+			fmt.Fprintf(w, "  %q [label=%q%s];\n", id, describe(node), attrs)
+		}
+
+		for _, child := range node.Children {
+			fmt.Fprintf(w, "  %q -> %q [label=%q];\n", id, hash.Format(child.Hash), child.Side)
+			visit(child)
+		}
+	}
+
+	for _, root := range report.Roots {
+		visit(root)
+	}
+
+	for _, orphan := range report.Orphans {
+		id := hash.Format(orphan)
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		fmt.Fprintf(w, "  %q [label=%q, color=gray];\n", id, short(orphan)+" orphan")
+	}
+
+	for _, unknown := range report.Unknown {
+		fmt.Fprintf(w, "  %q [label=%q, color=orange];\n", hash.Format(unknown.Hash), short(unknown.Hash)+" unknown")
+	}
+
+	fmt.Fprintln(w, "}")
+
+	return nil
+}
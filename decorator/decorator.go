@@ -0,0 +1,369 @@
+package decorator
+
+import (
+	"context"
+	"io"
+	"iter"
+	"reflect"
+
+	"github.com/alinz/storage.go"
+)
+
+// Layer overrides some methods of the storage it wraps, every nil field is
+// forwarded to next. Overrides get the next storage so a layer can be
+// applied to a Tx as well
+type Layer struct {
+	Put    func(ctx context.Context, r io.Reader, next storage.Putter) ([]byte, int64, error)
+	Get    func(ctx context.Context, hash []byte, next storage.Getter) (io.ReadCloser, error)
+	Remove func(ctx context.Context, hash []byte, next storage.Remover) error
+	List   func(next storage.Lister) (storage.IteratorFunc, storage.CancelFunc)
+	Close  func(next storage.Closer) error
+}
+
+// Storage implements every interface of the storage package. Methods
+// missing from next return storage.ErrNotSupported, except Close which
+// does nothing.
+//
+// Optional interfaces are only forwarded to next if the layer doesn't
+// override the methods they are derived from, e.g. if Get is overridden,
+// Stat, Has, GetRange and GetBatch use the generic fallbacks on top of the
+// overridden Get. Storage is a storage.Optional, so the helpers of the
+// storage package only use such an interface if next serves it as well
+type Storage struct {
+	next  any
+	layer Layer
+}
+
+var _ storage.Putter = (*Storage)(nil)
+var _ storage.Getter = (*Storage)(nil)
+var _ storage.RangeGetter = (*Storage)(nil)
+var _ storage.Remover = (*Storage)(nil)
+var _ storage.Lister = (*Storage)(nil)
+var _ storage.SeqLister = (*Storage)(nil)
+var _ storage.PageLister = (*Storage)(nil)
+var _ storage.EntryLister = (*Storage)(nil)
+var _ storage.Stater = (*Storage)(nil)
+var _ storage.Haser = (*Storage)(nil)
+var _ storage.BatchPutter = (*Storage)(nil)
+var _ storage.BatchGetter = (*Storage)(nil)
+var _ storage.BatchRemover = (*Storage)(nil)
+var _ storage.Transactioner = (*Storage)(nil)
+var _ storage.Watcher = (*Storage)(nil)
+var _ storage.Closer = (*Storage)(nil)
+var _ storage.Optional = (*Storage)(nil)
+
+func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	if s.layer.Put != nil {
+		return s.layer.Put(ctx, r, s.putter())
+	}
+
+	return s.putter().Put(ctx, r)
+}
+
+func (s *Storage) Get(ctx context.Context, hash []byte) (io.ReadCloser, error) {
+	if s.layer.Get != nil {
+		return s.layer.Get(ctx, hash, s.getter())
+	}
+
+	return s.getter().Get(ctx, hash)
+}
+
+func (s *Storage) Remove(ctx context.Context, hash []byte) error {
+	if s.layer.Remove != nil {
+		return s.layer.Remove(ctx, hash, s.remover())
+	}
+
+	return s.remover().Remove(ctx, hash)
+}
+
+func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
+	if s.layer.List != nil {
+		return s.layer.List(s.lister())
+	}
+
+	return s.lister().List()
+}
+
+func (s *Storage) Close() error {
+	closer, ok := storage.As[storage.Closer](s.next)
+	if !ok {
+		closer = nopCloser{}
+	}
+
+	if s.layer.Close != nil {
+		return s.layer.Close(closer)
+	}
+
+	return closer.Close()
+}
+
+func (s *Storage) GetRange(ctx context.Context, hash []byte, offset int64, length int64) (io.ReadCloser, error) {
+	return storage.GetRange(ctx, s.readGetter(), hash, offset, length)
+}
+
+func (s *Storage) Stat(ctx context.Context, hash []byte) (storage.Info, error) {
+	return storage.Stat(ctx, s.readGetter(), hash)
+}
+
+func (s *Storage) Has(ctx context.Context, hash []byte) (bool, error) {
+	return storage.Has(ctx, s.readGetter(), hash)
+}
+
+func (s *Storage) GetBatch(ctx context.Context, hashes [][]byte) ([]storage.GetResult, error) {
+	return storage.GetBatch(ctx, s.readGetter(), hashes)
+}
+
+func (s *Storage) PutBatch(ctx context.Context, rs []io.Reader) ([]storage.PutResult, error) {
+	if s.layer.Put != nil {
+		return storage.PutBatch(ctx, view{s}, rs)
+	}
+
+	return storage.PutBatch(ctx, s.putter(), rs)
+}
+
+func (s *Storage) RemoveBatch(ctx context.Context, hashes [][]byte) ([]error, error) {
+	if s.layer.Remove != nil {
+		return storage.RemoveBatch(ctx, view{s}, hashes)
+	}
+
+	return storage.RemoveBatch(ctx, s.remover(), hashes)
+}
+
+func (s *Storage) All(ctx context.Context) iter.Seq2[[]byte, error] {
+	return storage.All(ctx, s.readLister())
+}
+
+func (s *Storage) ListPage(ctx context.Context, opts storage.ListOptions) (*storage.Page, error) {
+	return storage.ListPage(ctx, s.readLister(), opts)
+}
+
+func (s *Storage) Entries(ctx context.Context) iter.Seq2[storage.Entry, error] {
+	if s.layer.List != nil || s.layer.Get != nil {
+		return storage.Entries(ctx, statView{view{s}})
+	}
+
+	return storage.Entries(ctx, s.lister())
+}
+
+// Begin applies the Put and Get overrides of the layer to the Tx of next
+func (s *Storage) Begin(ctx context.Context) (storage.Tx, error) {
+	transactioner, ok := storage.As[storage.Transactioner](s.next)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+
+	t, err := transactioner.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tx{Tx: t, layer: s.layer}, nil
+}
+
+func (s *Storage) Watch(ctx context.Context) iter.Seq2[storage.Event, error] {
+	if watcher, ok := storage.As[storage.Watcher](s.next); ok {
+		return watcher.Watch(ctx)
+	}
+
+	return func(yield func(storage.Event, error) bool) {
+		yield(storage.Event{}, storage.ErrNotSupported)
+	}
+}
+
+// Implements reports whether next serves the interface target points to
+// and the layer doesn't override the methods it is derived from. Overridden
+// core methods are always served
+func (s *Storage) Implements(target any) bool {
+	switch target.(type) {
+	case *storage.Putter:
+		return s.layer.Put != nil || implements(s.next, target)
+	case *storage.Getter:
+		return s.layer.Get != nil || implements(s.next, target)
+	case *storage.Remover:
+		return s.layer.Remove != nil || implements(s.next, target)
+	case *storage.Lister:
+		return s.layer.List != nil || implements(s.next, target)
+	case *storage.Closer:
+		return s.layer.Close != nil || implements(s.next, target)
+	case *storage.RangeGetter, *storage.Stater, *storage.Haser, *storage.BatchGetter:
+		return s.layer.Get == nil && implements(s.next, target)
+	case *storage.BatchPutter:
+		return s.layer.Put == nil && implements(s.next, target)
+	case *storage.BatchRemover:
+		return s.layer.Remove == nil && implements(s.next, target)
+	case *storage.SeqLister, *storage.PageLister:
+		return s.layer.List == nil && implements(s.next, target)
+	case *storage.EntryLister:
+		return s.layer.List == nil && s.layer.Get == nil && implements(s.next, target)
+	default:
+		return implements(s.next, target)
+	}
+}
+
+// implements reports whether next has the methods of the interface
+// target points to and, if next is an Optional too, serves it
+func implements(next any, target any) bool {
+	if next == nil {
+		return false
+	}
+
+	if !reflect.TypeOf(next).Implements(reflect.TypeOf(target).Elem()) {
+		return false
+	}
+
+	if optional, ok := next.(storage.Optional); ok {
+		return optional.Implements(target)
+	}
+
+	return true
+}
+
+func (s *Storage) putter() storage.Putter {
+	if putter, ok := storage.As[storage.Putter](s.next); ok {
+		return putter
+	}
+
+	return unsupported{}
+}
+
+func (s *Storage) getter() storage.Getter {
+	if getter, ok := storage.As[storage.Getter](s.next); ok {
+		return getter
+	}
+
+	return unsupported{}
+}
+
+func (s *Storage) remover() storage.Remover {
+	if remover, ok := storage.As[storage.Remover](s.next); ok {
+		return remover
+	}
+
+	return unsupported{}
+}
+
+func (s *Storage) lister() storage.Lister {
+	if lister, ok := storage.As[storage.Lister](s.next); ok {
+		return lister
+	}
+
+	return unsupported{}
+}
+
+// readGetter returns next if Get is not overridden, so its optional
+// interfaces are used, otherwise a getter going through the override
+func (s *Storage) readGetter() storage.Getter {
+	if s.layer.Get != nil {
+		return view{s}
+	}
+
+	return s.getter()
+}
+
+func (s *Storage) readLister() storage.Lister {
+	if s.layer.List != nil {
+		return view{s}
+	}
+
+	return s.lister()
+}
+
+// Wrap returns a storage which applies layer on top of next, next
+// should implement at least one of the storage interfaces
+func Wrap(next any, layer Layer) *Storage {
+	return &Storage{
+		next:  next,
+		layer: layer,
+	}
+}
+
+// Chain applies layers on top of next, the first layer is the
+// outermost one, so it is the first to see each call
+func Chain(next any, layers ...Layer) *Storage {
+	if len(layers) == 0 {
+		return Wrap(next, Layer{})
+	}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		next = Wrap(next, layers[i])
+	}
+
+	return next.(*Storage)
+}
+
+// view only exposes the core methods of a Storage, so the generic
+// fallbacks of the storage package go through the overrides
+type view struct {
+	s *Storage
+}
+
+func (v view) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	return v.s.Put(ctx, r)
+}
+
+func (v view) Get(ctx context.Context, hash []byte) (io.ReadCloser, error) {
+	return v.s.Get(ctx, hash)
+}
+
+func (v view) Remove(ctx context.Context, hash []byte) error {
+	return v.s.Remove(ctx, hash)
+}
+
+func (v view) List() (storage.IteratorFunc, storage.CancelFunc) {
+	return v.s.List()
+}
+
+type statView struct {
+	view
+}
+
+func (v statView) Stat(ctx context.Context, hash []byte) (storage.Info, error) {
+	return v.s.Stat(ctx, hash)
+}
+
+type tx struct {
+	storage.Tx
+	layer Layer
+}
+
+func (t *tx) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	if t.layer.Put != nil {
+		return t.layer.Put(ctx, r, t.Tx)
+	}
+
+	return t.Tx.Put(ctx, r)
+}
+
+func (t *tx) Get(ctx context.Context, hash []byte) (io.ReadCloser, error) {
+	if t.layer.Get != nil {
+		return t.layer.Get(ctx, hash, t.Tx)
+	}
+
+	return t.Tx.Get(ctx, hash)
+}
+
+type unsupported struct{}
+
+func (unsupported) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	return nil, 0, storage.ErrNotSupported
+}
+
+func (unsupported) Get(ctx context.Context, hash []byte) (io.ReadCloser, error) {
+	return nil, storage.ErrNotSupported
+}
+
+func (unsupported) Remove(ctx context.Context, hash []byte) error {
+	return storage.ErrNotSupported
+}
+
+func (unsupported) List() (storage.IteratorFunc, storage.CancelFunc) {
+	return func(ctx context.Context) ([]byte, error) {
+		return nil, storage.ErrNotSupported
+	}, func() {}
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
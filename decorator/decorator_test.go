@@ -0,0 +1,185 @@
+package decorator_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/decorator"
+	"github.com/alinz/storage.go/kv/boltdb"
+	"github.com/alinz/storage.go/memory"
+	"github.com/alinz/storage.go/merkle"
+)
+
+// upper returns a layer which stores contents as they are and
+// returns them in upper case
+func upper() decorator.Layer {
+	return decorator.Layer{
+		Get: func(ctx context.Context, hash []byte, next storage.Getter) (io.ReadCloser, error) {
+			rc, err := next.Get(ctx, hash)
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+
+			b, err := io.ReadAll(rc)
+			if err != nil {
+				return nil, err
+			}
+
+			return io.NopCloser(bytes.NewReader(bytes.ToUpper(b))), nil
+		},
+	}
+}
+
+// tag returns a layer which appends name to every content put through it
+func tag(name string) decorator.Layer {
+	return decorator.Layer{
+		Put: func(ctx context.Context, r io.Reader, next storage.Putter) ([]byte, int64, error) {
+			return next.Put(ctx, io.MultiReader(r, strings.NewReader(name)))
+		},
+	}
+}
+
+// readAll returns the content of rc, or the error if there is any
+func readAll(rc io.ReadCloser, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	defer rc.Close()
+
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return err.Error()
+	}
+
+	return string(b)
+}
+
+func TestDecorator(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("forward every method which is not overridden", func(t *testing.T) {
+		backend := memory.New()
+		decorated := decorator.Wrap(backend, upper())
+
+		hashValue, _, err := decorated.Put(ctx, strings.NewReader("hello"))
+		assert.NoError(t, err)
+
+		assert.Equal(t, "HELLO", readAll(decorated.Get(ctx, hashValue)))
+		assert.Equal(t, "hello", readAll(backend.Get(ctx, hashValue)))
+
+		ok, err := decorated.Has(ctx, hashValue)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		var hashes [][]byte
+		for hashValue, err := range decorated.All(ctx) {
+			assert.NoError(t, err)
+			hashes = append(hashes, hashValue)
+		}
+		assert.Equal(t, [][]byte{hashValue}, hashes)
+
+		assert.NoError(t, decorated.Remove(ctx, hashValue))
+
+		_, err = backend.Get(ctx, hashValue)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		assert.NoError(t, decorated.Close())
+	})
+
+	t.Run("derived reads go through the overridden get", func(t *testing.T) {
+		decorated := decorator.Wrap(memory.New(), upper())
+
+		hashValue, _, err := decorated.Put(ctx, strings.NewReader("hello world"))
+		assert.NoError(t, err)
+
+		assert.Equal(t, "WORLD", readAll(decorated.GetRange(ctx, hashValue, 6, -1)))
+		assert.Equal(t, "WORLD", readAll(storage.GetRange(ctx, decorated, hashValue, 6, 5)))
+
+		results, err := decorated.GetBatch(ctx, [][]byte{hashValue})
+		assert.NoError(t, err)
+		assert.Equal(t, "HELLO WORLD", readAll(results[0].Reader, results[0].Err))
+	})
+
+	t.Run("missing methods are not supported", func(t *testing.T) {
+		decorated := decorator.Wrap(struct{ storage.Putter }{memory.New()}, decorator.Layer{})
+
+		_, err := decorated.Get(ctx, []byte("hash"))
+		assert.ErrorIs(t, err, storage.ErrNotSupported)
+
+		assert.ErrorIs(t, decorated.Remove(ctx, []byte("hash")), storage.ErrNotSupported)
+
+		_, err = decorated.Begin(ctx)
+		assert.ErrorIs(t, err, storage.ErrNotSupported)
+
+		assert.NoError(t, decorated.Close())
+	})
+
+	t.Run("optional interfaces are only served if next has them", func(t *testing.T) {
+		decorated := decorator.Wrap(struct{ storage.Getter }{memory.New()}, decorator.Layer{})
+
+		_, ok := storage.As[storage.Haser](decorated)
+		assert.False(t, ok)
+		_, ok = storage.As[storage.Transactioner](decorated)
+		assert.False(t, ok)
+		_, ok = storage.As[storage.Putter](decorated)
+		assert.False(t, ok)
+		_, ok = storage.As[storage.Getter](decorated)
+		assert.True(t, ok)
+
+		decorated = decorator.Chain(memory.New(), decorator.Layer{}, upper())
+
+		_, ok = storage.As[storage.Haser](decorated)
+		assert.False(t, ok, "get is overridden by the inner layer")
+		_, ok = storage.As[storage.SeqLister](decorated)
+		assert.True(t, ok)
+		_, ok = storage.As[storage.Transactioner](decorated)
+		assert.False(t, ok)
+	})
+
+	t.Run("chain applies the first layer last", func(t *testing.T) {
+		backend := memory.New()
+		decorated := decorator.Chain(backend, tag("-outer"), tag("-inner"), upper())
+
+		hashValue, _, err := decorated.Put(ctx, strings.NewReader("hello"))
+		assert.NoError(t, err)
+
+		assert.Equal(t, "hello-outer-inner", readAll(backend.Get(ctx, hashValue)))
+		assert.Equal(t, "HELLO-OUTER-INNER", readAll(decorated.Get(ctx, hashValue)))
+	})
+
+	t.Run("layers are applied to transactions", func(t *testing.T) {
+		backend, err := boltdb.New(t.TempDir() + "/bolt.db")
+		assert.NoError(t, err)
+		defer backend.Close()
+
+		decorated := decorator.Chain(backend, tag("-tx"), upper())
+
+		tx, err := decorated.Begin(ctx)
+		assert.NoError(t, err)
+		defer tx.Rollback()
+
+		hashValue, _, err := tx.Put(ctx, strings.NewReader("hello"))
+		assert.NoError(t, err)
+		assert.Equal(t, "HELLO-TX", readAll(tx.Get(ctx, hashValue)))
+		assert.NoError(t, tx.Commit())
+
+		assert.Equal(t, "hello-tx", readAll(backend.Get(ctx, hashValue)))
+	})
+
+	t.Run("merkle on top of a decorated backend", func(t *testing.T) {
+		backend := memory.New()
+		decorated := decorator.Wrap(backend, decorator.Layer{})
+		merkleStorage := merkle.New(decorated, decorated, decorated, 4)
+
+		hashValue, _, err := merkleStorage.Put(ctx, strings.NewReader("hello world"))
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world", readAll(merkleStorage.Get(ctx, hashValue)))
+	})
+}
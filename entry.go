@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"iter"
+)
+
+// Entries uses EntryLister if lister implements it, otherwise every hash
+// of the listing is completed with Stat if lister is a Stater as well
+func Entries(ctx context.Context, lister Lister) iter.Seq2[Entry, error] {
+	if entryLister, ok := As[EntryLister](lister); ok {
+		return entryLister.Entries(ctx)
+	}
+
+	stater, _ := As[Stater](lister)
+
+	return func(yield func(Entry, error) bool) {
+		for hashValue, err := range All(ctx, lister) {
+			if err != nil {
+				yield(Entry{}, err)
+				return
+			}
+
+			entry := Entry{Hash: hashValue, Size: -1}
+
+			if stater != nil {
+				info, err := stater.Stat(ctx, hashValue)
+				if errors.Is(err, ErrNotFound) {
+					// removed while listing
+					continue
+				} else if err != nil {
+					yield(Entry{}, err)
+					return
+				}
+
+				entry.Size = info.Size
+				entry.ModTime = info.ModTime
+			}
+
+			if !yield(entry, nil) {
+				return
+			}
+		}
+	}
+}
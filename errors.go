@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/alinz/hash.go"
+)
+
+// Error describes a failed operation, Err wraps one of the sentinel errors
+// and usually the error of the underlying driver as well, so both can be
+// checked with errors.Is. Hash is nil if the operation is not about a
+// single content
+type Error struct {
+	Op   string
+	Hash []byte
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if len(e.Hash) == 0 {
+		return e.Op + ": " + e.Err.Error()
+	}
+
+	return e.Op + " " + hash.Format(e.Hash) + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NewError wraps err into an Error, nil and errors which already
+// are an Error are returned as they are, so layers don't repeat what
+// the backend already said
+func NewError(op string, hash []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+
+	return &Error{Op: op, Hash: hash, Err: err}
+}
+
+// IsRetryable reports whether the failed operation might succeed if it is
+// tried again later
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrUnavailable)
+}
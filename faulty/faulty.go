@@ -0,0 +1,244 @@
+// Package faulty wraps a backend and injects failures, so error paths of
+// the layers built on top of it (merkle, secure, ...) can be tested
+package faulty
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/alinz/hash.go"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/decorator"
+)
+
+var ErrInjected = errors.New("injected fault")
+
+type config struct {
+	failPutAfter int64
+	failGetAfter int64
+	corruptRate  float64
+	latency      time.Duration
+	dropRate     float64
+	notFoundRate float64
+}
+
+type Option func(*config)
+
+// FailPutAfter makes every Put fail with ErrInjected once n bytes of the
+// content are read, the backend sees the first n bytes
+func FailPutAfter(n int64) Option {
+	return func(c *config) {
+		c.failPutAfter = n
+	}
+}
+
+// FailGetAfter makes every reader returned by Get fail with
+// ErrInjected once n bytes are read
+func FailGetAfter(n int64) Option {
+	return func(c *config) {
+		c.failGetAfter = n
+	}
+}
+
+// CorruptReads flips a bit of each byte read through Get with
+// the given probability
+func CorruptReads(rate float64) Option {
+	return func(c *config) {
+		c.corruptRate = rate
+	}
+}
+
+// Latency delays every Put and Get, the delay ends early if the
+// context is done
+func Latency(d time.Duration) Option {
+	return func(c *config) {
+		c.latency = d
+	}
+}
+
+// DropWrites makes Put succeed without storing the content
+// with the given probability
+func DropWrites(rate float64) Option {
+	return func(c *config) {
+		c.dropRate = rate
+	}
+}
+
+// NotFound makes Get return storage.ErrNotFound with
+// the given probability
+func NotFound(rate float64) Option {
+	return func(c *config) {
+		c.notFoundRate = rate
+	}
+}
+
+// Storage forwards everything which is not faulty to the wrapped backend.
+// The same seed and the same sequence of calls inject the same faults,
+// calls made from many goroutines share the random source so their
+// order decides which call gets which fault
+type Storage struct {
+	*decorator.Storage
+	config config
+	mu     sync.Mutex
+	rng    *rand.Rand
+}
+
+// chance reports whether an event of the given probability happens
+func (s *Storage) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rng.Float64() < rate
+}
+
+func (s *Storage) bit() byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return 1 << s.rng.IntN(8)
+}
+
+func (s *Storage) wait(ctx context.Context) error {
+	if s.config.latency <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(s.config.latency)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (s *Storage) put(ctx context.Context, r io.Reader, next storage.Putter) ([]byte, int64, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, 0, storage.NewError("put", nil, err)
+	}
+
+	if s.config.failPutAfter == 0 {
+		return nil, 0, storage.NewError("put", nil, ErrInjected)
+	} else if s.config.failPutAfter > 0 {
+		r = &failingReader{r: r, remaining: s.config.failPutAfter}
+	}
+
+	if s.chance(s.config.dropRate) {
+		hr := hash.NewReader(r)
+		n, err := io.Copy(io.Discard, hr)
+		if err != nil {
+			return nil, 0, storage.NewError("put", nil, err)
+		}
+
+		return hr.Hash(), n, nil
+	}
+
+	return next.Put(ctx, r)
+}
+
+func (s *Storage) get(ctx context.Context, hashValue []byte, next storage.Getter) (io.ReadCloser, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, storage.NewError("get", hashValue, err)
+	}
+
+	if s.chance(s.config.notFoundRate) {
+		return nil, storage.NewError("get", hashValue, storage.ErrNotFound)
+	}
+
+	rc, err := next.Get(ctx, hashValue)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = rc
+	if s.config.failGetAfter >= 0 {
+		r = &failingReader{r: r, remaining: s.config.failGetAfter}
+	}
+
+	if s.config.corruptRate > 0 {
+		r = &corruptingReader{r: r, storage: s}
+	}
+
+	return readCloser{Reader: r, Closer: rc}, nil
+}
+
+// New wraps next, faults are only injected for the given options
+func New(next any, seed uint64, opts ...Option) *Storage {
+	s := &Storage{
+		config: config{
+			failPutAfter: -1,
+			failGetAfter: -1,
+		},
+		rng: rand.New(rand.NewPCG(seed, seed)),
+	}
+
+	for _, opt := range opts {
+		opt(&s.config)
+	}
+
+	s.Storage = decorator.Wrap(next, decorator.Layer{
+		Put: s.put,
+		Get: s.get,
+	})
+
+	return s
+}
+
+// failingReader returns ErrInjected along with the last allowed bytes,
+// a (0, err) read would look like the end of the content to hash.Reader
+type failingReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (f *failingReader) Read(b []byte) (int, error) {
+	if f.remaining <= 0 {
+		return 0, ErrInjected
+	}
+
+	if int64(len(b)) > f.remaining {
+		b = b[:f.remaining]
+	}
+
+	n, err := f.r.Read(b)
+	f.remaining -= int64(n)
+
+	if f.remaining <= 0 {
+		return n, ErrInjected
+	}
+
+	return n, err
+}
+
+type corruptingReader struct {
+	r       io.Reader
+	storage *Storage
+}
+
+func (c *corruptingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+
+	for i := range b[:n] {
+		if c.storage.chance(c.storage.config.corruptRate) {
+			b[i] ^= c.storage.bit()
+		}
+	}
+
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
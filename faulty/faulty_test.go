@@ -0,0 +1,144 @@
+package faulty_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alinz/hash.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/faulty"
+	"github.com/alinz/storage.go/kv/boltdb"
+	"github.com/alinz/storage.go/memory"
+	"github.com/alinz/storage.go/merkle"
+	"github.com/alinz/storage.go/secure"
+)
+
+func read(rc io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+func TestFaulty(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("hello world, this is a merkle tree")
+
+	t.Run("the same seed injects the same faults", func(t *testing.T) {
+		backend := memory.New()
+		hashValue, _, err := backend.Put(ctx, bytes.NewReader(content))
+		assert.NoError(t, err)
+
+		results := func(seed uint64) []bool {
+			f := faulty.New(backend, seed, faulty.NotFound(0.5))
+
+			var found []bool
+			for i := 0; i < 64; i++ {
+				_, err := f.Get(ctx, hashValue)
+				found = append(found, err == nil)
+			}
+			return found
+		}
+
+		assert.Equal(t, results(1), results(1))
+		assert.NotEqual(t, results(1), results(2))
+		assert.Contains(t, results(1), true)
+		assert.Contains(t, results(1), false)
+	})
+
+	t.Run("a failed merkle put leaves nothing behind", func(t *testing.T) {
+		backend, err := boltdb.New(filepath.Join(t.TempDir(), "bolt.db"))
+		assert.NoError(t, err)
+		defer backend.Close()
+
+		f := faulty.New(backend, 1, faulty.FailPutAfter(3))
+		merkleStorage := merkle.New(f, f, f, 4)
+
+		_, _, err = merkleStorage.Put(ctx, bytes.NewReader(content))
+		assert.ErrorIs(t, err, faulty.ErrInjected)
+
+		for _, err := range storage.All(ctx, backend) {
+			assert.NoError(t, err)
+			t.Fatal("the failed put stored a node")
+		}
+	})
+
+	t.Run("merkle get fails if a node is missing", func(t *testing.T) {
+		backend := memory.New()
+		f := faulty.New(backend, 1, faulty.NotFound(0.2))
+		merkleStorage := merkle.New(f, backend, backend, 4)
+
+		hashValue, _, err := merkle.New(backend, backend, backend, 4).Put(ctx, bytes.NewReader(content))
+		assert.NoError(t, err)
+
+		_, err = read(merkleStorage.Get(ctx, hashValue))
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("dropped writes are not found", func(t *testing.T) {
+		backend := memory.New()
+		f := faulty.New(backend, 1, faulty.DropWrites(1))
+
+		hashValue, n, err := f.Put(ctx, bytes.NewReader(content))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), n)
+		assert.Equal(t, hash.Bytes(content), hash.Value(hashValue))
+
+		_, err = backend.Get(ctx, hashValue)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("secure get fails while reading", func(t *testing.T) {
+		backend := memory.New()
+		secureStorage := secure.Wrap(faulty.New(backend, 1, faulty.FailGetAfter(5)), []byte("secret"))
+
+		hashValue, _, err := secureStorage.Put(ctx, bytes.NewReader(content))
+		assert.NoError(t, err)
+
+		plaintext, err := read(secureStorage.Get(ctx, hashValue))
+		assert.ErrorIs(t, err, faulty.ErrInjected)
+		assert.Less(t, len(plaintext), len(content))
+	})
+
+	t.Run("corrupted reads", func(t *testing.T) {
+		backend := memory.New()
+		f := faulty.New(backend, 1, faulty.CorruptReads(0.5))
+
+		hashValue, _, err := backend.Put(ctx, bytes.NewReader(content))
+		assert.NoError(t, err)
+
+		corrupted, err := read(f.Get(ctx, hashValue))
+		assert.NoError(t, err)
+		assert.Len(t, corrupted, len(content))
+		assert.NotEqual(t, content, corrupted)
+
+		// merkle either can't parse the corrupted nodes or returns another content
+		merkleBackend := memory.New()
+		rootHash, _, err := merkle.New(merkleBackend, merkleBackend, merkleBackend, 4).Put(ctx, bytes.NewReader(content))
+		assert.NoError(t, err)
+
+		f = faulty.New(merkleBackend, 1, faulty.CorruptReads(0.5))
+		value, err := read(merkle.New(f, f, f, 4).Get(ctx, rootHash))
+		if err == nil {
+			assert.NotEqual(t, content, value)
+		}
+	})
+
+	t.Run("latency ends with the context", func(t *testing.T) {
+		f := faulty.New(memory.New(), 1, faulty.Latency(time.Hour))
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		_, _, err := f.Put(ctx, bytes.NewReader(content))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
@@ -3,55 +3,77 @@ package storage
 import (
 	"context"
 	"errors"
+	"iter"
 )
 
 var (
 	ErrIteratorDone = errors.New("iterator is done")
 )
 
+// IteratorFunc returns ErrIteratorDone once there are no more values,
+// it is not safe for concurrent use
 type IteratorFunc func(ctx context.Context) ([]byte, error)
 type YieldFunc func([]byte, error) bool
 type MapperFunc func(YieldFunc)
 type CancelFunc func()
 
+// Iterator stops the mapper as soon as it yields an error
 func Iterator(mapper MapperFunc) (IteratorFunc, CancelFunc) {
-	values := make(chan []byte, 1)
-	done := make(chan struct{}, 1)
-	errs := make(chan error, 1)
+	return Pull(func(yield func([]byte, error) bool) {
+		mapper(func(value []byte, err error) bool {
+			return yield(value, err) && err == nil
+		})
+	})
+}
 
-	go func() {
-		defer close(values)
+// Pull converts seq to an IteratorFunc, seq runs as a coroutine
+// so no goroutine or channel is needed
+func Pull(seq iter.Seq2[[]byte, error]) (IteratorFunc, CancelFunc) {
+	next, stop := iter.Pull2(seq)
 
-		mapper(func(value []byte, err error) bool {
-			if err != nil {
-				errs <- err
-				return false
-			}
+	return func(ctx context.Context) ([]byte, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		value, err, ok := next()
+		if !ok {
+			return nil, ErrIteratorDone
+		}
 
-			select {
-			case <-done:
-				return false
-			case values <- value:
-				return true
+		return value, err
+	}, CancelFunc(stop)
+}
+
+// Seq converts an IteratorFunc to a range-over-func iterator,
+// cancel is called once the loop is done
+func Seq(ctx context.Context, next IteratorFunc, cancel CancelFunc) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		defer cancel()
+
+		for {
+			value, err := next(ctx)
+			if errors.Is(err, ErrIteratorDone) {
+				return
 			}
-		})
-	}()
 
-	iter := func(ctx context.Context) ([]byte, error) {
-		select {
-		case <-ctx.Done():
-			return nil, context.Canceled
-		case err := <-errs:
-			return nil, err
-		case value, ok := <-values:
-			if !ok {
-				return nil, ErrIteratorDone
+			if !yield(value, err) || err != nil {
+				return
 			}
-			return value, nil
 		}
 	}
+}
+
+// All uses SeqLister if lister implements it, otherwise List is converted
+func All(ctx context.Context, lister Lister) iter.Seq2[[]byte, error] {
+	if seqLister, ok := As[SeqLister](lister); ok {
+		return seqLister.All(ctx)
+	}
 
-	return iter, func() {
-		close(done)
+	// List is only called once the loop starts, so an unused
+	// sequence doesn't hold anything
+	return func(yield func([]byte, error) bool) {
+		next, cancel := lister.List()
+		Seq(ctx, next, cancel)(yield)
 	}
 }
@@ -3,9 +3,13 @@ package boltdb
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"iter"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/alinz/hash.go"
@@ -16,111 +20,925 @@ import (
 
 var bucketName = []byte("data")
 
+// chunksBucketName holds the chunks of the values larger than chunkSize,
+// their keys are the id of the value followed by the sequence of the chunk
+var chunksBucketName = []byte("chunks")
+
+// chunkSize is the largest value stored under its hash, a larger value is
+// a bucket under its hash holding the id of its chunks and its size
+const chunkSize = 1 << 20
+
+// chunkPool holds the read buffers of put
+var chunkPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, chunkSize)
+		return &buf
+	},
+}
+
+var (
+	chunkIDKey   = []byte("id")
+	chunkSizeKey = []byte("size")
+)
+
+// namespacesBucketName holds a bucket for every store opened WithBucket,
+// each with its own data and chunks buckets
+var namespacesBucketName = []byte("namespaces")
+
+var errMissingBucket = fmt.Errorf("%w: bucket not found", storage.ErrCorrupted)
+
 type Storage struct {
-	db *bolt.DB
+	db      *bolt.DB
+	buckets buckets
+
+	// update is db.Update, or db.Batch WithBatch
+	update func(func(*bolt.Tx) error) error
+}
+
+type options struct {
+	bucket   string
+	mode     os.FileMode
+	timeout  time.Duration
+	noSync   bool
+	batch    bool
+	readOnly bool
+}
+
+type Option func(*options)
+
+// WithBucket keeps the contents in a bucket of their own, stores with
+// different buckets share a file without seeing each other's contents.
+// Without it the contents are in the buckets of the older versions
+func WithBucket(name string) Option {
+	return func(o *options) {
+		o.bucket = name
+	}
+}
+
+// WithFileMode sets the mode of the file if New creates it,
+// os.ModePerm by default
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.mode = mode
+	}
+}
+
+// WithTimeout sets how long New waits for the lock of the file, a file
+// opened for writing by another process is locked. 2 seconds by default
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithNoSync skips the fsync of every commit, a crash can lose the
+// last commits or corrupt the file
+func WithNoSync() Option {
+	return func(o *options) {
+		o.noSync = true
+	}
+}
+
+// WithBatch commits the Puts of concurrent goroutines together with
+// db.Batch, a Put waits up to bolt's MaxBatchDelay for the others
+func WithBatch() Option {
+	return func(o *options) {
+		o.batch = true
+	}
+}
+
+// WithReadOnly opens the file with a shared lock, the writes fail with
+// storage.ErrReadOnly. The file and its bucket must exist
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// buckets finds the buckets of a store, a nil namespace is the
+// top level buckets of the older versions
+type buckets struct {
+	namespace []byte
+}
+
+func (bk buckets) bucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	if bk.namespace == nil {
+		return tx.Bucket(name)
+	}
+
+	namespaces := tx.Bucket(namespacesBucketName)
+	if namespaces == nil {
+		return nil
+	}
+
+	namespace := namespaces.Bucket(bk.namespace)
+	if namespace == nil {
+		return nil
+	}
+
+	return namespace.Bucket(name)
+}
+
+func (bk buckets) data(tx *bolt.Tx) *bolt.Bucket {
+	return bk.bucket(tx, bucketName)
+}
+
+func (bk buckets) chunks(tx *bolt.Tx) *bolt.Bucket {
+	return bk.bucket(tx, chunksBucketName)
+}
+
+func (bk buckets) create(tx *bolt.Tx) error {
+	parent := bucketCreator(tx)
+	if bk.namespace != nil {
+		namespaces, err := tx.CreateBucketIfNotExists(namespacesBucketName)
+		if err != nil {
+			return err
+		}
+
+		if parent, err = namespaces.CreateBucketIfNotExists(bk.namespace); err != nil {
+			return err
+		}
+	}
+
+	if _, err := parent.CreateBucketIfNotExists(bucketName); err != nil {
+		return err
+	}
+
+	_, err := parent.CreateBucketIfNotExists(chunksBucketName)
+	return err
+}
+
+// bucketCreator is what a transaction and a bucket have in common
+type bucketCreator interface {
+	CreateBucketIfNotExists(name []byte) (*bolt.Bucket, error)
 }
 
 var _ storage.Putter = (*Storage)(nil)
 var _ storage.Getter = (*Storage)(nil)
 var _ storage.Remover = (*Storage)(nil)
 var _ storage.Lister = (*Storage)(nil)
+var _ storage.SeqLister = (*Storage)(nil)
+var _ storage.EntryLister = (*Storage)(nil)
 var _ storage.Closer = (*Storage)(nil)
+var _ storage.Stater = (*Storage)(nil)
+var _ storage.Haser = (*Storage)(nil)
+var _ storage.RangeGetter = (*Storage)(nil)
+var _ storage.BatchPutter = (*Storage)(nil)
+var _ storage.BatchGetter = (*Storage)(nil)
+var _ storage.BatchRemover = (*Storage)(nil)
+var _ storage.Transactioner = (*Storage)(nil)
+var _ storage.PageLister = (*Storage)(nil)
 
+// Put stores a value up to chunkSize in a single Update, a larger value is
+// written a chunk per Update so only a couple of chunks are in memory. The
+// chunks of a Put a crash interrupted are removed by the next New
 func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	return s.buckets.put(ctx, s.update, r)
+}
+
+// put reads r a chunk at a time and writes with update, which is either
+// an Update of its own for every call or the same open transaction
+func (bk buckets) put(ctx context.Context, update func(func(*bolt.Tx) error) error, r io.Reader) (hashValue []byte, n int64, err error) {
+	var (
+		id      uint64
+		seq     uint64
+		pending []byte
+	)
+
+	// a failed put removes the chunks it already wrote
+	defer func() {
+		if err != nil && id != 0 {
+			update(func(tx *bolt.Tx) error {
+				return bk.removeChunks(tx, id)
+			})
+		}
+	}()
+
+	buf := chunkPool.Get().(*[]byte)
+	defer chunkPool.Put(buf)
+
 	hr := hash.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, wrapError("put", nil, err)
+		}
 
-	buffer := bytes.Buffer{}
+		read, readErr := io.ReadFull(hr, *buf)
+		if readErr != nil && !errors.Is(readErr, io.EOF) && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return nil, 0, wrapError("put", nil, readErr)
+		}
 
-	n, err := io.Copy(&buffer, hr)
-	if err != nil {
-		return nil, 0, err
+		if read > 0 {
+			// a second chunk means the value is larger than chunkSize
+			if pending != nil {
+				if id, err = bk.writeChunk(update, id, seq, pending); err != nil {
+					return nil, 0, wrapError("put", nil, err)
+				}
+				seq++
+			}
+
+			// bolt keeps the values it is given until the commit, the
+			// buffer is reused so pending is a copy of the exact size
+			pending = append([]byte(nil), (*buf)[:read]...)
+			n += int64(read)
+		}
+
+		if readErr != nil {
+			break
+		}
 	}
 
 	if n == 0 {
-		return nil, 0, io.EOF
+		return nil, 0, wrapError("put", nil, storage.ErrEmpty)
+	}
+
+	hashValue = hr.Hash()
+
+	if id != 0 {
+		if _, err = bk.writeChunk(update, id, seq, pending); err != nil {
+			return nil, 0, wrapError("put", hashValue, err)
+		}
 	}
 
-	hashValue := hr.Hash()
+	err = update(func(tx *bolt.Tx) error {
+		b := bk.data(tx)
+		if b == nil {
+			return errMissingBucket
+		}
 
-	err = s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
+		if b.Get(hashValue) != nil || b.Bucket(hashValue) != nil {
+			// if the hash value already exists, the chunks are not needed
+			if id != 0 {
+				return bk.removeChunks(tx, id)
+			}
+			return nil
+		}
+
+		if id == 0 {
+			return b.Put(hashValue, pending)
+		}
+
+		chunked, err := b.CreateBucket(hashValue)
 		if err != nil {
 			return err
 		}
 
-		return b.Put(hashValue, buffer.Bytes())
+		if err := chunked.Put(chunkIDKey, encodeUint64(id)); err != nil {
+			return err
+		}
+
+		return chunked.Put(chunkSizeKey, encodeUint64(uint64(n)))
+	})
+	if err != nil {
+		return nil, 0, wrapError("put", hashValue, err)
+	}
+
+	return hashValue, n, nil
+}
+
+// writeChunk stores a chunk of the value id, a new id is taken
+// for the first chunk. db.Batch can run fn again once rolled back,
+// so the id is only kept once update succeeds
+func (bk buckets) writeChunk(update func(func(*bolt.Tx) error) error, id uint64, seq uint64, chunk []byte) (uint64, error) {
+	var written uint64
+	err := update(func(tx *bolt.Tx) error {
+		chunks := bk.chunks(tx)
+		if chunks == nil {
+			return errMissingBucket
+		}
+
+		written = id
+		if written == 0 {
+			var err error
+			if written, err = chunks.NextSequence(); err != nil {
+				return err
+			}
+		}
+
+		return chunks.Put(chunkKey(written, seq), chunk)
 	})
+	if err != nil {
+		return id, err
+	}
+
+	return written, nil
+}
+
+func (bk buckets) removeChunks(tx *bolt.Tx, id uint64) error {
+	chunks := bk.chunks(tx)
+	if chunks == nil {
+		return errMissingBucket
+	}
+
+	prefix := encodeUint64(id)
+	c := chunks.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := chunks.Delete(k); err != nil {
+			return err
+		}
+	}
 
-	return hashValue, n, err
+	return nil
 }
 
+func chunkKey(id uint64, seq uint64) []byte {
+	return append(encodeUint64(id), encodeUint64(seq)...)
+}
+
+func encodeUint64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+// readAt copies the value from offset into p, chunks before offset are
+// skipped by their sequence as every chunk but the last is chunkSize
+func (bk buckets) readAt(tx *bolt.Tx, hashValue []byte, offset int64, p []byte) (int, error) {
+	b := bk.data(tx)
+	if b == nil {
+		return 0, errMissingBucket
+	}
+
+	if value := b.Get(hashValue); value != nil {
+		if offset >= int64(len(value)) {
+			return 0, nil
+		}
+		return copy(p, value[offset:]), nil
+	}
+
+	chunked := b.Bucket(hashValue)
+	if chunked == nil {
+		return 0, storage.ErrNotFound
+	}
+
+	chunks := bk.chunks(tx)
+	if chunks == nil {
+		return 0, errMissingBucket
+	}
+
+	id := binary.BigEndian.Uint64(chunked.Get(chunkIDKey))
+	prefix := encodeUint64(id)
+
+	n := 0
+	skip := offset % chunkSize
+	c := chunks.Cursor()
+	for k, v := c.Seek(chunkKey(id, uint64(offset/chunkSize))); k != nil && bytes.HasPrefix(k, prefix) && n < len(p); k, v = c.Next() {
+		if skip < int64(len(v)) {
+			n += copy(p[n:], v[skip:])
+		}
+		skip = 0
+	}
+
+	return n, nil
+}
+
+// size returns the size of the value without reading it
+func size(b *bolt.Bucket, hashValue []byte) (int64, bool) {
+	if value := b.Get(hashValue); value != nil {
+		return int64(len(value)), true
+	}
+
+	if chunked := b.Bucket(hashValue); chunked != nil {
+		return int64(binary.BigEndian.Uint64(chunked.Get(chunkSizeKey))), true
+	}
+
+	return 0, false
+}
+
+// Get returns a reader which copies the value a Read at a time, every
+// Read in a View of its own so no transaction outlives a call and the
+// reader doesn't hold back the writers
 func (s *Storage) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
-	var buffer bytes.Buffer
+	return s.GetRange(ctx, hashValue, 0, -1)
+}
+
+// GetRange skips the chunks before offset
+func (s *Storage) GetRange(ctx context.Context, hashValue []byte, offset int64, length int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError("get", hashValue, err)
+	}
 
+	if offset < 0 {
+		return nil, wrapError("get", hashValue, storage.ErrInvalidRange)
+	}
+
+	var valueSize int64
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
+		b := s.buckets.data(tx)
 		if b == nil {
-			return errors.New("bucket not found")
+			return errMissingBucket
 		}
 
-		value := b.Get(hashValue)
-		if value == nil {
+		var ok bool
+		if valueSize, ok = size(b, hashValue); !ok {
 			return storage.ErrNotFound
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, wrapError("get", hashValue, err)
+	}
+
+	remaining := max(valueSize-offset, 0)
+	if length >= 0 {
+		remaining = min(remaining, length)
+	}
+
+	return &rangeReader{
+		db:        s.db,
+		buckets:   s.buckets,
+		hashValue: hashValue,
+		offset:    offset,
+		remaining: remaining,
+	}, nil
+}
+
+func (s *Storage) Stat(ctx context.Context, hashValue []byte) (storage.Info, error) {
+	var info storage.Info
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.buckets.data(tx)
+		if b == nil {
+			return errMissingBucket
+		}
 
-		_, err := buffer.Write(value)
-		return err
+		var ok bool
+		if info.Size, ok = size(b, hashValue); !ok {
+			return storage.ErrNotFound
+		}
+
+		return nil
 	})
+
 	if err != nil {
-		return nil, err
+		return storage.Info{}, wrapError("stat", hashValue, err)
 	}
 
-	return io.NopCloser(&buffer), nil
+	return info, nil
+}
+
+func (s *Storage) Has(ctx context.Context, hashValue []byte) (bool, error) {
+	_, err := s.Stat(ctx, hashValue)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
 }
 
 func (s *Storage) Remove(ctx context.Context, hashValue []byte) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
-		return b.Delete(hashValue)
+	if err := ctx.Err(); err != nil {
+		return wrapError("remove", hashValue, err)
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return s.buckets.remove(tx, hashValue)
 	})
+
+	return wrapError("remove", hashValue, err)
 }
 
-func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
-	mapper := func(yield storage.YieldFunc) {
-		s.db.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket(bucketName)
+// remove returns storage.ErrNotFound if there is nothing to
+// delete, bolt's Delete doesn't report missing keys
+func (bk buckets) remove(tx *bolt.Tx, hashValue []byte) error {
+	b := bk.data(tx)
+	if b == nil {
+		return errMissingBucket
+	}
+
+	if b.Get(hashValue) != nil {
+		return b.Delete(hashValue)
+	}
+
+	chunked := b.Bucket(hashValue)
+	if chunked == nil {
+		return storage.ErrNotFound
+	}
+
+	if err := bk.removeChunks(tx, binary.BigEndian.Uint64(chunked.Get(chunkIDKey))); err != nil {
+		return err
+	}
+
+	return b.DeleteBucket(hashValue)
+}
+
+// All holds a read transaction open until the loop is done
+func (s *Storage) All(ctx context.Context) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		err := s.db.View(func(tx *bolt.Tx) error {
+			c := s.buckets.data(tx).Cursor()
+
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				// keys are only valid while the transaction is open
+				if !yield(append([]byte(nil), k...), nil) {
+					return nil
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			yield(nil, wrapError("list", nil, err))
+		}
+	}
+}
+
+// Entries reads the size of chunked values from their bucket
+func (s *Storage) Entries(ctx context.Context) iter.Seq2[storage.Entry, error] {
+	return func(yield func(storage.Entry, error) bool) {
+		err := s.db.View(func(tx *bolt.Tx) error {
+			b := s.buckets.data(tx)
 			c := b.Cursor()
 
 			for k, _ := c.First(); k != nil; k, _ = c.Next() {
-				if ok := yield(k, nil); !ok {
-					break
+				size, _ := size(b, k)
+				entry := storage.Entry{Hash: append([]byte(nil), k...), Size: size}
+				if !yield(entry, nil) {
+					return nil
 				}
 			}
 
 			return nil
 		})
+		if err != nil {
+			yield(storage.Entry{}, wrapError("list", nil, err))
+		}
+	}
+}
+
+func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
+	return storage.Pull(s.All(context.Background()))
+}
+
+// ListPage seeks the cursor to the token or the prefix, bolt keeps
+// the keys sorted by their bytes
+func (s *Storage) ListPage(ctx context.Context, opts storage.ListOptions) (*storage.Page, error) {
+	after, err := storage.ParseToken(opts.Token)
+	if err != nil {
+		return nil, wrapError("list", nil, err)
+	}
+
+	pageSize := storage.PageSize(opts.PageSize)
+	hashes := make([][]byte, 0, pageSize+1)
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := s.buckets.data(tx).Cursor()
+
+		start := after
+		if bytes.Compare(opts.Prefix, start) > 0 {
+			start = opts.Prefix
+		}
+
+		k, _ := c.Seek(start)
+		if k != nil && bytes.Equal(k, after) {
+			k, _ = c.Next()
+		}
+
+		for ; k != nil && len(hashes) <= pageSize; k, _ = c.Next() {
+			if !bytes.HasPrefix(k, opts.Prefix) {
+				break
+			}
+
+			// keys are only valid while the transaction is open
+			hashes = append(hashes, append([]byte(nil), k...))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, wrapError("list", nil, err)
+	}
+
+	return storage.NewPage(hashes, pageSize), nil
+}
+
+// PutBatch writes every content in a single Update, so the whole batch
+// costs one fsync. A failed content doesn't stop the others
+func (s *Storage) PutBatch(ctx context.Context, rs []io.Reader) ([]storage.PutResult, error) {
+	results := make([]storage.PutResult, len(rs))
+
+	err := s.db.Update(func(t *bolt.Tx) error {
+		for i, r := range rs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			hashValue, n, err := s.buckets.put(ctx, inTx(t), r)
+			results[i] = storage.PutResult{Hash: hashValue, N: n, Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, wrapError("put", nil, err)
+	}
+
+	return results, nil
+}
+
+// inTx runs every update in the same open transaction
+func inTx(t *bolt.Tx) func(func(*bolt.Tx) error) error {
+	return func(fn func(*bolt.Tx) error) error {
+		return fn(t)
+	}
+}
+
+func (s *Storage) GetBatch(ctx context.Context, hashes [][]byte) ([]storage.GetResult, error) {
+	results := make([]storage.GetResult, len(hashes))
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for i, hashValue := range hashes {
+			value, err := s.buckets.readAll(tx, hashValue)
+			if err != nil {
+				results[i].Err = wrapError("get", hashValue, err)
+				continue
+			}
+
+			results[i].Reader = io.NopCloser(bytes.NewReader(value))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, wrapError("get", nil, err)
+	}
+
+	return results, nil
+}
+
+func (s *Storage) RemoveBatch(ctx context.Context, hashes [][]byte) ([]error, error) {
+	errs := make([]error, len(hashes))
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for i, hashValue := range hashes {
+			errs[i] = wrapError("remove", hashValue, s.buckets.remove(tx, hashValue))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, wrapError("remove", nil, err)
 	}
 
-	return storage.Iterator(mapper)
+	return errs, nil
+}
+
+// Begin opens a writable bolt transaction, other writers are
+// blocked until it is committed or rolled back
+func (s *Storage) Begin(ctx context.Context) (storage.Tx, error) {
+	t, err := s.db.Begin(true)
+	if err != nil {
+		return nil, wrapError("begin", nil, err)
+	}
+
+	return &tx{tx: t, buckets: s.buckets}, nil
 }
 
 func (s *Storage) Close() error {
-	return s.db.Close()
+	return wrapError("close", nil, s.db.Close())
 }
 
-func New(filepath string) (*Storage, error) {
-	db, err := bolt.Open(filepath, os.ModePerm, &bolt.Options{Timeout: 2 * time.Second})
+func New(filepath string, opts ...Option) (*Storage, error) {
+	o := options{mode: os.ModePerm, timeout: 2 * time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	db, err := bolt.Open(filepath, o.mode, &bolt.Options{Timeout: o.timeout, ReadOnly: o.readOnly})
+	if err != nil {
+		return nil, wrapError("open", nil, err)
+	}
+	db.NoSync = o.noSync
+
+	update := db.Update
+	if o.batch {
+		update = db.Batch
+	}
+
+	s, err := (&Storage{db: db, update: update}).Namespace(o.bucket)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	err = db.Update(func(t *bolt.Tx) error {
-		_, err := t.CreateBucketIfNotExists(bucketName)
-		return err
+	if !o.readOnly {
+		if err := db.Update(sweep); err != nil {
+			db.Close()
+			return nil, wrapError("open", nil, err)
+		}
+	}
+
+	return s, nil
+}
+
+// sweep removes the chunks no value refers to, which a Put interrupted by
+// a crash leaves behind. New holds the lock of the file, no Put is running
+// in any of its stores
+func sweep(tx *bolt.Tx) error {
+	stores := []buckets{{}}
+	if namespaces := tx.Bucket(namespacesBucketName); namespaces != nil {
+		err := namespaces.ForEach(func(k, v []byte) error {
+			if v == nil {
+				stores = append(stores, buckets{namespace: append([]byte(nil), k...)})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, bk := range stores {
+		if err := bk.sweep(tx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (bk buckets) sweep(tx *bolt.Tx) error {
+	b, chunks := bk.data(tx), bk.chunks(tx)
+	if b == nil || chunks == nil {
+		return nil
+	}
+
+	// chunked values are the nested buckets of data
+	ids := make(map[uint64]bool)
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v == nil {
+			ids[binary.BigEndian.Uint64(b.Bucket(k).Get(chunkIDKey))] = true
+		}
+	}
+
+	var orphans [][]byte
+	err := chunks.ForEach(func(k, _ []byte) error {
+		if !ids[binary.BigEndian.Uint64(k)] {
+			orphans = append(orphans, append([]byte(nil), k...))
+		}
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range orphans {
+		if err := chunks.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Namespace returns a store in the bucket name of the same file, with the
+// same options. bolt locks its file so a process opens it once and gets its
+// other stores from Namespace. They all share the file, closing any of them
+// closes it. An empty name is the store of New without WithBucket
+func (s *Storage) Namespace(name string) (*Storage, error) {
+	ns := &Storage{db: s.db, update: s.update}
+	if name != "" {
+		ns.buckets.namespace = []byte(name)
+	}
+
+	var err error
+
+	// a read-only file can't get the buckets it misses
+	if s.db.IsReadOnly() {
+		err = s.db.View(func(t *bolt.Tx) error {
+			if ns.buckets.data(t) == nil || ns.buckets.chunks(t) == nil {
+				return fmt.Errorf("%w: bucket %q", storage.ErrNotFound, name)
+			}
+			return nil
+		})
+	} else {
+		err = s.db.Update(ns.buckets.create)
+	}
+	if err != nil {
+		return nil, wrapError("open", nil, err)
+	}
+
+	return ns, nil
+}
+
+type tx struct {
+	tx      *bolt.Tx
+	buckets buckets
+}
+
+var _ storage.Tx = (*tx)(nil)
+
+func (t *tx) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	return t.buckets.put(ctx, inTx(t.tx), r)
+}
+
+func (t *tx) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	value, err := t.buckets.readAll(t.tx, hashValue)
+	if err != nil {
+		return nil, wrapError("get", hashValue, err)
+	}
+
+	return io.NopCloser(bytes.NewReader(value)), nil
+}
+
+// readAll copies the value, values are only valid while the transaction is open
+func (bk buckets) readAll(tx *bolt.Tx, hashValue []byte) ([]byte, error) {
+	b := bk.data(tx)
+	if b == nil {
+		return nil, errMissingBucket
+	}
+
+	size, ok := size(b, hashValue)
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+
+	value := make([]byte, size)
+	n, err := bk.readAt(tx, hashValue, 0, value)
 	if err != nil {
 		return nil, err
+	} else if int64(n) != size {
+		return nil, fmt.Errorf("%w: %d of %d bytes", storage.ErrCorrupted, n, size)
 	}
 
-	return &Storage{db: db}, nil
+	return value, nil
+}
+
+func (t *tx) Commit() error {
+	return wrapError("commit", nil, t.tx.Commit())
+}
+
+func (t *tx) Rollback() error {
+	err := t.tx.Rollback()
+	if errors.Is(err, bolt.ErrTxClosed) {
+		return nil
+	}
+
+	return wrapError("rollback", nil, err)
+}
+
+// wrapError maps the errors of bolt to the errors of the storage package
+func wrapError(op string, hashValue []byte, err error) error {
+	var kind error
+
+	switch {
+	case errors.Is(err, bolt.ErrDatabaseNotOpen), errors.Is(err, bolt.ErrTxClosed):
+		kind = storage.ErrClosed
+	case errors.Is(err, bolt.ErrDatabaseReadOnly), errors.Is(err, bolt.ErrTxNotWritable):
+		kind = storage.ErrReadOnly
+	case errors.Is(err, bolt.ErrKeyTooLarge), errors.Is(err, bolt.ErrValueTooLarge):
+		kind = storage.ErrTooLarge
+	case errors.Is(err, bolt.ErrTimeout):
+		kind = storage.ErrUnavailable
+	case errors.Is(err, bolt.ErrInvalid), errors.Is(err, bolt.ErrChecksum), errors.Is(err, bolt.ErrVersionMismatch):
+		kind = storage.ErrCorrupted
+	}
+
+	if kind != nil {
+		err = fmt.Errorf("%w: %w", kind, err)
+	}
+
+	return storage.NewError(op, hashValue, err)
+}
+
+// rangeReader reads remaining bytes of a value from offset, the value
+// is looked up again on every Read so a removed value fails the reader
+type rangeReader struct {
+	db        *bolt.DB
+	buckets   buckets
+	hashValue []byte
+	offset    int64
+	remaining int64
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	var n int
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = r.buckets.readAt(tx, r.hashValue, r.offset, p)
+		return err
+	})
+	if err != nil {
+		return 0, wrapError("get", r.hashValue, err)
+	}
+
+	// the value can't shrink, it can only be removed and put again
+	if n == 0 && len(p) > 0 {
+		return 0, wrapError("get", r.hashValue, io.ErrUnexpectedEOF)
+	}
+
+	r.offset += int64(n)
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+func (r *rangeReader) Close() error {
+	r.remaining = 0
+	return nil
 }
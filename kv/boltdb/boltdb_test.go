@@ -3,18 +3,24 @@ package boltdb_test
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/alinz/hash.go"
+	bbolt "github.com/boltdb/bolt"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/alinz/storage.go"
 	"github.com/alinz/storage.go/internal/tests"
 	"github.com/alinz/storage.go/kv/boltdb"
+	"github.com/alinz/storage.go/storagetest"
 )
 
 func TestBoltdbStorage(t *testing.T) {
@@ -59,6 +65,24 @@ func TestBoltdbStorage(t *testing.T) {
 		assert.Equal(t, 1, count)
 	})
 
+	t.Run("stat and has without reading the content", func(t *testing.T) {
+		info, err := bolt.Stat(context.Background(), expectedHashValue)
+		assert.NoError(t, err)
+		assert.Equal(t, contentSize, info.Size)
+
+		exists, err := bolt.Has(context.Background(), expectedHashValue)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		missing := hash.Bytes([]byte("missing"))
+		_, err = bolt.Stat(context.Background(), missing)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		exists, err = bolt.Has(context.Background(), missing)
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	})
+
 	t.Run("make sure the deleted value no longer get accessed", func(t *testing.T) {
 		err := bolt.Remove(context.TODO(), expectedHashValue)
 		assert.NoError(t, err)
@@ -81,3 +105,292 @@ func TestBoltdbStorage(t *testing.T) {
 		assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
 	})
 }
+
+func TestBoltdbSmallPutsAllocations(t *testing.T) {
+	bolt, err := boltdb.New(filepath.Join(t.TempDir(), "database"))
+	assert.NoError(t, err)
+	defer bolt.Close()
+
+	rs := make([]io.Reader, 500)
+	for i := range rs {
+		rs[i] = bytes.NewReader([]byte(fmt.Sprintf("small content %d", i)))
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	results, err := bolt.PutBatch(context.Background(), rs)
+	assert.NoError(t, err)
+
+	runtime.ReadMemStats(&after)
+
+	for _, result := range results {
+		assert.NoError(t, result.Err)
+	}
+
+	// a chunk sized buffer for every value would be 500 MiB
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(32<<20))
+}
+
+func TestBoltdbSweepOrphanChunks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database")
+
+	store, err := boltdb.New(path)
+	assert.NoError(t, err)
+
+	content := make([]byte, 2<<20+1)
+	hashValue, _, err := store.Put(context.Background(), bytes.NewReader(content))
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+
+	// the chunk of a Put which never finished
+	db, err := bbolt.Open(path, 0o600, nil)
+	assert.NoError(t, err)
+	orphan := append(binary.BigEndian.AppendUint64(nil, 1000), make([]byte, 8)...)
+	err = db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("chunks")).Put(orphan, []byte("orphan"))
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	store, err = boltdb.New(path)
+	assert.NoError(t, err)
+
+	rc, err := store.Get(context.Background(), hashValue)
+	assert.NoError(t, err)
+	assert.NoError(t, tests.EqualReaders(io.NopCloser(bytes.NewReader(content)), rc))
+	assert.NoError(t, store.Close())
+
+	db, err = bbolt.Open(path, 0o600, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	chunks := 0
+	err = db.View(func(tx *bbolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte("chunks")).Get(orphan))
+		return tx.Bucket([]byte("chunks")).ForEach(func(k, v []byte) error {
+			chunks++
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, chunks)
+}
+
+func TestBoltdbOptions(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "database")
+
+	first, err := boltdb.New(path, boltdb.WithBucket("first"))
+	assert.NoError(t, err)
+
+	content := []byte("only in the first bucket")
+	hashValue, _, err := first.Put(ctx, bytes.NewReader(content))
+	assert.NoError(t, err)
+	assert.NoError(t, first.Close())
+
+	t.Run("buckets don't see each other's contents", func(t *testing.T) {
+		second, err := boltdb.New(path, boltdb.WithBucket("second"))
+		assert.NoError(t, err)
+		defer second.Close()
+
+		_, err = second.Get(ctx, hashValue)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		for _, err := range second.All(ctx) {
+			t.Fatalf("the second bucket isn't empty: %v", err)
+		}
+	})
+
+	t.Run("namespaces share the open file", func(t *testing.T) {
+		bolt, err := boltdb.New(path)
+		assert.NoError(t, err)
+		defer bolt.Close()
+
+		first, err := bolt.Namespace("first")
+		assert.NoError(t, err)
+
+		exists, err := first.Has(ctx, hashValue)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		third, err := first.Namespace("third")
+		assert.NoError(t, err)
+
+		other, _, err := third.Put(ctx, bytes.NewReader([]byte("only in the third bucket")))
+		assert.NoError(t, err)
+
+		exists, err = first.Has(ctx, other)
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("the default store doesn't see the buckets", func(t *testing.T) {
+		bolt, err := boltdb.New(path)
+		assert.NoError(t, err)
+		defer bolt.Close()
+
+		exists, err := bolt.Has(ctx, hashValue)
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		bolt, err := boltdb.New(path, boltdb.WithBucket("first"), boltdb.WithReadOnly())
+		assert.NoError(t, err)
+		defer bolt.Close()
+
+		rc, err := bolt.Get(ctx, hashValue)
+		assert.NoError(t, err)
+		assert.NoError(t, tests.EqualReaders(io.NopCloser(bytes.NewReader(content)), rc))
+
+		_, _, err = bolt.Put(ctx, bytes.NewReader([]byte("hello")))
+		assert.ErrorIs(t, err, storage.ErrReadOnly)
+		assert.ErrorIs(t, bolt.Remove(ctx, hashValue), storage.ErrReadOnly)
+	})
+
+	t.Run("read-only needs the bucket", func(t *testing.T) {
+		_, err := boltdb.New(path, boltdb.WithBucket("missing"), boltdb.WithReadOnly())
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("a locked file times out", func(t *testing.T) {
+		bolt, err := boltdb.New(path)
+		assert.NoError(t, err)
+		defer bolt.Close()
+
+		_, err = boltdb.New(path, boltdb.WithTimeout(10*time.Millisecond))
+		assert.ErrorIs(t, err, storage.ErrUnavailable)
+	})
+
+	t.Run("file mode", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "database")
+
+		bolt, err := boltdb.New(path, boltdb.WithFileMode(0o600))
+		assert.NoError(t, err)
+		defer bolt.Close()
+
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		bolt, err := boltdb.New(filepath.Join(t.TempDir(), "database"))
+		assert.NoError(t, err)
+		t.Cleanup(func() { bolt.Close() })
+
+		return bolt
+	})
+}
+
+func TestConformanceBatch(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		bolt, err := boltdb.New(filepath.Join(t.TempDir(), "database"), boltdb.WithBucket("batch"), boltdb.WithBatch(), boltdb.WithNoSync())
+		assert.NoError(t, err)
+		t.Cleanup(func() { bolt.Close() })
+
+		return bolt
+	})
+}
+
+func TestBoltdbChunks(t *testing.T) {
+	ctx := context.Background()
+
+	bolt, err := boltdb.New(filepath.Join(t.TempDir(), "database"))
+	assert.NoError(t, err)
+	defer bolt.Close()
+
+	// a bit more than three chunks
+	content := make([]byte, 3<<20+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	hashValue, n, err := bolt.Put(ctx, bytes.NewReader(content))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+	assert.Equal(t, hash.Bytes(content), hash.Value(hashValue))
+
+	t.Run("get the whole value", func(t *testing.T) {
+		rc, err := bolt.Get(ctx, hashValue)
+		assert.NoError(t, err)
+		assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
+	})
+
+	t.Run("get a range across chunks", func(t *testing.T) {
+		offset, length := int64(1<<20-10), int64(1<<20+20)
+
+		rc, err := bolt.GetRange(ctx, hashValue, offset, length)
+		assert.NoError(t, err)
+		defer rc.Close()
+
+		got, err := io.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.Equal(t, content[offset:offset+length], got)
+	})
+
+	t.Run("stat reports the size of every chunk", func(t *testing.T) {
+		info, err := bolt.Stat(ctx, hashValue)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), info.Size)
+
+		for entry, err := range bolt.Entries(ctx) {
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(content)), entry.Size)
+		}
+	})
+
+	t.Run("put the same value again", func(t *testing.T) {
+		again, n, err := bolt.Put(ctx, bytes.NewReader(content))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), n)
+		assert.Equal(t, hashValue, again)
+
+		count := 0
+		for _, err := range storage.All(ctx, bolt) {
+			assert.NoError(t, err)
+			count++
+		}
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("an open reader doesn't block writers", func(t *testing.T) {
+		rc, err := bolt.Get(ctx, hashValue)
+		assert.NoError(t, err)
+		defer rc.Close()
+
+		head := make([]byte, 10)
+		_, err = io.ReadFull(rc, head)
+		assert.NoError(t, err)
+
+		// the Put grows the file, which bolt can't do while a read
+		// transaction is open
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := bolt.Put(ctx, bytes.NewReader(append([]byte("other"), content...)))
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the Put is blocked by the open reader")
+		}
+
+		rest, err := io.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.Equal(t, content, append(head, rest...))
+	})
+
+	t.Run("remove the chunks", func(t *testing.T) {
+		assert.NoError(t, bolt.Remove(ctx, hashValue))
+
+		_, err := bolt.Get(ctx, hashValue)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+		assert.ErrorIs(t, bolt.Remove(ctx, hashValue), storage.ErrNotFound)
+	})
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"iter"
+	"os"
 
 	"github.com/akrylysov/pogreb"
 	"github.com/alinz/hash.go"
@@ -20,75 +23,251 @@ var _ storage.Putter = (*Storage)(nil)
 var _ storage.Getter = (*Storage)(nil)
 var _ storage.Remover = (*Storage)(nil)
 var _ storage.Lister = (*Storage)(nil)
+var _ storage.SeqLister = (*Storage)(nil)
+var _ storage.EntryLister = (*Storage)(nil)
 var _ storage.Closer = (*Storage)(nil)
+var _ storage.Stater = (*Storage)(nil)
+var _ storage.Haser = (*Storage)(nil)
+var _ storage.RangeGetter = (*Storage)(nil)
+var _ storage.BatchPutter = (*Storage)(nil)
+var _ storage.BatchGetter = (*Storage)(nil)
+var _ storage.BatchRemover = (*Storage)(nil)
 
 func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, wrapError("put", nil, err)
+	}
+
 	hr := hash.NewReader(r)
 
 	buffer := bytes.Buffer{}
 
 	n, err := io.Copy(&buffer, hr)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapError("put", nil, err)
 	}
 
 	if n == 0 {
-		return nil, 0, io.EOF
+		return nil, 0, wrapError("put", nil, storage.ErrEmpty)
 	}
 
 	hashValue := hr.Hash()
 
 	err = s.db.Put(hashValue, buffer.Bytes())
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapError("put", hashValue, err)
 	}
 
 	return hashValue, n, nil
 }
 
 func (s *Storage) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError("get", hashValue, err)
+	}
+
 	value, err := s.db.Get(hashValue)
 	if err != nil {
-		return nil, err
+		return nil, wrapError("get", hashValue, err)
 	} else if value == nil {
-		return nil, storage.ErrNotFound
+		return nil, wrapError("get", hashValue, storage.ErrNotFound)
 	}
 
 	return io.NopCloser(bytes.NewReader(value)), nil
 }
 
+func (s *Storage) GetRange(ctx context.Context, hashValue []byte, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, wrapError("get", hashValue, storage.ErrInvalidRange)
+	}
+
+	value, err := s.db.Get(hashValue)
+	if err != nil {
+		return nil, wrapError("get", hashValue, err)
+	} else if value == nil {
+		return nil, wrapError("get", hashValue, storage.ErrNotFound)
+	}
+
+	if length < 0 {
+		length = int64(len(value))
+	}
+
+	return io.NopCloser(io.NewSectionReader(bytes.NewReader(value), offset, length)), nil
+}
+
+func (s *Storage) Stat(ctx context.Context, hashValue []byte) (storage.Info, error) {
+	value, err := s.db.Get(hashValue)
+	if err != nil {
+		return storage.Info{}, wrapError("stat", hashValue, err)
+	} else if value == nil {
+		return storage.Info{}, wrapError("stat", hashValue, storage.ErrNotFound)
+	}
+
+	return storage.Info{Size: int64(len(value))}, nil
+}
+
+func (s *Storage) Has(ctx context.Context, hashValue []byte) (bool, error) {
+	ok, err := s.db.Has(hashValue)
+	if err != nil {
+		return false, wrapError("stat", hashValue, err)
+	}
+
+	return ok, nil
+}
+
 func (s *Storage) Remove(ctx context.Context, hashValue []byte) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError("remove", hashValue, err)
+	}
+
+	return wrapError("remove", hashValue, s.remove(hashValue))
+}
+
+// remove returns storage.ErrNotFound if there is nothing to
+// delete, pogreb's Delete doesn't report missing keys
+func (s *Storage) remove(hashValue []byte) error {
+	ok, err := s.db.Has(hashValue)
+	if err != nil {
+		return err
+	} else if !ok {
+		return storage.ErrNotFound
+	}
+
 	return s.db.Delete(hashValue)
 }
 
-func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
-	it := s.db.Items()
+func (s *Storage) All(ctx context.Context) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		it := s.db.Items()
 
-	mapper := func(yield storage.YieldFunc) {
 		for {
 			key, _, err := it.Next()
 			if errors.Is(err, pogreb.ErrIterationDone) {
 				return
 			}
 
-			if ok := yield(key, err); !ok {
+			if !yield(key, wrapError("list", nil, err)) || err != nil {
 				return
 			}
 		}
 	}
+}
+
+func (s *Storage) Entries(ctx context.Context) iter.Seq2[storage.Entry, error] {
+	return func(yield func(storage.Entry, error) bool) {
+		it := s.db.Items()
+
+		for {
+			key, value, err := it.Next()
+			if errors.Is(err, pogreb.ErrIterationDone) {
+				return
+			} else if err != nil {
+				yield(storage.Entry{}, wrapError("list", nil, err))
+				return
+			}
 
-	return storage.Iterator(mapper)
+			if !yield(storage.Entry{Hash: key, Size: int64(len(value))}, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
+	return storage.Pull(s.All(context.Background()))
+}
+
+// PutBatch writes every content and syncs the database once at the end
+func (s *Storage) PutBatch(ctx context.Context, rs []io.Reader) ([]storage.PutResult, error) {
+	results := make([]storage.PutResult, len(rs))
+
+	for i, r := range rs {
+		if err := ctx.Err(); err != nil {
+			return nil, wrapError("put", nil, err)
+		}
+
+		hashValue, n, err := s.Put(ctx, r)
+		results[i] = storage.PutResult{Hash: hashValue, N: n, Err: err}
+	}
+
+	if err := s.db.Sync(); err != nil {
+		return nil, wrapError("put", nil, err)
+	}
+
+	return results, nil
+}
+
+func (s *Storage) GetBatch(ctx context.Context, hashes [][]byte) ([]storage.GetResult, error) {
+	results := make([]storage.GetResult, len(hashes))
+
+	for i, hashValue := range hashes {
+		if err := ctx.Err(); err != nil {
+			return nil, wrapError("get", hashValue, err)
+		}
+
+		rc, err := s.Get(ctx, hashValue)
+		results[i] = storage.GetResult{Reader: rc, Err: err}
+	}
+
+	return results, nil
+}
+
+// RemoveBatch deletes every hash and syncs the database once at the end
+func (s *Storage) RemoveBatch(ctx context.Context, hashes [][]byte) ([]error, error) {
+	errs := make([]error, len(hashes))
+
+	for i, hashValue := range hashes {
+		if err := ctx.Err(); err != nil {
+			return nil, wrapError("remove", hashValue, err)
+		}
+
+		errs[i] = wrapError("remove", hashValue, s.remove(hashValue))
+	}
+
+	if err := s.db.Sync(); err != nil {
+		return nil, wrapError("remove", nil, err)
+	}
+
+	return errs, nil
 }
 
 func (s *Storage) Close() error {
-	return s.db.Close()
+	return wrapError("close", nil, s.db.Close())
 }
 
 func New(filepath string) (*Storage, error) {
 	db, err := pogreb.Open(filepath, nil)
 	if err != nil {
-		return nil, err
+		return nil, wrapError("open", nil, err)
 	}
 
 	return &Storage{db: db}, nil
 }
+
+// pogreb doesn't export its errors, so they are matched by their message
+var errorKinds = map[string]error{
+	"key is too large":      storage.ErrTooLarge,
+	"value is too large":    storage.ErrTooLarge,
+	"database is full":      storage.ErrTooLarge,
+	"database is corrupted": storage.ErrCorrupted,
+	"database is locked":    storage.ErrUnavailable,
+	"database is busy":      storage.ErrUnavailable,
+}
+
+// wrapError maps the errors of pogreb to the errors of the storage package
+func wrapError(op string, hashValue []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	kind := errorKinds[err.Error()]
+	if errors.Is(err, os.ErrClosed) {
+		kind = storage.ErrClosed
+	}
+
+	if kind != nil {
+		err = fmt.Errorf("%w: %w", kind, err)
+	}
+
+	return storage.NewError(op, hashValue, err)
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/alinz/storage.go"
 	"github.com/alinz/storage.go/internal/tests"
 	"github.com/alinz/storage.go/kv/pogreb"
+	"github.com/alinz/storage.go/storagetest"
 )
 
 func TestPogrebStorage(t *testing.T) {
@@ -59,6 +60,24 @@ func TestPogrebStorage(t *testing.T) {
 		assert.Equal(t, 1, count)
 	})
 
+	t.Run("stat and has without reading the content", func(t *testing.T) {
+		info, err := memory.Stat(context.Background(), expectedHashValue)
+		assert.NoError(t, err)
+		assert.Equal(t, contentSize, info.Size)
+
+		exists, err := memory.Has(context.Background(), expectedHashValue)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		missing := hash.Bytes([]byte("missing"))
+		_, err = memory.Stat(context.Background(), missing)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		exists, err = memory.Has(context.Background(), missing)
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	})
+
 	t.Run("make sure the deleted value no longer get accessed", func(t *testing.T) {
 		err := memory.Remove(context.TODO(), expectedHashValue)
 		assert.NoError(t, err)
@@ -81,3 +100,42 @@ func TestPogrebStorage(t *testing.T) {
 		assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
 	})
 }
+
+func TestPogrebBatchCanceled(t *testing.T) {
+	db, err := pogreb.New(filepath.Join(t.TempDir(), "database"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	hashValue := hash.Bytes([]byte("hello"))
+	var storageErr *storage.Error
+
+	_, err = db.PutBatch(ctx, []io.Reader{bytes.NewReader([]byte("hello"))})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.True(t, errors.As(err, &storageErr))
+	assert.Equal(t, "put", storageErr.Op)
+
+	_, err = db.GetBatch(ctx, [][]byte{hashValue})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.True(t, errors.As(err, &storageErr))
+	assert.Equal(t, "get", storageErr.Op)
+	assert.Equal(t, []byte(hashValue), storageErr.Hash)
+
+	_, err = db.RemoveBatch(ctx, [][]byte{hashValue})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.True(t, errors.As(err, &storageErr))
+	assert.Equal(t, "remove", storageErr.Op)
+	assert.Equal(t, []byte(hashValue), storageErr.Hash)
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		db, err := pogreb.New(filepath.Join(t.TempDir(), "database"))
+		assert.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+
+		return db
+	})
+}
@@ -0,0 +1,24 @@
+package local
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alinz/storage.go"
+)
+
+func TestWrapError(t *testing.T) {
+	err := wrapError("put", nil, syscall.EFBIG)
+	assert.ErrorIs(t, err, storage.ErrTooLarge)
+	assert.ErrorIs(t, err, syscall.EFBIG)
+
+	for _, errno := range []error{syscall.ENOSPC, syscall.EDQUOT} {
+		err := wrapError("put", nil, errno)
+		assert.ErrorIs(t, err, storage.ErrUnavailable)
+		assert.False(t, errors.Is(err, storage.ErrTooLarge))
+		assert.ErrorIs(t, err, errno)
+	}
+}
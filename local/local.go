@@ -1,18 +1,33 @@
 package local
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"io"
+	"iter"
 	"math/big"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 
 	"github.com/alinz/hash.go"
 
 	"github.com/alinz/storage.go"
 )
 
+var errTxClosed = fmt.Errorf("%w: transaction is closed", storage.ErrClosed)
+
+// hashHeader is the prefix of every stored file name
+var hashHeader = hash.Format([]byte{})
+
+// stagingPrefix is the prefix of the staging directories of transactions
+const stagingPrefix = ".tx-"
+
 type Storage struct {
 	path string
 }
@@ -21,19 +36,30 @@ var _ storage.Putter = (*Storage)(nil)
 var _ storage.Getter = (*Storage)(nil)
 var _ storage.Remover = (*Storage)(nil)
 var _ storage.Lister = (*Storage)(nil)
+var _ storage.SeqLister = (*Storage)(nil)
+var _ storage.EntryLister = (*Storage)(nil)
+var _ storage.Stater = (*Storage)(nil)
+var _ storage.Haser = (*Storage)(nil)
+var _ storage.RangeGetter = (*Storage)(nil)
+var _ storage.Transactioner = (*Storage)(nil)
+var _ storage.PageLister = (*Storage)(nil)
 
 func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, wrapError("put", nil, err)
+	}
+
 	// generate random filename
 	tempFilename, err := generateRandomString(10)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapError("put", nil, err)
 	}
 
 	// create the file name in given path
 	tempFilePath := filepath.Join(s.path, tempFilename)
 	file, err := os.Create(tempFilePath)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapError("put", nil, err)
 	}
 	defer file.Close()
 
@@ -44,10 +70,10 @@ func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
 	cr := hash.NewReader(r)
 	n, err := io.Copy(file, cr)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapError("put", nil, err)
 	} else if n == 0 {
 		os.Remove(tempFilePath)
-		return nil, 0, io.EOF
+		return nil, 0, wrapError("put", nil, storage.ErrEmpty)
 	}
 
 	hash := cr.Hash()
@@ -55,88 +81,384 @@ func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
 
 	// if filePath is already exists, no need to rename the file
 	// we just have to remove the temporary file
+	// renaming over it would make watchers see the content put again
 	_, err = os.Stat(filePath)
-	if os.IsExist(err) {
+	if err == nil {
 		os.Remove(tempFilePath)
 		return hash, n, nil
 	} else if os.IsNotExist(err) {
 		// ignore this as we are about to create a new file
 	} else if err != nil {
-		return nil, n, err
+		return nil, n, wrapError("put", nil, err)
 	}
 
 	err = os.Rename(tempFilePath, filePath)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapError("put", nil, err)
 	}
 
 	return hash, n, nil
 }
 
 func (s *Storage) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError("get", hashValue, err)
+	}
+
 	internalHash := hash.Value(hashValue)
 	filePath := filepath.Join(s.path, internalHash.String())
 
 	_, err := os.Stat(filePath)
 	if os.IsNotExist(err) {
-		return nil, storage.ErrNotFound
+		return nil, wrapError("get", hashValue, storage.ErrNotFound)
 	} else if err != nil {
-		return nil, err
+		return nil, wrapError("get", hashValue, err)
 	}
 
 	file, err := os.Open(filePath)
 	if err != nil {
-		return nil, err
+		return nil, wrapError("get", hashValue, err)
 	}
 
 	return file, nil
 }
 
+func (s *Storage) GetRange(ctx context.Context, hashValue []byte, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, wrapError("get", hashValue, storage.ErrInvalidRange)
+	}
+
+	internalHash := hash.Value(hashValue)
+	filePath := filepath.Join(s.path, internalHash.String())
+
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, wrapError("get", hashValue, storage.ErrNotFound)
+	} else if err != nil {
+		return nil, wrapError("get", hashValue, err)
+	}
+
+	if length < 0 {
+		stat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, wrapError("get", hashValue, err)
+		}
+		length = stat.Size()
+	}
+
+	return &sectionReadCloser{
+		SectionReader: io.NewSectionReader(file, offset, length),
+		file:          file,
+	}, nil
+}
+
+func (s *Storage) Stat(ctx context.Context, hashValue []byte) (storage.Info, error) {
+	internalHash := hash.Value(hashValue)
+	filePath := filepath.Join(s.path, internalHash.String())
+
+	stat, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return storage.Info{}, wrapError("stat", hashValue, storage.ErrNotFound)
+	} else if err != nil {
+		return storage.Info{}, wrapError("stat", hashValue, err)
+	}
+
+	return storage.Info{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (s *Storage) Has(ctx context.Context, hashValue []byte) (bool, error) {
+	_, err := s.Stat(ctx, hashValue)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
 func (s *Storage) Remove(ctx context.Context, hashValue []byte) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError("remove", hashValue, err)
+	}
+
 	internalHash := hash.Value(hashValue)
 	filePath := filepath.Join(s.path, internalHash.String())
 
 	_, err := os.Stat(filePath)
 	if os.IsNotExist(err) {
-		return storage.ErrNotFound
+		return wrapError("remove", hashValue, storage.ErrNotFound)
 	} else if err != nil {
-		return err
+		return wrapError("remove", hashValue, err)
 	}
 
-	return os.Remove(filePath)
+	return wrapError("remove", hashValue, os.Remove(filePath))
 }
 
-func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
-	mapperFiles := func(yield storage.YieldFunc) {
-		var files []os.DirEntry
-		folder, err := os.Open(s.path)
+func (s *Storage) All(ctx context.Context) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		files, err := os.ReadDir(s.path)
 		if err != nil {
-			yield(nil, err)
+			yield(nil, wrapError("list", nil, err))
 			return
 		}
 
-		files, err = folder.ReadDir(-1)
-		folder.Close()
+		for _, file := range files {
+			// skip staging directories and temporary files of ongoing Puts
+			if file.IsDir() || !strings.HasPrefix(file.Name(), hashHeader) {
+				continue
+			}
+
+			hashValue, err := hash.ValueFromString(file.Name())
+			if !yield(hashValue, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Storage) Entries(ctx context.Context) iter.Seq2[storage.Entry, error] {
+	return func(yield func(storage.Entry, error) bool) {
+		files, err := os.ReadDir(s.path)
 		if err != nil {
-			yield(nil, err)
+			yield(storage.Entry{}, wrapError("list", nil, err))
 			return
 		}
 
 		for _, file := range files {
+			// skip staging directories and temporary files of ongoing Puts
+			if file.IsDir() || !strings.HasPrefix(file.Name(), hashHeader) {
+				continue
+			}
+
+			info, err := file.Info()
+			if os.IsNotExist(err) {
+				// removed while listing
+				continue
+			} else if err != nil {
+				yield(storage.Entry{}, wrapError("list", nil, err))
+				return
+			}
+
 			hashValue, err := hash.ValueFromString(file.Name())
-			if ok := yield(hashValue, err); !ok {
+			if err != nil {
+				yield(storage.Entry{}, wrapError("list", nil, err))
+				return
+			}
+
+			entry := storage.Entry{Hash: hashValue, Size: info.Size(), ModTime: info.ModTime()}
+			if !yield(entry, nil) {
 				return
 			}
 		}
 	}
+}
 
-	return storage.Iterator(mapperFiles)
+func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
+	return storage.Pull(s.All(context.Background()))
 }
 
+// ListPage relies on os.ReadDir returning the files sorted by name, the hex
+// encoding of the name keeps the same order as the bytes of the hash
+func (s *Storage) ListPage(ctx context.Context, opts storage.ListOptions) (*storage.Page, error) {
+	after, err := storage.ParseToken(opts.Token)
+	if err != nil {
+		return nil, wrapError("list", nil, err)
+	}
+
+	files, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, wrapError("list", nil, err)
+	}
+
+	i := 0
+	if after != nil {
+		afterName := hash.Format(after)
+		i = sort.Search(len(files), func(i int) bool {
+			return files[i].Name() > afterName
+		})
+	}
+
+	if len(opts.Prefix) > 0 {
+		prefixName := hash.Format(opts.Prefix)
+		if j := sort.Search(len(files), func(i int) bool {
+			return files[i].Name() >= prefixName
+		}); j > i {
+			i = j
+		}
+	}
+
+	pageSize := storage.PageSize(opts.PageSize)
+	hashes := make([][]byte, 0, pageSize+1)
+
+	for ; i < len(files) && len(hashes) <= pageSize; i++ {
+		name := files[i].Name()
+
+		// skip staging directories and temporary files of ongoing Puts
+		if files[i].IsDir() || !strings.HasPrefix(name, hashHeader) {
+			continue
+		}
+
+		hashValue, err := hash.ValueFromString(name)
+		if err != nil {
+			return nil, wrapError("list", nil, err)
+		}
+
+		if !bytes.HasPrefix(hashValue, opts.Prefix) {
+			// every following file is after the prefix as well
+			break
+		}
+
+		hashes = append(hashes, hashValue)
+	}
+
+	return storage.NewPage(hashes, pageSize), nil
+}
+
+// Begin creates a staging directory inside path, contents are moved out of
+// it on Commit in the same order they were put, so the last content put
+// (e.g. the root of a merkle tree) is the last one to become visible
+func (s *Storage) Begin(ctx context.Context) (storage.Tx, error) {
+	stagingPath, err := os.MkdirTemp(s.path, stagingPrefix)
+	if err != nil {
+		return nil, wrapError("begin", nil, err)
+	}
+
+	return &tx{storage: s, staging: &Storage{path: stagingPath}}, nil
+}
+
+// New removes the staging directories of transactions which were neither
+// committed nor rolled back, e.g. because the process crashed, so path
+// should not be opened while another process has an open transaction
 func New(path string) *Storage {
-	return &Storage{
+	s := &Storage{
 		path: path,
 	}
+
+	// best effort, what is left is removed by the next New
+	s.sweep()
+
+	return s
+}
+
+func (s *Storage) sweep() {
+	files, _ := os.ReadDir(s.path)
+	for _, file := range files {
+		if file.IsDir() && strings.HasPrefix(file.Name(), stagingPrefix) {
+			os.RemoveAll(filepath.Join(s.path, file.Name()))
+		}
+	}
+}
+
+type tx struct {
+	storage *Storage
+	staging *Storage
+	hashes  []hash.Value
+	done    bool
+}
+
+var _ storage.Tx = (*tx)(nil)
+
+func (t *tx) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	if t.done {
+		return nil, 0, errTxClosed
+	}
+
+	hashValue, n, err := t.staging.Put(ctx, r)
+	if err != nil {
+		return nil, n, err
+	}
+
+	t.hashes = append(t.hashes, hashValue)
+
+	return hashValue, n, nil
+}
+
+func (t *tx) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	if t.done {
+		return nil, errTxClosed
+	}
+
+	rc, err := t.staging.Get(ctx, hashValue)
+	if errors.Is(err, storage.ErrNotFound) {
+		return t.storage.Get(ctx, hashValue)
+	}
+
+	return rc, err
+}
+
+func (t *tx) Commit() error {
+	if t.done {
+		return errTxClosed
+	}
+	t.done = true
+	defer os.RemoveAll(t.staging.path)
+
+	for _, hashValue := range t.hashes {
+		name := hashValue.String()
+
+		// already stored, renaming over it would be seen as a new Put
+		if _, err := os.Stat(filepath.Join(t.storage.path, name)); err == nil {
+			continue
+		}
+
+		err := os.Rename(filepath.Join(t.staging.path, name), filepath.Join(t.storage.path, name))
+		if os.IsNotExist(err) {
+			// the same content was put more than once
+			continue
+		} else if err != nil {
+			return wrapError("commit", nil, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *tx) Rollback() error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+
+	return wrapError("rollback", nil, os.RemoveAll(t.staging.path))
+}
+
+// wrapError maps the errors of the filesystem to the errors of the storage package
+func wrapError(op string, hashValue []byte, err error) error {
+	var kind error
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		kind = storage.ErrNotFound
+	case errors.Is(err, os.ErrClosed):
+		kind = storage.ErrClosed
+	case errors.Is(err, syscall.EROFS):
+		kind = storage.ErrReadOnly
+	case errors.Is(err, syscall.EFBIG):
+		kind = storage.ErrTooLarge
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		// a full disk says nothing about the content, it might fit once
+		// space is freed
+		kind = storage.ErrUnavailable
+	case errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EBUSY), errors.Is(err, syscall.EMFILE):
+		kind = storage.ErrUnavailable
+	}
+
+	if kind != nil {
+		err = fmt.Errorf("%w: %w", kind, err)
+	}
+
+	return storage.NewError(op, hashValue, err)
+}
+
+type sectionReadCloser struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (s *sectionReadCloser) Close() error {
+	return s.file.Close()
 }
 
 func generateRandomString(n int) (string, error) {
@@ -3,6 +3,7 @@ package local_test
 import (
 	"context"
 	"fmt"
+	"os"
 	"strings"
 	"testing"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/alinz/storage.go"
 	"github.com/alinz/storage.go/internal/tests"
 	"github.com/alinz/storage.go/local"
+	"github.com/alinz/storage.go/storagetest"
 )
 
 func TestLocalStorage(t *testing.T) {
@@ -38,6 +40,19 @@ func TestLocalStorage(t *testing.T) {
 		contentReader.Reset(content)
 		assert.NoError(t, tests.EqualReaders(contentReader, r))
 
+		info, err := local.Stat(context.TODO(), actualHash)
+		assert.NoError(t, err)
+		assert.Equal(t, actualSize, info.Size)
+		assert.False(t, info.ModTime.IsZero())
+
+		exists, err := local.Has(context.TODO(), actualHash)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		exists, err = local.Has(context.TODO(), hash.Bytes([]byte("missing")))
+		assert.NoError(t, err)
+		assert.False(t, exists)
+
 		next, cancel := local.List()
 		defer cancel()
 
@@ -88,3 +103,30 @@ func TestListLargeNumberofFiles(t *testing.T) {
 
 	assert.Equal(t, count, 100_000)
 }
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		return local.New(t.TempDir())
+	})
+}
+
+func TestLocalSweepStaging(t *testing.T) {
+	path := t.TempDir()
+	backend := local.New(path)
+
+	// a transaction which is never finished, as if the process crashed
+	tx, err := backend.Begin(context.Background())
+	assert.NoError(t, err)
+	_, _, err = tx.Put(context.Background(), strings.NewReader("staged"))
+	assert.NoError(t, err)
+
+	hashValue, _, err := backend.Put(context.Background(), strings.NewReader("stored"))
+	assert.NoError(t, err)
+
+	local.New(path)
+
+	files, err := os.ReadDir(path)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, hash.Format(hashValue), files[0].Name())
+}
@@ -0,0 +1,123 @@
+//go:build linux
+
+package local
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/alinz/hash.go"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/watch"
+)
+
+var _ storage.Watcher = (*Storage)(nil)
+
+// Put writes into a temporary file and renames it, so only renames are
+// watched and files written directly under their hash are not seen
+const watchMask = syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+// Watch uses inotify, so changes made to the directory by other processes
+// are seen as well. A Put shows up once its temporary file is renamed, a
+// Put of an existing content doesn't show up again. The inotify descriptor
+// is only opened once the loop starts, so changes made before that are not
+// seen and an unused sequence doesn't hold anything
+func (s *Storage) Watch(ctx context.Context) iter.Seq2[storage.Event, error] {
+	return func(yield func(storage.Event, error) bool) {
+		if err := ctx.Err(); err != nil {
+			return
+		}
+
+		file, err := s.inotify()
+		if err != nil {
+			yield(storage.Event{}, wrapError("watch", nil, err))
+			return
+		}
+		defer file.Close()
+
+		// closing the file unblocks the pending Read
+		stop := context.AfterFunc(ctx, func() { file.Close() })
+		defer stop()
+
+		buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+		for {
+			n, err := file.Read(buffer)
+			if ctx.Err() != nil || errors.Is(err, os.ErrClosed) {
+				return
+			} else if err != nil {
+				yield(storage.Event{}, err)
+				return
+			}
+
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				mask := binary.NativeEndian.Uint32(buffer[offset+4:])
+				length := int(binary.NativeEndian.Uint32(buffer[offset+12:]))
+
+				offset += syscall.SizeofInotifyEvent
+				name := strings.TrimRight(string(buffer[offset:offset+length]), "\x00")
+				offset += length
+
+				if mask&syscall.IN_Q_OVERFLOW != 0 {
+					yield(storage.Event{}, watch.ErrOverflow)
+					return
+				}
+
+				event, ok := s.event(name, mask)
+				if !ok {
+					continue
+				}
+
+				if !yield(event, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Storage) inotify() (*os.File, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := syscall.InotifyAddWatch(fd, s.path, watchMask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// a non blocking fd makes the file pollable, so Close can interrupt Read
+	return os.NewFile(uintptr(fd), "inotify"), nil
+}
+
+// event skips staging directories and temporary files of ongoing Puts
+func (s *Storage) event(name string, mask uint32) (storage.Event, bool) {
+	if mask&syscall.IN_ISDIR != 0 || !strings.HasPrefix(name, hashHeader) {
+		return storage.Event{}, false
+	}
+
+	hashValue, err := hash.ValueFromString(name)
+	if err != nil {
+		return storage.Event{}, false
+	}
+
+	if mask&(syscall.IN_MOVED_FROM|syscall.IN_DELETE) != 0 {
+		return storage.Event{Hash: hashValue, Op: storage.OpRemove}, true
+	}
+
+	// the size is unknown if the file is removed before the event is read
+	event := storage.Event{Hash: hashValue, Op: storage.OpPut}
+	if info, err := os.Stat(filepath.Join(s.path, name)); err == nil {
+		event.Size = info.Size()
+	}
+
+	return event, true
+}
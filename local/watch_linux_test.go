@@ -0,0 +1,98 @@
+//go:build linux
+
+package local_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"iter"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/local"
+)
+
+func TestLocalWatch(t *testing.T) {
+	local := local.New(t.TempDir())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	next, stop := iter.Pull2(local.Watch(ctx))
+	defer stop()
+
+	// inotify is only set up once the loop starts, so contents
+	// are put until the first one is seen
+	done := make(chan struct{})
+	putting := make(chan struct{})
+	go func() {
+		defer close(putting)
+		for i := 0; ; i++ {
+			local.Put(context.Background(), strings.NewReader(fmt.Sprintf("warm up %d", i)))
+
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	event, err, ok := next()
+	close(done)
+	<-putting
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.OpPut, event.Op)
+
+	// putting the same content again is not seen
+	content := "hello world"
+	hashValue, _, err := local.Put(context.Background(), strings.NewReader(content))
+	assert.NoError(t, err)
+	_, _, err = local.Put(context.Background(), strings.NewReader(content))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []storage.Event{
+		{Hash: hashValue, Op: storage.OpPut, Size: int64(len(content))},
+	}, eventsUntil(t, next, hashValue, storage.OpPut))
+
+	assert.NoError(t, local.Remove(context.Background(), hashValue))
+
+	assert.Equal(t, []storage.Event{
+		{Hash: hashValue, Op: storage.OpRemove},
+	}, eventsUntil(t, next, hashValue, storage.OpRemove))
+
+	// the loop ends once the context is done
+	ctx, cancel = context.WithCancel(context.Background())
+	events := local.Watch(ctx)
+	cancel()
+	for _, err := range events {
+		assert.NoError(t, err)
+	}
+}
+
+// eventsUntil returns the events of hashValue up to the first one of op,
+// events of other contents are skipped
+func eventsUntil(t *testing.T, next func() (storage.Event, error, bool), hashValue []byte, op storage.Op) []storage.Event {
+	var got []storage.Event
+	for {
+		event, err, ok := next()
+		if !assert.True(t, ok) || !assert.NoError(t, err) {
+			return got
+		}
+
+		if !bytes.Equal(event.Hash, hashValue) {
+			continue
+		}
+
+		got = append(got, event)
+		if event.Op == op {
+			return got
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"iter"
+	"sort"
 	"sync"
 
 	"github.com/alinz/hash.go"
@@ -20,8 +22,18 @@ var _ storage.Putter = (*Storage)(nil)
 var _ storage.Getter = (*Storage)(nil)
 var _ storage.Remover = (*Storage)(nil)
 var _ storage.Lister = (*Storage)(nil)
+var _ storage.SeqLister = (*Storage)(nil)
+var _ storage.EntryLister = (*Storage)(nil)
+var _ storage.Stater = (*Storage)(nil)
+var _ storage.Haser = (*Storage)(nil)
+var _ storage.RangeGetter = (*Storage)(nil)
+var _ storage.PageLister = (*Storage)(nil)
 
 func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, storage.NewError("put", nil, err)
+	}
+
 	s.rw.Lock()
 	defer s.rw.Unlock()
 
@@ -31,7 +43,9 @@ func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
 
 	n, err := io.Copy(&buffer, hr)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, storage.NewError("put", nil, err)
+	} else if n == 0 {
+		return nil, 0, storage.NewError("put", nil, storage.ErrEmpty)
 	}
 
 	hashValue := hr.Hash()
@@ -42,24 +56,72 @@ func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
 }
 
 func (s *Storage) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, storage.NewError("get", hashValue, err)
+	}
+
 	s.rw.RLock()
 	defer s.rw.RUnlock()
 
 	value, ok := s.keyValue[hash.Format(hashValue)]
 	if !ok {
-		return nil, storage.ErrNotFound
+		return nil, storage.NewError("get", hashValue, storage.ErrNotFound)
 	}
 
 	return io.NopCloser(bytes.NewReader(value)), nil
 }
 
+func (s *Storage) GetRange(ctx context.Context, hashValue []byte, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, storage.NewError("get", hashValue, storage.ErrInvalidRange)
+	}
+
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+
+	value, ok := s.keyValue[hash.Format(hashValue)]
+	if !ok {
+		return nil, storage.NewError("get", hashValue, storage.ErrNotFound)
+	}
+
+	if length < 0 {
+		length = int64(len(value))
+	}
+
+	return io.NopCloser(io.NewSectionReader(bytes.NewReader(value), offset, length)), nil
+}
+
+func (s *Storage) Stat(ctx context.Context, hashValue []byte) (storage.Info, error) {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+
+	value, ok := s.keyValue[hash.Format(hashValue)]
+	if !ok {
+		return storage.Info{}, storage.NewError("stat", hashValue, storage.ErrNotFound)
+	}
+
+	return storage.Info{Size: int64(len(value))}, nil
+}
+
+func (s *Storage) Has(ctx context.Context, hashValue []byte) (bool, error) {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+
+	_, ok := s.keyValue[hash.Format(hashValue)]
+	return ok, nil
+}
+
 func (s *Storage) Remove(ctx context.Context, hashValue []byte) error {
+	if err := ctx.Err(); err != nil {
+		return storage.NewError("remove", hashValue, err)
+	}
+
 	s.rw.Lock()
 	defer s.rw.Unlock()
 
 	key := hash.Format(hashValue)
 	if _, ok := s.keyValue[key]; !ok {
-		return storage.ErrNotFound
+		return storage.NewError("remove", hashValue, storage.ErrNotFound)
 	}
 
 	delete(s.keyValue, key)
@@ -67,29 +129,79 @@ func (s *Storage) Remove(ctx context.Context, hashValue []byte) error {
 	return nil
 }
 
-func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
-	mapper := func(yield storage.YieldFunc) {
+// All yields the hashes of a snapshot, contents put or removed
+// during the loop are not reflected
+func (s *Storage) All(ctx context.Context) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		s.rw.RLock()
+		keys := make([]string, 0, len(s.keyValue))
+		for key := range s.keyValue {
+			keys = append(keys, key)
+		}
+		s.rw.RUnlock()
+
+		for _, key := range keys {
+			hashValue, err := hash.ValueFromString(key)
+			if !yield(hashValue, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Storage) Entries(ctx context.Context) iter.Seq2[storage.Entry, error] {
+	return func(yield func(storage.Entry, error) bool) {
 		s.rw.RLock()
-		snapshot := make(map[string][]byte, len(s.keyValue))
+		sizes := make(map[string]int64, len(s.keyValue))
 		for key, value := range s.keyValue {
-			snapshot[key] = value
+			sizes[key] = int64(len(value))
 		}
 		s.rw.RUnlock()
 
-		for key := range snapshot {
+		for key, size := range sizes {
 			hashValue, err := hash.ValueFromString(key)
 			if err != nil {
-				yield(nil, err)
+				yield(storage.Entry{}, err)
 				return
 			}
 
-			if ok := yield(hashValue, err); !ok {
+			if !yield(storage.Entry{Hash: hashValue, Size: size}, nil) {
 				return
 			}
 		}
 	}
+}
+
+func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
+	return storage.Pull(s.All(context.Background()))
+}
+
+func (s *Storage) ListPage(ctx context.Context, opts storage.ListOptions) (*storage.Page, error) {
+	after, err := storage.ParseToken(opts.Token)
+	if err != nil {
+		return nil, storage.NewError("list", nil, err)
+	}
+
+	s.rw.RLock()
+	hashes := make([][]byte, 0, len(s.keyValue))
+	for key := range s.keyValue {
+		hashValue, err := hash.ValueFromString(key)
+		if err != nil {
+			s.rw.RUnlock()
+			return nil, storage.NewError("list", nil, err)
+		}
+
+		if bytes.HasPrefix(hashValue, opts.Prefix) && bytes.Compare(hashValue, after) > 0 {
+			hashes = append(hashes, hashValue)
+		}
+	}
+	s.rw.RUnlock()
+
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i], hashes[j]) < 0
+	})
 
-	return storage.Iterator(mapper)
+	return storage.NewPage(hashes, opts.PageSize), nil
 }
 
 func New() *Storage {
@@ -11,6 +11,7 @@ import (
 
 	"github.com/alinz/storage.go"
 	"github.com/alinz/storage.go/memory"
+	"github.com/alinz/storage.go/storagetest"
 )
 
 func TestMemoryStorage(t *testing.T) {
@@ -33,6 +34,24 @@ func TestMemoryStorage(t *testing.T) {
 		assert.Equal(t, rc, io.NopCloser(bytes.NewReader(content)))
 	})
 
+	t.Run("stat and has without reading the content", func(t *testing.T) {
+		info, err := memory.Stat(context.Background(), expectedHashValue)
+		assert.NoError(t, err)
+		assert.Equal(t, contentSize, info.Size)
+
+		exists, err := memory.Has(context.Background(), expectedHashValue)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		missing := hash.Bytes([]byte("missing"))
+		_, err = memory.Stat(context.Background(), missing)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		exists, err = memory.Has(context.Background(), missing)
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	})
+
 	t.Run("make sure the deleted value no longer get accessed", func(t *testing.T) {
 		err := memory.Remove(context.TODO(), expectedHashValue)
 		assert.NoError(t, err)
@@ -40,3 +59,9 @@ func TestMemoryStorage(t *testing.T) {
 		assert.Error(t, err, storage.ErrNotFound)
 	})
 }
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		return memory.New()
+	})
+}
@@ -0,0 +1,277 @@
+package merkle_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/merkle"
+)
+
+// adversarial answers every hash with one of its nodes, the first byte of
+// the hash picks the node so crafted meta nodes can point anywhere
+type adversarial [][]byte
+
+func (a adversarial) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(a) == 0 || len(hashValue) == 0 {
+		return nil, storage.ErrNotFound
+	}
+
+	return io.NopCloser(bytes.NewReader(a[int(hashValue[0])%len(a)])), nil
+}
+
+type countingGetter struct {
+	storage.Getter
+	count atomic.Int64
+}
+
+func (c *countingGetter) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	c.count.Add(1)
+	return c.Getter.Get(ctx, hashValue)
+}
+
+// ref is a hash which adversarial resolves to the i-th node
+func ref(i int) []byte {
+	value := make([]byte, 32)
+	value[0] = byte(i)
+	value[31] = 1
+	return value
+}
+
+func metaNode(fileType merkle.FileType, left, right []byte) []byte {
+	node := []byte{byte(fileType)}
+	node = append(node, left...)
+	return append(node, right...)
+}
+
+func dataNode(content string) []byte {
+	return append([]byte{byte(merkle.DataType)}, content...)
+}
+
+func getAll(t *testing.T, getter storage.Getter) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rc, err := merkle.New(getter, nil, nil, 16).Get(ctx, ref(0))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	// a shared subtree can repeat the content far beyond what is worth reading
+	return io.ReadAll(io.LimitReader(rc, 1<<20))
+}
+
+func TestMerkleGetAdversarial(t *testing.T) {
+	empty := make([]byte, 32)
+
+	t.Run("a node which is its own child", func(t *testing.T) {
+		_, err := getAll(t, adversarial{metaNode(merkle.RootType, ref(0), empty)})
+		assert.ErrorIs(t, err, merkle.ErrCycle)
+		assert.ErrorIs(t, err, storage.ErrCorrupted)
+	})
+
+	t.Run("a longer cycle", func(t *testing.T) {
+		_, err := getAll(t, adversarial{
+			metaNode(merkle.RootType, ref(1), empty),
+			metaNode(merkle.MetaType, ref(2), ref(3)),
+			dataNode("leaf"),
+			metaNode(merkle.MetaType, ref(1), empty),
+		})
+		assert.ErrorIs(t, err, merkle.ErrCycle)
+	})
+
+	t.Run("a shared subtree is not a cycle", func(t *testing.T) {
+		content, err := getAll(t, adversarial{
+			metaNode(merkle.RootType, ref(1), ref(1)),
+			dataNode("twice"),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "twicetwice", string(content))
+	})
+
+	t.Run("a tree deeper than MaxDepth", func(t *testing.T) {
+		nodes := adversarial{metaNode(merkle.RootType, ref(1), empty)}
+		for i := 1; i < 100; i++ {
+			nodes = append(nodes, metaNode(merkle.MetaType, ref(i+1), empty))
+		}
+		nodes = append(nodes, dataNode("leaf"))
+
+		_, err := getAll(t, nodes)
+		assert.ErrorIs(t, err, merkle.ErrTooDeep)
+	})
+
+	t.Run("a data node larger than the block size", func(t *testing.T) {
+		_, err := getAll(t, adversarial{
+			metaNode(merkle.RootType, ref(1), empty),
+			dataNode("more than sixteen bytes"),
+		})
+		assert.ErrorIs(t, err, merkle.ErrNodeTooLarge)
+	})
+
+	t.Run("a meta node with trailing bytes", func(t *testing.T) {
+		_, err := getAll(t, adversarial{append(metaNode(merkle.RootType, ref(1), empty), 0)})
+		assert.ErrorIs(t, err, merkle.ErrInvalidMetaFile)
+	})
+
+	t.Run("closing the reader stops the walk", func(t *testing.T) {
+		// every node points twice to the next one, the walk never ends
+		var nodes adversarial
+		for i := 0; i < 32; i++ {
+			nodes = append(nodes, metaNode(merkle.MetaType, ref(i+1), ref(i+1)))
+		}
+		nodes = append(nodes, dataNode("leaf"))
+
+		getter := &countingGetter{Getter: nodes}
+		rc, err := merkle.New(getter, nil, nil, 16).Get(context.Background(), ref(0))
+		assert.NoError(t, err)
+
+		_, err = io.ReadFull(rc, make([]byte, 8))
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+
+		time.Sleep(10 * time.Millisecond)
+		count := getter.count.Load()
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, count, getter.count.Load())
+	})
+}
+
+func FuzzParseMetaFile(f *testing.F) {
+	f.Add(metaNode(merkle.MetaType, ref(1), ref(2)))
+	f.Add(metaNode(merkle.RootType, ref(1), make([]byte, 32)))
+	f.Add([]byte{byte(merkle.MetaType)})
+	f.Add(append(metaNode(merkle.MetaType, ref(1), ref(2)), 0))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		meta, err := merkle.ParseMetaFile(bytes.NewReader(b))
+		if err != nil {
+			if !errors.Is(err, storage.ErrCorrupted) {
+				t.Fatalf("parse returned %v, expected storage.ErrCorrupted", err)
+			}
+			return
+		}
+
+		if len(b) != 65 {
+			t.Fatalf("parsed a meta node of %d bytes", len(b))
+		}
+
+		// a parsed node is written back as it was read
+		written, err := io.ReadAll(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(written, b) {
+			t.Fatalf("meta node %x was written back as %x", b, written)
+		}
+	})
+}
+
+func FuzzMetaFileWrite(f *testing.F) {
+	f.Add(metaNode(merkle.MetaType, ref(1), ref(2)))
+	f.Add([]byte{byte(merkle.DataType)})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		meta := merkle.NewMetaFile()
+		n, err := meta.Write(b)
+		if err != nil {
+			if n != 0 {
+				t.Fatalf("failed write returned %d bytes", n)
+			}
+			return
+		}
+
+		if n != len(b) {
+			t.Fatalf("write returned %d bytes, expected %d", n, len(b))
+		}
+
+		if !bytes.Equal(meta.Left(), b[1:33]) || !bytes.Equal(meta.Right(), b[33:]) {
+			t.Fatalf("meta node %x has left %x and right %x", b, meta.Left(), meta.Right())
+		}
+	})
+}
+
+func FuzzParseDataFile(f *testing.F) {
+	f.Add(dataNode("hello"))
+	f.Add([]byte{byte(merkle.DataType)})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r, err := merkle.ParseDataFile(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(content, b[1:]) {
+			t.Fatalf("data node %x parsed as %x", b, content)
+		}
+	})
+}
+
+func FuzzDetectFileType(f *testing.F) {
+	f.Add(dataNode("hello"))
+	f.Add(metaNode(merkle.RootType, ref(1), ref(2)))
+	f.Add([]byte{0xff})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r, fileType, err := merkle.DetectFileType(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+
+		switch fileType {
+		case merkle.MetaType, merkle.DataType, merkle.RootType:
+		default:
+			t.Fatalf("detected %s for %x", fileType, b)
+		}
+
+		// detecting the type doesn't consume the content
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(content, b) {
+			t.Fatalf("detecting the type of %x left %x", b, content)
+		}
+	})
+}
+
+// FuzzGet splits the input into the nodes of an adversarial store, Get
+// must end with the content or storage.ErrCorrupted
+func FuzzGet(f *testing.F) {
+	join := func(nodes ...[]byte) []byte {
+		return bytes.Join(nodes, []byte("|"))
+	}
+	empty := make([]byte, 32)
+
+	f.Add(join(metaNode(merkle.RootType, ref(1), ref(2)), dataNode("hello "), dataNode("world")))
+	f.Add(join(metaNode(merkle.RootType, ref(0), empty)))
+	f.Add(join(metaNode(merkle.RootType, ref(1), ref(1)), metaNode(merkle.MetaType, ref(0), ref(1))))
+	f.Add(join(metaNode(merkle.RootType, ref(1), empty), dataNode("a data node which is too large")))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		_, err := getAll(t, adversarial(bytes.Split(b, []byte("|"))))
+		if err != nil && !errors.Is(err, storage.ErrCorrupted) && !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("get returned %v, expected storage.ErrCorrupted", err)
+		}
+	})
+}
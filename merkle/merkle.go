@@ -1,12 +1,25 @@
 package merkle
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 
 	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/watch"
+)
+
+// MaxDepth is the deepest tree Get reads, a balanced tree of this depth
+// holds more blocks than any backend can store
+const MaxDepth = 64
+
+var (
+	ErrCycle        = fmt.Errorf("%w: node is its own ancestor", storage.ErrCorrupted)
+	ErrTooDeep      = fmt.Errorf("%w: tree is deeper than %d", storage.ErrCorrupted, MaxDepth)
+	ErrNodeTooLarge = fmt.Errorf("%w: data node is larger than the block size", storage.ErrCorrupted)
 )
 
 type Storage struct {
@@ -14,23 +27,81 @@ type Storage struct {
 	putter    storage.Putter
 	getter    storage.Getter
 	lister    storage.Lister
+	hub       watch.Hub
 }
 
 var _ storage.Putter = (*Storage)(nil)
 var _ storage.Getter = (*Storage)(nil)
 var _ storage.Lister = (*Storage)(nil)
-
+var _ storage.SeqLister = (*Storage)(nil)
+var _ storage.EntryLister = (*Storage)(nil)
+var _ storage.Watcher = (*Storage)(nil)
+var _ storage.Haser = (*Storage)(nil)
+
+// Put writes the whole tree in a single transaction if the putter is a
+// storage.Transactioner, so a failed Put doesn't leave any node behind.
+// Watchers get an OpRoot event once the tree is stored
 func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	hashValue, n, err := s.write(ctx, r)
+	if err != nil {
+		return nil, n, err
+	}
+
+	s.hub.Publish(storage.Event{Hash: hashValue, Op: storage.OpRoot, Size: n})
+
+	return hashValue, n, nil
+}
+
+func (s *Storage) write(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	transactioner, ok := storage.As[storage.Transactioner](s.putter)
+	if !ok {
+		return s.put(ctx, r)
+	}
+
+	tx, err := transactioner.Begin(ctx)
+	if errors.Is(err, storage.ErrNotSupported) {
+		return s.put(ctx, r)
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	session := &Storage{
+		blockSize: s.blockSize,
+		putter:    tx,
+		getter:    tx,
+		lister:    s.lister,
+	}
+
+	hashValue, n, err := session.put(ctx, r)
+	if err != nil {
+		return nil, n, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, n, err
+	}
+
+	return hashValue, n, nil
+}
+
+func (s *Storage) put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
 	var totalSize int64
 	var totalHeaderSize int64
 	var actualSize int64
 
-	tree := NewTree(s.rebalance)
+	tree := NewTree(func(parent []byte, child []byte, side NodeSide) ([]byte, error) {
+		return s.rebalance(ctx, parent, child, side)
+	})
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, actualSize, err
+		}
+
 		dataFile := NewDataFile(io.LimitReader(r, s.blockSize))
 		hashValue, n, err := s.putter.Put(ctx, dataFile)
-		if errors.Is(err, io.EOF) {
+		if errors.Is(err, io.EOF) || errors.Is(err, storage.ErrEmpty) {
 			break
 		} else if err != nil {
 			return nil, actualSize, err
@@ -56,16 +127,25 @@ func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
 	return rootValue, actualSize, nil
 }
 
+// Get streams the content of the tree, nodes are read from the backend
+// and can't be trusted: a node which is its own ancestor, a tree deeper
+// than MaxDepth or a data node larger than the block size is reported as
+// storage.ErrCorrupted. Closing the reader stops the walk
 func (s *Storage) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
 	pr, pw := io.Pipe()
 
-	stack := NewBytesStack()
-	stack.Push(hashValue)
+	stack := []*node{{hash: hashValue}}
 
 	walk := func() error {
-		value := stack.Pop()
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
 
-		r, err := s.getter.Get(ctx, value)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		r, err := s.getter.Get(ctx, current.hash)
 		if err != nil {
 			return err
 		}
@@ -73,40 +153,59 @@ func (s *Storage) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, err
 
 		reader, fileType, err := DetectFileType(r)
 		if err != nil {
-			return err
+			return nodeError(current.hash, err)
 		}
 
 		if fileType == MetaType || fileType == RootType {
 			metaFile, err := ParseMetaFile(reader)
 			if err != nil {
-				return err
+				return nodeError(current.hash, err)
 			}
 
-			if metaFile.HasRight() {
-				stack.Push(metaFile.right)
+			if current.depth >= MaxDepth {
+				return nodeError(current.hash, ErrTooDeep)
 			}
 
-			if metaFile.HasLeft() {
-				stack.Push(metaFile.left)
+			// right is pushed first so left is read first
+			for _, child := range [][]byte{metaFile.right, metaFile.left} {
+				if bytes.Equal(child, empty32Bytes) {
+					continue
+				}
+
+				if current.hasAncestor(child) {
+					return nodeError(current.hash, ErrCycle)
+				}
+
+				stack = append(stack, &node{hash: child, depth: current.depth + 1, parent: current})
 			}
 
 		} else if fileType == DataType {
 			reader, _ = ParseDataFile(reader)
-			_, err = io.Copy(pw, reader)
-			if err != nil {
+			if s.blockSize <= 0 {
+				_, err = io.Copy(pw, reader)
+				return err
+			}
+
+			if _, err = io.Copy(pw, io.LimitReader(reader, s.blockSize)); err != nil {
 				return err
 			}
+
+			if n, _ := reader.Read(make([]byte, 1)); n > 0 {
+				return nodeError(current.hash, ErrNodeTooLarge)
+			}
 		} else {
-			return fmt.Errorf("data corruption")
+			return nodeError(current.hash, ErrUnknownFileType)
 		}
 
 		return nil
 	}
 
 	go func() {
+		defer cancel()
+
 		var err error
 
-		for !stack.IsEmpty() {
+		for len(stack) > 0 {
 			err = walk()
 			if err != nil {
 				break
@@ -120,50 +219,91 @@ func (s *Storage) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, err
 		}
 	}()
 
-	return pr, nil
+	return &pipeReader{PipeReader: pr, cancel: cancel}, nil
 }
 
-func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
-	next, cancel := s.lister.List()
+// Has reports whether the root exists, Get can not be used for this
+// as it only reports errors while reading the content
+func (s *Storage) Has(ctx context.Context, hashValue []byte) (bool, error) {
+	return storage.Has(ctx, s.getter, hashValue)
+}
 
-	// helper fucntion is extracted so defer rc.Close() can be called
-	// inside the loop without compounding the number of open files
-	helper := func(ctx context.Context) ([]byte, FileType, error) {
-		hashValue, err := next(ctx)
-		if err != nil {
-			return nil, 0, err
-		}
+// All only yields the roots, every listed hash is read to detect its type
+func (s *Storage) All(ctx context.Context) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		for hashValue, err := range storage.All(ctx, s.lister) {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
 
-		rc, err := s.getter.Get(ctx, hashValue)
-		if err != nil {
-			return nil, 0, err
-		}
-		defer rc.Close()
+			fileType, err := s.fileType(ctx, hashValue)
+			if errors.Is(err, io.EOF) {
+				// empty contents are not part of any tree
+				continue
+			} else if err != nil {
+				yield(nil, err)
+				return
+			}
 
-		_, fileType, err := DetectFileType(rc)
-		if errors.Is(err, io.EOF) {
-			return nil, 0, storage.ErrIteratorDone
-		} else if err != nil {
-			return nil, 0, err
-		}
+			if fileType != RootType {
+				continue
+			}
 
-		return hashValue, fileType, nil
+			if !yield(hashValue, nil) {
+				return
+			}
+		}
 	}
+}
 
-	return func(ctx context.Context) ([]byte, error) {
-		for {
-			hashValue, fileType, err := helper(ctx)
+// Entries lists every node of every tree with its type, contents which
+// are not merkle nodes are listed with an empty type
+func (s *Storage) Entries(ctx context.Context) iter.Seq2[storage.Entry, error] {
+	return func(yield func(storage.Entry, error) bool) {
+		for entry, err := range storage.Entries(ctx, s.lister) {
 			if err != nil {
-				return nil, err
+				yield(storage.Entry{}, err)
+				return
 			}
 
-			if fileType != RootType {
-				continue
+			fileType, err := s.fileType(ctx, entry.Hash)
+			switch {
+			case err == nil:
+				entry.Type = fileType.String()
+			case errors.Is(err, io.EOF), errors.Is(err, ErrUnknownFileType):
+				// not a merkle node
+			default:
+				yield(storage.Entry{}, err)
+				return
 			}
 
-			return hashValue, nil
+			if !yield(entry, nil) {
+				return
+			}
 		}
-	}, cancel
+	}
+}
+
+// Watch only yields OpRoot events, writes of the nodes can be watched
+// on the backend
+func (s *Storage) Watch(ctx context.Context) iter.Seq2[storage.Event, error] {
+	return s.hub.Watch(ctx)
+}
+
+func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
+	return storage.Pull(s.All(context.Background()))
+}
+
+func (s *Storage) fileType(ctx context.Context, hashValue []byte) (FileType, error) {
+	rc, err := s.getter.Get(ctx, hashValue)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	_, fileType, err := DetectFileType(rc)
+	return fileType, err
 }
 
 func (s *Storage) verify(ctx context.Context, hashValue []byte) (bool, error) {
@@ -176,17 +316,11 @@ func (s *Storage) setAsRoot(ctx context.Context, hashValue []byte) ([]byte, erro
 		return nil, err
 	}
 	metaFile.isRoot = true
-	rootValue, _, err := s.putter.Put(ctx, metaFile)
-	if err != nil {
-		return nil, err
-	}
 
-	return rootValue, nil
+	return s.putMetaFile(ctx, metaFile)
 }
 
-func (s *Storage) rebalance(parent []byte, child []byte, side NodeSide) ([]byte, error) {
-	ctx := context.Background()
-
+func (s *Storage) rebalance(ctx context.Context, parent []byte, child []byte, side NodeSide) ([]byte, error) {
 	metaFile, err := s.readMetaFile(ctx, parent)
 	if err != nil {
 		return nil, err
@@ -199,29 +333,95 @@ func (s *Storage) rebalance(parent []byte, child []byte, side NodeSide) ([]byte,
 		copy(metaFile.right, child)
 	}
 
-	newValue, _, err := s.putter.Put(ctx, metaFile)
+	return s.putMetaFile(ctx, metaFile)
+}
+
+// putMetaFile skips writing meta files which already exist, the hash of a
+// meta file is known before writing it. This only happens if the getter can
+// answer cheaply, otherwise writing 65 bytes is faster than checking
+func (s *Storage) putMetaFile(ctx context.Context, metaFile *MetaFile) ([]byte, error) {
+	if haser, ok := storage.As[storage.Haser](s.getter); ok {
+		hashValue := metaFile.Hash()
+		exists, err := haser.Has(ctx, hashValue)
+		if err != nil {
+			return nil, err
+		} else if exists {
+			return hashValue, nil
+		}
+	}
+
+	hashValue, _, err := s.putter.Put(ctx, metaFile)
 	if err != nil {
 		return nil, err
 	}
 
-	return newValue, nil
+	return hashValue, nil
 }
 
 func (s *Storage) readMetaFile(ctx context.Context, key []byte) (*MetaFile, error) {
-	metaFile := NewMetaFile()
+	// new nodes of the tree don't have a value yet
+	if len(key) == 0 {
+		return NewMetaFile(), nil
+	}
 
 	metaFileReader, err := s.getter.Get(ctx, key)
 	if errors.Is(err, storage.ErrNotFound) {
 		// ignore
-		err = nil
+		return NewMetaFile(), nil
 	} else if err != nil {
 		return nil, err
-	} else {
-		_, err = io.Copy(metaFile, metaFileReader)
-		metaFileReader.Close()
+	}
+	defer metaFileReader.Close()
+
+	metaFile, err := ParseMetaFile(metaFileReader)
+	if err != nil {
+		return nil, err
+	}
+
+	// the parent is rebuilt as an inner node, setAsRoot marks the root
+	metaFile.isRoot = false
+
+	return metaFile, nil
+}
+
+// node is a node of the tree which Get has not read yet, parent links
+// the ancestors to find cycles. A node can appear under many parents,
+// the same subtree is shared by identical parts of the content
+type node struct {
+	hash   []byte
+	depth  int
+	parent *node
+}
+
+func (n *node) hasAncestor(hashValue []byte) bool {
+	for current := n; current != nil; current = current.parent {
+		if bytes.Equal(current.hash, hashValue) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pipeReader stops the walk of Get when it is closed
+type pipeReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (p *pipeReader) Close() error {
+	p.cancel()
+	return p.PipeReader.Close()
+}
+
+// nodeError reports a node which can't be parsed as storage.ErrCorrupted,
+// errors of the backend are returned as they are
+func nodeError(hashValue []byte, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = fmt.Errorf("%w: %w", storage.ErrCorrupted, err)
 	}
 
-	return metaFile, err
+	return storage.NewError("get", hashValue, err)
 }
 
 func New(getter storage.Getter, putter storage.Putter, lister storage.Lister, blockSize int64) *Storage {
@@ -5,13 +5,28 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
+
+	"github.com/alinz/storage.go"
 )
 
 var (
-	ErrUnknownFileType = errors.New("unknown node type")
+	ErrUnknownFileType = fmt.Errorf("%w: unknown node type", storage.ErrCorrupted)
+	ErrInvalidMetaFile = fmt.Errorf("%w: meta node is not %d bytes", storage.ErrCorrupted, MetaFileSize)
 )
 
+// MetaFileSize is the stored size of a meta node, the type byte followed
+// by the left and right hashes
+const MetaFileSize = 65
+
+// NodeSize is the largest node stored for blockSize, a data node is the
+// type byte followed by a block. Backends which limit the size of a
+// content, e.g. sqlite, need at least this much
+func NodeSize(blockSize int64) int64 {
+	return max(blockSize+1, MetaFileSize)
+}
+
 type FileType byte
 
 func (ft FileType) String() string {
@@ -65,7 +80,7 @@ func (m *MetaFile) Read(b []byte) (int, error) {
 	}
 
 	n := len(b)
-	if n < 65 {
+	if n < MetaFileSize {
 		return 0, io.ErrShortBuffer
 	}
 
@@ -79,22 +94,23 @@ func (m *MetaFile) Read(b []byte) (int, error) {
 	copy(b[33:], m.right)
 	m.readDone = true
 
-	return 65, nil
+	return MetaFileSize, nil
 }
 
 func (m *MetaFile) Write(b []byte) (int, error) {
-	if len(b) != 65 {
-		return 0, io.ErrShortWrite
+	if len(b) != MetaFileSize {
+		return 0, ErrInvalidMetaFile
 	}
 
 	if b[0] != byte(MetaType) && b[0] != byte(RootType) {
 		return 0, ErrUnknownFileType
 	}
 
+	m.isRoot = b[0] == byte(RootType)
 	copy(m.left, b[1:33])
 	copy(m.right, b[33:])
 
-	return 65, nil
+	return MetaFileSize, nil
 }
 
 func (m *MetaFile) Hash() []byte {
@@ -163,27 +179,34 @@ func DetectFileType(r io.Reader) (io.Reader, FileType, error) {
 	return br, FileType, nil
 }
 
+// ParseMetaFile reads exactly one meta node, shorter or longer
+// contents are ErrInvalidMetaFile
 func ParseMetaFile(r io.Reader) (*MetaFile, error) {
+	// one more byte than needed to catch trailing bytes
+	b := make([]byte, MetaFileSize+1)
+	n, err := io.ReadFull(r, b)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+
+	if n != MetaFileSize {
+		return nil, ErrInvalidMetaFile
+	}
+
 	meta := NewMetaFile()
-	_, err := io.Copy(meta, r)
-	if err != nil {
+	if _, err := meta.Write(b[:n]); err != nil {
 		return nil, err
 	}
+
 	return meta, nil
 }
 
 func ParseDataFile(r io.Reader) (io.Reader, error) {
 	b := []byte{0}
-	n, err := r.Read(b)
-
-	if err != nil {
+	if _, err := io.ReadFull(r, b); err != nil {
 		return nil, err
 	}
 
-	if n == 0 {
-		return nil, io.EOF
-	}
-
 	if b[0] != byte(DataType) {
 		return nil, ErrUnknownFileType
 	}
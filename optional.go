@@ -0,0 +1,24 @@
+package storage
+
+// Optional is implemented by wrappers which have the methods of every
+// optional interface but only serve the ones of what they wrap. target
+// is a nil pointer to the interface, e.g. (*Haser)(nil)
+type Optional interface {
+	Implements(target any) bool
+}
+
+// As asserts v to T like a type assertion, except that it fails if v
+// is an Optional which doesn't serve T
+func As[T any](v any) (T, bool) {
+	t, ok := v.(T)
+	if !ok {
+		return t, false
+	}
+
+	if optional, ok := v.(Optional); ok && !optional.Implements((*T)(nil)) {
+		var zero T
+		return zero, false
+	}
+
+	return t, true
+}
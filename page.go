@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"sort"
+)
+
+// DefaultPageSize is used if ListOptions.PageSize is not set
+const DefaultPageSize = 1000
+
+// ListPage uses PageLister if lister implements it, otherwise the whole
+// listing is read and sorted to build the requested page
+func ListPage(ctx context.Context, lister Lister, opts ListOptions) (*Page, error) {
+	if pageLister, ok := As[PageLister](lister); ok {
+		return pageLister.ListPage(ctx, opts)
+	}
+
+	after, err := ParseToken(opts.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes [][]byte
+	for hashValue, err := range All(ctx, lister) {
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.HasPrefix(hashValue, opts.Prefix) && bytes.Compare(hashValue, after) > 0 {
+			hashes = append(hashes, hashValue)
+		}
+	}
+
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i], hashes[j]) < 0
+	})
+
+	return NewPage(hashes, opts.PageSize), nil
+}
+
+// NewPage builds a page out of sorted hashes, backends should pass
+// one more hash than the page size so Next is only set if there is
+// another page
+func NewPage(hashes [][]byte, pageSize int) *Page {
+	pageSize = PageSize(pageSize)
+
+	if len(hashes) <= pageSize {
+		return &Page{Hashes: hashes}
+	}
+
+	hashes = hashes[:pageSize]
+
+	return &Page{
+		Hashes: hashes,
+		Next:   Token(hashes[pageSize-1]),
+	}
+}
+
+// PageSize returns DefaultPageSize if pageSize is not set
+func PageSize(pageSize int) int {
+	if pageSize <= 0 {
+		return DefaultPageSize
+	}
+
+	return pageSize
+}
+
+// Token encodes the last hash of a page, callers should treat
+// tokens as opaque values
+func Token(hash []byte) string {
+	return base64.RawURLEncoding.EncodeToString(hash)
+}
+
+// ParseToken returns the last hash of the previous page,
+// an empty token returns nil
+func ParseToken(token string) ([]byte, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	hash, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	return hash, nil
+}
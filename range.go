@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"io"
+)
+
+// GetRange returns length bytes of the content starting at offset, a
+// negative length reads until the end. It uses RangeGetter if getter
+// implements it, otherwise the content is seeked if possible or the bytes
+// before offset are skipped
+func GetRange(ctx context.Context, getter Getter, hash []byte, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, ErrInvalidRange
+	}
+
+	if rangeGetter, ok := As[RangeGetter](getter); ok {
+		return rangeGetter.GetRange(ctx, hash, offset, length)
+	}
+
+	rc, err := getter.Get(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if seeker, ok := rc.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, rc, offset)
+		if err == io.EOF {
+			// offset is past the end, nothing left to read
+			err = nil
+		}
+	}
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	return LimitReadCloser(rc, length), nil
+}
+
+// LimitReadCloser is io.LimitReader which keeps the Closer of rc,
+// a negative n means no limit
+func LimitReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	if n < 0 {
+		return rc
+	}
+
+	return &limitReadCloser{
+		Reader: io.LimitReader(rc, n),
+		closer: rc,
+	}
+}
+
+type limitReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (l *limitReadCloser) Close() error {
+	return l.closer.Close()
+}
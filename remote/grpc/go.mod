@@ -0,0 +1,28 @@
+module github.com/alinz/storage.go/remote/grpc
+
+go 1.25.0
+
+require (
+	github.com/alinz/hash.go v0.0.0-20211013151738-120d1a5878e0
+	github.com/alinz/storage.go v0.0.0
+	github.com/alinz/storage.go/server/grpc v0.0.0
+	github.com/stretchr/testify v1.7.0
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800
+	google.golang.org/grpc v1.84.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/protobuf v1.36.12 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace (
+	github.com/alinz/storage.go => ../..
+	github.com/alinz/storage.go/server/grpc => ../../server/grpc
+)
@@ -0,0 +1,224 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/server/grpc/pb"
+)
+
+const chunkSize = 32 * 1024
+
+// Storage is a client of the gRPC storage service, deadlines and
+// cancellation of the given contexts are propagated to the server
+type Storage struct {
+	client pb.StorageClient
+}
+
+var _ storage.Putter = (*Storage)(nil)
+var _ storage.Getter = (*Storage)(nil)
+var _ storage.Remover = (*Storage)(nil)
+var _ storage.Lister = (*Storage)(nil)
+var _ storage.SeqLister = (*Storage)(nil)
+
+func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := s.client.Put(ctx)
+	if err != nil {
+		return nil, 0, wrapError("put", nil, err)
+	}
+
+	buffer := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buffer)
+		if n > 0 {
+			if err := stream.Send(&pb.PutRequest{Chunk: buffer[:n]}); err != nil {
+				// the real reason is returned by CloseAndRecv
+				break
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, 0, storage.NewError("put", nil, err)
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, 0, wrapError("put", nil, err)
+	}
+
+	return resp.Hash, resp.Size, nil
+}
+
+func (s *Storage) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	stream, err := s.client.Get(ctx, &pb.GetRequest{Hash: hashValue})
+	if err != nil {
+		cancel()
+		return nil, wrapError("get", hashValue, err)
+	}
+
+	// receive the first chunk so errors such as not found are returned
+	// by Get instead of the first Read
+	resp, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return &getReader{stream: stream, cancel: cancel, hash: hashValue, done: true}, nil
+	} else if err != nil {
+		cancel()
+		return nil, wrapError("get", hashValue, err)
+	}
+
+	return &getReader{stream: stream, cancel: cancel, hash: hashValue, chunk: resp.Chunk}, nil
+}
+
+func (s *Storage) Remove(ctx context.Context, hashValue []byte) error {
+	_, err := s.client.Remove(ctx, &pb.RemoveRequest{Hash: hashValue})
+	return wrapError("remove", hashValue, err)
+}
+
+// All cancels the stream once the loop is done
+func (s *Storage) All(ctx context.Context) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		stream, err := s.client.List(ctx, &pb.ListRequest{})
+		if err != nil {
+			yield(nil, wrapError("list", nil, err))
+			return
+		}
+
+		for {
+			resp, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return
+			} else if err != nil {
+				yield(nil, wrapError("list", nil, err))
+				return
+			}
+
+			for _, hashValue := range resp.Hashes {
+				if !yield(hashValue, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
+	return storage.Pull(s.All(context.Background()))
+}
+
+func New(conn grpc.ClientConnInterface) *Storage {
+	return &Storage{
+		client: pb.NewStorageClient(conn),
+	}
+}
+
+// wrapError maps the status of err and adds the operation and the hash
+func wrapError(op string, hashValue []byte, err error) error {
+	return storage.NewError(op, hashValue, fromStatus(err))
+}
+
+// reasons maps the reasons of the ErrorInfo details set by server/grpc
+// back to the errors of the storage package
+var reasons = map[string]error{
+	"EMPTY":         storage.ErrEmpty,
+	"NOT_FOUND":     storage.ErrNotFound,
+	"INVALID_TOKEN": storage.ErrInvalidToken,
+	"INVALID_RANGE": storage.ErrInvalidRange,
+	"TOO_LARGE":     storage.ErrTooLarge,
+	"READ_ONLY":     storage.ErrReadOnly,
+	"NOT_SUPPORTED": storage.ErrNotSupported,
+	"UNAVAILABLE":   storage.ErrUnavailable,
+	"CLOSED":        storage.ErrClosed,
+	"CORRUPTED":     storage.ErrCorrupted,
+}
+
+// errorDomain is the domain of the ErrorInfo details set by server/grpc
+const errorDomain = "github.com/alinz/storage.go"
+
+// fromStatus maps a status to the errors of the storage package, the
+// reason of its ErrorInfo detail is used if it has one. Otherwise only the
+// codes which gRPC itself sets are mapped, e.g. an unreachable server
+func fromStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	st := status.Convert(err)
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != errorDomain {
+			continue
+		}
+
+		if kind, ok := reasons[info.Reason]; ok {
+			return fmt.Errorf("%w: %w", kind, err)
+		}
+	}
+
+	switch st.Code() {
+	case codes.Canceled:
+		return context.Canceled
+	case codes.DeadlineExceeded:
+		return context.DeadlineExceeded
+	case codes.Unavailable:
+		return fmt.Errorf("%w: %w", storage.ErrUnavailable, err)
+	case codes.Unimplemented:
+		return fmt.Errorf("%w: %w", storage.ErrNotSupported, err)
+	default:
+		return err
+	}
+}
+
+type getReader struct {
+	stream pb.Storage_GetClient
+	cancel context.CancelFunc
+	hash   []byte
+	chunk  []byte
+	done   bool
+}
+
+func (g *getReader) Read(b []byte) (int, error) {
+	for len(g.chunk) == 0 {
+		if g.done {
+			return 0, io.EOF
+		}
+
+		resp, err := g.stream.Recv()
+		if errors.Is(err, io.EOF) {
+			g.done = true
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, wrapError("get", g.hash, err)
+		}
+		g.chunk = resp.Chunk
+	}
+
+	n := copy(b, g.chunk)
+	g.chunk = g.chunk[n:]
+
+	return n, nil
+}
+
+func (g *getReader) Close() error {
+	g.cancel()
+	return nil
+}
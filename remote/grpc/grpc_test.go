@@ -0,0 +1,217 @@
+package grpc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/alinz/hash.go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/internal/tests"
+	"github.com/alinz/storage.go/memory"
+	"github.com/alinz/storage.go/merkle"
+	remote "github.com/alinz/storage.go/remote/grpc"
+	server "github.com/alinz/storage.go/server/grpc"
+	"github.com/alinz/storage.go/server/grpc/pb"
+	"github.com/alinz/storage.go/storagetest"
+)
+
+func newClient(t *testing.T, srv pb.StorageServer) *remote.Storage {
+	listener := bufconn.Listen(1024 * 1024)
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterStorageServer(grpcServer, srv)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient(
+		"passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return remote.New(conn)
+}
+
+func TestGrpcStorage(t *testing.T) {
+	backend := memory.New()
+	client := newClient(t, server.New(backend, backend, backend, backend))
+
+	content := []byte("hello world")
+	expectedHash := hash.Bytes(content)
+
+	t.Run("put and get a content", func(t *testing.T) {
+		hashValue, n, err := client.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), n)
+		assert.Equal(t, expectedHash, hash.Value(hashValue))
+
+		rc, err := client.Get(context.Background(), hashValue)
+		assert.NoError(t, err)
+		defer rc.Close()
+		assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
+	})
+
+	t.Run("put and get a large content", func(t *testing.T) {
+		content := make([]byte, 1024*1024)
+		for i := range content {
+			content[i] = byte(i % 251)
+		}
+
+		hashValue, n, err := client.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), n)
+
+		rc, err := client.Get(context.Background(), hashValue)
+		assert.NoError(t, err)
+		defer rc.Close()
+		assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
+	})
+
+	t.Run("list every content", func(t *testing.T) {
+		next, cancel := client.List()
+		defer cancel()
+
+		count := 0
+		for {
+			_, err := next(context.Background())
+			if errors.Is(err, storage.ErrIteratorDone) {
+				break
+			}
+			assert.NoError(t, err)
+			count++
+		}
+
+		assert.Equal(t, 2, count)
+	})
+
+	t.Run("remove a content", func(t *testing.T) {
+		assert.NoError(t, client.Remove(context.Background(), expectedHash))
+
+		_, err := client.Get(context.Background(), expectedHash)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("merkle on top of grpc storage", func(t *testing.T) {
+		merkleStorage := merkle.New(client, client, client, 4)
+
+		content := []byte("hello world from a remote merkle tree")
+		root, n, err := merkleStorage.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), n)
+
+		rc, err := merkleStorage.Get(context.Background(), root)
+		assert.NoError(t, err)
+		defer rc.Close()
+		assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
+	})
+}
+
+// slowGetter never returns until the context is done
+type slowGetter struct{}
+
+func (slowGetter) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestGrpcStorageDeadline(t *testing.T) {
+	client := newClient(t, server.New(nil, slowGetter{}, nil, nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	hashValue := hash.Bytes([]byte("slow"))
+	_, err := client.Get(ctx, hashValue)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	var storageErr *storage.Error
+	assert.True(t, errors.As(err, &storageErr))
+	assert.Equal(t, "get", storageErr.Op)
+	assert.Equal(t, []byte(hashValue), storageErr.Hash)
+
+	err = client.Remove(context.Background(), hash.Bytes([]byte("slow")))
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, storage.ErrNotFound))
+}
+
+// failingGetter returns err for every hash
+type failingGetter struct {
+	err error
+}
+
+func (f failingGetter) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	return nil, f.err
+}
+
+// invalidServer answers every Remove with a status which
+// doesn't come from server/grpc
+type invalidServer struct {
+	pb.UnimplementedStorageServer
+}
+
+func (invalidServer) Remove(ctx context.Context, req *pb.RemoveRequest) (*pb.RemoveResponse, error) {
+	return nil, status.Error(codes.InvalidArgument, "bad request")
+}
+
+func TestGrpcStorageErrors(t *testing.T) {
+	for _, sentinel := range []error{
+		storage.ErrEmpty,
+		storage.ErrNotFound,
+		storage.ErrInvalidToken,
+		storage.ErrInvalidRange,
+		storage.ErrTooLarge,
+		storage.ErrReadOnly,
+		storage.ErrNotSupported,
+		storage.ErrUnavailable,
+		storage.ErrClosed,
+		storage.ErrCorrupted,
+	} {
+		client := newClient(t, server.New(nil, failingGetter{sentinel}, nil, nil))
+
+		_, err := client.Get(context.Background(), hash.Bytes([]byte("hello")))
+		assert.ErrorIs(t, err, sentinel)
+	}
+
+	// a status without the detail of server/grpc is not guessed from its code
+	var storageErr *storage.Error
+	client := newClient(t, invalidServer{})
+	err := client.Remove(context.Background(), hash.Bytes([]byte("hello")))
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, storage.ErrEmpty))
+
+	// the rpcs of a nil backend are not supported
+	_, _, err = client.Put(context.Background(), bytes.NewReader([]byte("hello")))
+	assert.ErrorIs(t, err, storage.ErrNotSupported)
+
+	// errors of the reader are returned as errors of put
+	readErr := errors.New("read failed")
+	client = newClient(t, server.New(memory.New(), nil, nil, nil))
+	_, _, err = client.Put(context.Background(), iotest.ErrReader(readErr))
+	assert.ErrorIs(t, err, readErr)
+	assert.True(t, errors.As(err, &storageErr))
+	assert.Equal(t, "put", storageErr.Op)
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		backend := memory.New()
+		return newClient(t, server.New(backend, backend, backend, backend))
+	})
+}
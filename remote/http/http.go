@@ -0,0 +1,452 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/alinz/hash.go"
+
+	"github.com/alinz/storage.go"
+)
+
+var (
+	ErrHashMismatch = fmt.Errorf("%w: hash mismatch", storage.ErrCorrupted)
+)
+
+type Storage struct {
+	baseURL    string
+	client     *http.Client
+	maxRetries int
+	backoff    time.Duration
+	pageSize   int
+	verify     bool
+}
+
+var _ storage.Putter = (*Storage)(nil)
+var _ storage.Getter = (*Storage)(nil)
+var _ storage.Remover = (*Storage)(nil)
+var _ storage.Lister = (*Storage)(nil)
+var _ storage.SeqLister = (*Storage)(nil)
+var _ storage.RangeGetter = (*Storage)(nil)
+var _ storage.PageLister = (*Storage)(nil)
+
+type Option func(*Storage)
+
+// WithClient sets the http client used for all requests,
+// http.DefaultClient is used by default
+func WithClient(client *http.Client) Option {
+	return func(s *Storage) {
+		s.client = client
+	}
+}
+
+// WithRetries sets how many times a failed request is retried, only network
+// errors and 5xx/429 responses are retried. The wait time between attempts
+// starts at backoff and doubles every time
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(s *Storage) {
+		s.maxRetries = maxRetries
+		s.backoff = backoff
+	}
+}
+
+// WithPageSize sets how many hashes are requested per page while listing
+func WithPageSize(pageSize int) Option {
+	return func(s *Storage) {
+		s.pageSize = pageSize
+	}
+}
+
+// WithoutVerification disables checking the hash of downloaded content,
+// it is required when the remote serves content which is not addressed by
+// its own hash, e.g. merkle roots
+func WithoutVerification() Option {
+	return func(s *Storage) {
+		s.verify = false
+	}
+}
+
+type putResponse struct {
+	Hash hash.Value `json:"hash"`
+	Size int64      `json:"size"`
+}
+
+type listResponse struct {
+	Hashes []hash.Value `json:"hashes"`
+	Next   string       `json:"next"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// codes are the error codes of the server, a code names the sentinel
+// error the server got so a status shared by several errors is not guessed
+var codes = map[string]error{
+	"empty":         storage.ErrEmpty,
+	"not_found":     storage.ErrNotFound,
+	"invalid_token": storage.ErrInvalidToken,
+	"invalid_range": storage.ErrInvalidRange,
+	"too_large":     storage.ErrTooLarge,
+	"read_only":     storage.ErrReadOnly,
+	"not_supported": storage.ErrNotSupported,
+	"unavailable":   storage.ErrUnavailable,
+}
+
+func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	// a stream can only be sent once, unless we can rewind it
+	seeker, canRetry := r.(io.Seeker)
+	var start int64
+	if canRetry {
+		var err error
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			canRetry = false
+		}
+	}
+
+	var hr *hash.Reader
+	newRequest := func() (*http.Request, error) {
+		if hr != nil {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		hr = hash.NewReader(r)
+		return http.NewRequestWithContext(ctx, http.MethodPut, s.baseURL+"/blobs", io.NopCloser(hr))
+	}
+
+	maxRetries := s.maxRetries
+	if !canRetry {
+		maxRetries = 0
+	}
+
+	resp, err := s.do(ctx, maxRetries, newRequest)
+	if err != nil {
+		return nil, 0, wrapError("put", nil, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, 0, wrapError("put", nil, responseError(resp))
+	}
+
+	var result putResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, wrapError("put", nil, err)
+	}
+
+	if s.verify && !bytes.Equal(hr.Hash(), result.Hash) {
+		return nil, 0, wrapError("put", nil, fmt.Errorf("%w: sent %s, remote stored %s", ErrHashMismatch, hash.Format(hr.Hash()), hash.Format(result.Hash)))
+	}
+
+	return result.Hash, result.Size, nil
+}
+
+func (s *Storage) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	// there is no way to address an empty hash remotely
+	if len(hashValue) == 0 {
+		return nil, wrapError("get", hashValue, storage.ErrNotFound)
+	}
+
+	resp, err := s.do(ctx, s.maxRetries, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, s.blobURL(hashValue), nil)
+	})
+	if err != nil {
+		return nil, wrapError("get", hashValue, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, wrapError("get", hashValue, responseError(resp))
+	}
+
+	if !s.verify {
+		return resp.Body, nil
+	}
+
+	return &verifyReader{
+		hr:       hash.NewReader(resp.Body),
+		rc:       resp.Body,
+		expected: hashValue,
+	}, nil
+}
+
+// GetRange sends a Range request, partial content can't be verified
+// against its hash so verification is skipped
+func (s *Storage) GetRange(ctx context.Context, hashValue []byte, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, wrapError("get", hashValue, storage.ErrInvalidRange)
+	}
+
+	if len(hashValue) == 0 {
+		return nil, wrapError("get", hashValue, storage.ErrNotFound)
+	}
+
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	rangeHeader := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		rangeHeader = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+
+	resp, err := s.do(ctx, s.maxRetries, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.blobURL(hashValue), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", rangeHeader)
+		return req, nil
+	})
+	if err != nil {
+		return nil, wrapError("get", hashValue, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	case http.StatusOK:
+		// the remote ignored the range
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil && !errors.Is(err, io.EOF) {
+			resp.Body.Close()
+			return nil, wrapError("get", hashValue, err)
+		}
+		return storage.LimitReadCloser(resp.Body, length), nil
+	default:
+		defer resp.Body.Close()
+		return nil, wrapError("get", hashValue, responseError(resp))
+	}
+}
+
+func (s *Storage) Remove(ctx context.Context, hashValue []byte) error {
+	if len(hashValue) == 0 {
+		return wrapError("remove", hashValue, storage.ErrNotFound)
+	}
+
+	resp, err := s.do(ctx, s.maxRetries, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodDelete, s.blobURL(hashValue), nil)
+	})
+	if err != nil {
+		return wrapError("remove", hashValue, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return wrapError("remove", hashValue, responseError(resp))
+	}
+
+	return nil
+}
+
+// All requests one page at a time, the next page is only
+// requested once the loop reaches it
+func (s *Storage) All(ctx context.Context) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		opts := storage.ListOptions{PageSize: s.pageSize}
+
+		for {
+			page, err := s.ListPage(ctx, opts)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			for _, hashValue := range page.Hashes {
+				if !yield(hashValue, nil) {
+					return
+				}
+			}
+
+			if page.Next == "" {
+				return
+			}
+			opts.Token = page.Next
+		}
+	}
+}
+
+func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
+	return storage.Pull(s.All(context.Background()))
+}
+
+func (s *Storage) ListPage(ctx context.Context, opts storage.ListOptions) (*storage.Page, error) {
+	query := url.Values{}
+	query.Set("limit", fmt.Sprintf("%d", storage.PageSize(opts.PageSize)))
+	if opts.Token != "" {
+		query.Set("token", opts.Token)
+	}
+	if len(opts.Prefix) > 0 {
+		query.Set("prefix", hex.EncodeToString(opts.Prefix))
+	}
+
+	resp, err := s.do(ctx, s.maxRetries, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, s.baseURL+"/blobs?"+query.Encode(), nil)
+	})
+	if err != nil {
+		return nil, wrapError("list", nil, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, wrapError("list", nil, responseError(resp))
+	}
+
+	var list listResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, wrapError("list", nil, err)
+	}
+
+	page := &storage.Page{Hashes: make([][]byte, 0, len(list.Hashes)), Next: list.Next}
+	for _, hashValue := range list.Hashes {
+		page.Hashes = append(page.Hashes, hashValue)
+	}
+
+	return page, nil
+}
+
+func (s *Storage) blobURL(hashValue []byte) string {
+	return s.baseURL + "/blobs/" + hash.Format(hashValue)
+}
+
+// do sends the request created by newRequest and retries network errors and
+// server side failures up to maxRetries times
+func (s *Storage) do(ctx context.Context, maxRetries int, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	backoff := s.backoff
+
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.client.Do(req)
+		if err == nil && !retryable(resp.StatusCode) {
+			return resp, nil
+		}
+
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+
+		if attempt >= maxRetries {
+			if err != nil {
+				// the remote can't be reached
+				return nil, fmt.Errorf("%w: %w", storage.ErrUnavailable, err)
+			}
+			return resp, nil
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func New(baseURL string, opts ...Option) *Storage {
+	s := &Storage{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		client:     http.DefaultClient,
+		maxRetries: 3,
+		backoff:    100 * time.Millisecond,
+		pageSize:   1000,
+		verify:     true,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+func retryable(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusTooManyRequests
+}
+
+// responseError maps the status codes set by server/http back
+// to the errors of the storage package
+func responseError(resp *http.Response) error {
+	err := fmt.Errorf("remote responded with status %d", resp.StatusCode)
+
+	var errResp errorResponse
+	if json.NewDecoder(resp.Body).Decode(&errResp) == nil && errResp.Error != "" {
+		err = fmt.Errorf("remote responded with status %d: %s", resp.StatusCode, errResp.Error)
+	}
+
+	kind, ok := codes[errResp.Code]
+
+	// older servers don't send a code
+	if !ok {
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			kind = storage.ErrNotFound
+		case resp.StatusCode == http.StatusRequestEntityTooLarge:
+			kind = storage.ErrTooLarge
+		case resp.StatusCode == http.StatusForbidden:
+			kind = storage.ErrReadOnly
+		case resp.StatusCode == http.StatusNotImplemented:
+			kind = storage.ErrNotSupported
+		case retryable(resp.StatusCode):
+			kind = storage.ErrUnavailable
+		}
+	}
+
+	if kind != nil {
+		err = fmt.Errorf("%w: %w", kind, err)
+	}
+
+	return err
+}
+
+// wrapError keeps the sentinel errors and adds the operation and the hash
+func wrapError(op string, hashValue []byte, err error) error {
+	return storage.NewError(op, hashValue, err)
+}
+
+// verifyReader calculates the hash of the content while it's being read
+// and replaces the final io.EOF with ErrHashMismatch if the content doesn't
+// match the requested hash
+type verifyReader struct {
+	hr       *hash.Reader
+	rc       io.ReadCloser
+	expected []byte
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.hr.Read(p)
+	if errors.Is(err, io.EOF) && !bytes.Equal(v.hr.Hash(), v.expected) {
+		return n, fmt.Errorf("%w: expected %s, got %s", ErrHashMismatch, hash.Format(v.expected), hash.Format(v.hr.Hash()))
+	}
+	return n, err
+}
+
+func (v *verifyReader) Close() error {
+	return v.rc.Close()
+}
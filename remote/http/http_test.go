@@ -0,0 +1,201 @@
+package http_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alinz/hash.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/internal/tests"
+	"github.com/alinz/storage.go/memory"
+	"github.com/alinz/storage.go/merkle"
+	remote "github.com/alinz/storage.go/remote/http"
+	server "github.com/alinz/storage.go/server/http"
+	"github.com/alinz/storage.go/storagetest"
+)
+
+func TestRemoteStorage(t *testing.T) {
+	backend := memory.New()
+	ts := httptest.NewServer(server.New(backend, backend, backend, backend))
+	defer ts.Close()
+
+	client := remote.New(ts.URL, remote.WithPageSize(2))
+
+	content := []byte("hello world")
+	expectedHash := hash.Bytes(content)
+
+	t.Run("put and get a content", func(t *testing.T) {
+		hashValue, n, err := client.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), n)
+		assert.Equal(t, expectedHash, hash.Value(hashValue))
+
+		rc, err := client.Get(context.Background(), hashValue)
+		assert.NoError(t, err)
+		defer rc.Close()
+		assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
+	})
+
+	t.Run("get a range of the content", func(t *testing.T) {
+		rc, err := client.GetRange(context.Background(), expectedHash, 6, 5)
+		assert.NoError(t, err)
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("world"), b)
+
+		rc, err = client.GetRange(context.Background(), expectedHash, 20, -1)
+		assert.NoError(t, err)
+		b, err = io.ReadAll(rc)
+		rc.Close()
+		assert.NoError(t, err)
+		assert.Empty(t, b)
+	})
+
+	t.Run("list every content across pages", func(t *testing.T) {
+		for _, value := range []string{"a", "b", "c", "d"} {
+			_, _, err := client.Put(context.Background(), strings.NewReader(value))
+			assert.NoError(t, err)
+		}
+
+		next, cancel := client.List()
+		defer cancel()
+
+		count := 0
+		for {
+			_, err := next(context.Background())
+			if errors.Is(err, storage.ErrIteratorDone) {
+				break
+			}
+			assert.NoError(t, err)
+			count++
+		}
+
+		assert.Equal(t, 5, count)
+	})
+
+	t.Run("remove a content", func(t *testing.T) {
+		assert.NoError(t, client.Remove(context.Background(), expectedHash))
+
+		_, err := client.Get(context.Background(), expectedHash)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		assert.ErrorIs(t, client.Remove(context.Background(), expectedHash), storage.ErrNotFound)
+	})
+
+	t.Run("merkle on top of remote storage", func(t *testing.T) {
+		merkleStorage := merkle.New(client, client, client, 4)
+
+		content := []byte("hello world from a remote merkle tree")
+		root, n, err := merkleStorage.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), n)
+
+		rc, err := merkleStorage.Get(context.Background(), root)
+		assert.NoError(t, err)
+		defer rc.Close()
+		assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
+	})
+}
+
+func TestRemoteStorageRetries(t *testing.T) {
+	backend := memory.New()
+	handler := server.New(backend, backend, backend, backend)
+
+	var failures int32 = 2
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	client := remote.New(ts.URL, remote.WithRetries(3, time.Millisecond))
+
+	hashValue, _, err := client.Put(context.Background(), strings.NewReader("retry me"))
+	assert.NoError(t, err)
+
+	atomic.StoreInt32(&failures, 5)
+	_, err = client.Get(context.Background(), hashValue)
+	assert.Error(t, err)
+
+	// streams which can not be rewound are not retried
+	atomic.StoreInt32(&failures, 1)
+	_, _, err = client.Put(context.Background(), io.MultiReader(strings.NewReader("retry me")))
+	assert.Error(t, err)
+}
+
+func TestRemoteStorageErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a malformed request is a bad request too, but not an empty content
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid request","code":"invalid_request"}`))
+	}))
+	defer ts.Close()
+
+	_, _, err := remote.New(ts.URL).Put(context.Background(), strings.NewReader("hello"))
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, storage.ErrEmpty))
+
+	backend := memory.New()
+	ts = httptest.NewServer(server.New(backend, backend, backend, backend))
+	defer ts.Close()
+
+	client := remote.New(ts.URL)
+
+	_, _, err = client.Put(context.Background(), strings.NewReader(""))
+	assert.ErrorIs(t, err, storage.ErrEmpty)
+
+	hashValue := hash.Bytes([]byte("missing"))
+	_, err = client.Get(context.Background(), hashValue)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	var storageErr *storage.Error
+	assert.True(t, errors.As(err, &storageErr))
+	assert.Equal(t, "get", storageErr.Op)
+	assert.Equal(t, []byte(hashValue), storageErr.Hash)
+}
+
+func TestRemoteStorageVerification(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("tampered content"))
+	}))
+	defer ts.Close()
+
+	expectedHash := hash.Bytes([]byte("original content"))
+
+	rc, err := remote.New(ts.URL).Get(context.Background(), expectedHash)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(rc)
+	assert.ErrorIs(t, err, remote.ErrHashMismatch)
+
+	rc, err = remote.New(ts.URL, remote.WithoutVerification()).Get(context.Background(), expectedHash)
+	assert.NoError(t, err)
+	b, err := io.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("tampered content"), b)
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		backend := memory.New()
+		ts := httptest.NewServer(server.New(backend, backend, backend, backend))
+		t.Cleanup(ts.Close)
+
+		return remote.New(ts.URL, remote.WithPageSize(7))
+	})
+}
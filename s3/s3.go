@@ -0,0 +1,597 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"strings"
+	"sync"
+
+	"github.com/alinz/hash.go"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"github.com/alinz/storage.go"
+)
+
+const (
+	// MinPartSize is the smallest part size accepted by S3 for multipart uploads
+	MinPartSize int64 = 5 * 1024 * 1024
+
+	tempPrefix = "tmp/"
+)
+
+// maxCopySize is the largest object a single CopyObject request can handle,
+// bigger objects are copied in parts
+const maxCopySize int64 = 5 * 1024 * 1024 * 1024
+
+// ErrNoSuchBucket is a configuration error, the bucket given to New
+// doesn't exist. It isn't storage.ErrNotFound, the contents aren't missing
+var ErrNoSuchBucket = errors.New("bucket does not exist")
+
+// Storage stores every content as an object named by its hash, e.g.
+// "prefix/sha256-b94d27...". A content which fits in a part is uploaded
+// once under its name, the hash of a larger one is only known once the
+// whole content is read so Put streams it into a temporary object under
+// "prefix/tmp/" and then copies it to its final name
+type Storage struct {
+	client   *awss3.Client
+	bucket   string
+	prefix   string
+	partSize int64
+
+	// parts holds the part buffers of the uploads, partSize each
+	parts sync.Pool
+}
+
+var _ storage.Putter = (*Storage)(nil)
+var _ storage.Getter = (*Storage)(nil)
+var _ storage.Remover = (*Storage)(nil)
+var _ storage.Lister = (*Storage)(nil)
+var _ storage.SeqLister = (*Storage)(nil)
+var _ storage.EntryLister = (*Storage)(nil)
+var _ storage.Stater = (*Storage)(nil)
+var _ storage.Haser = (*Storage)(nil)
+var _ storage.RangeGetter = (*Storage)(nil)
+var _ storage.PageLister = (*Storage)(nil)
+
+type Option func(*Storage)
+
+// WithPrefix stores every object under the given prefix, it makes it
+// possible to share a bucket between multiple stores
+func WithPrefix(prefix string) Option {
+	return func(s *Storage) {
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		s.prefix = prefix
+	}
+}
+
+// WithPartSize sets the size of each part of a multipart upload, content
+// smaller than a part is uploaded with a single request
+func WithPartSize(partSize int64) Option {
+	return func(s *Storage) {
+		if partSize < MinPartSize {
+			partSize = MinPartSize
+		}
+		s.partSize = partSize
+	}
+}
+
+func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	buffer := s.parts.Get().(*[]byte)
+	defer s.parts.Put(buffer)
+
+	n, err := io.ReadFull(r, *buffer)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		hashValue, err := s.putSmall(ctx, (*buffer)[:n])
+		if err != nil {
+			return nil, 0, wrapError("put", hashValue, err)
+		}
+		return hashValue, int64(n), nil
+	} else if err != nil {
+		return nil, 0, wrapError("put", nil, err)
+	}
+
+	hashValue, total, err := s.putLarge(ctx, r, *buffer)
+	if err != nil {
+		return nil, 0, wrapError("put", hashValue, err)
+	}
+
+	return hashValue, total, nil
+}
+
+// putSmall uploads a content which fits in a part under its name
+func (s *Storage) putSmall(ctx context.Context, content []byte) ([]byte, error) {
+	if len(content) == 0 {
+		return nil, storage.ErrEmpty
+	}
+
+	hashValue := []byte(hash.Bytes(content))
+	key := s.key(hashValue)
+
+	exists, err := s.exists(ctx, key)
+	if err != nil {
+		return hashValue, err
+	} else if exists {
+		return hashValue, nil
+	}
+
+	_, err = s.client.PutObject(ctx, &awss3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(content),
+		ContentLength: aws.Int64(int64(len(content))),
+	})
+
+	return hashValue, mapError(err)
+}
+
+// putLarge streams a content larger than a part into a temporary object,
+// buffer holds its first part
+func (s *Storage) putLarge(ctx context.Context, r io.Reader, buffer []byte) ([]byte, int64, error) {
+	tempKey, err := s.tempKey()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the first part was read before the hash reader
+	h := sha256.New()
+	h.Write(buffer)
+
+	n, err := s.upload(ctx, tempKey, io.TeeReader(r, h), buffer)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer s.delete(context.Background(), tempKey)
+
+	hashValue := h.Sum(nil)
+	key := s.key(hashValue)
+
+	exists, err := s.exists(ctx, key)
+	if err != nil {
+		return hashValue, 0, err
+	} else if exists {
+		return hashValue, n, nil
+	}
+
+	if err := s.copy(ctx, tempKey, key, n); err != nil {
+		return hashValue, 0, err
+	}
+
+	return hashValue, n, nil
+}
+
+func (s *Storage) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &awss3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(hashValue)),
+	})
+	if err != nil {
+		return nil, wrapError("get", hashValue, err)
+	}
+
+	return out.Body, nil
+}
+
+func (s *Storage) GetRange(ctx context.Context, hashValue []byte, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, wrapError("get", hashValue, storage.ErrInvalidRange)
+	}
+
+	if length == 0 {
+		exists, err := s.Has(ctx, hashValue)
+		if err != nil {
+			return nil, wrapError("get", hashValue, err)
+		} else if !exists {
+			return nil, wrapError("get", hashValue, storage.ErrNotFound)
+		}
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	rangeHeader := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		rangeHeader = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+
+	out, err := s.client.GetObject(ctx, &awss3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(hashValue)),
+		Range:  aws.String(rangeHeader),
+	})
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange" {
+		// offset is past the end, nothing left to read
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	} else if err != nil {
+		return nil, wrapError("get", hashValue, err)
+	}
+
+	return out.Body, nil
+}
+
+func (s *Storage) Stat(ctx context.Context, hashValue []byte) (storage.Info, error) {
+	out, err := s.client.HeadObject(ctx, &awss3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(hashValue)),
+	})
+	if err != nil {
+		return storage.Info{}, wrapError("stat", hashValue, err)
+	}
+
+	return storage.Info{
+		Size:    aws.ToInt64(out.ContentLength),
+		ModTime: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+func (s *Storage) Has(ctx context.Context, hashValue []byte) (bool, error) {
+	exists, err := s.exists(ctx, s.key(hashValue))
+	return exists, wrapError("has", hashValue, err)
+}
+
+func (s *Storage) Remove(ctx context.Context, hashValue []byte) error {
+	key := s.key(hashValue)
+
+	// DeleteObject succeeds even if the object doesn't exist
+	exists, err := s.exists(ctx, key)
+	if err != nil {
+		return wrapError("remove", hashValue, err)
+	} else if !exists {
+		return wrapError("remove", hashValue, storage.ErrNotFound)
+	}
+
+	return wrapError("remove", hashValue, s.delete(ctx, key))
+}
+
+func (s *Storage) All(ctx context.Context) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		paginator := awss3.NewListObjectsV2Paginator(s.client, &awss3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String(s.prefix),
+		})
+
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				yield(nil, wrapError("list", nil, err))
+				return
+			}
+
+			for _, object := range page.Contents {
+				name := strings.TrimPrefix(aws.ToString(object.Key), s.prefix)
+				if strings.HasPrefix(name, tempPrefix) {
+					continue
+				}
+
+				hashValue, err := hash.ValueFromString(name)
+				if !yield(hashValue, wrapError("list", nil, err)) || err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Storage) Entries(ctx context.Context) iter.Seq2[storage.Entry, error] {
+	return func(yield func(storage.Entry, error) bool) {
+		paginator := awss3.NewListObjectsV2Paginator(s.client, &awss3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String(s.prefix),
+		})
+
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				yield(storage.Entry{}, wrapError("list", nil, err))
+				return
+			}
+
+			for _, object := range page.Contents {
+				name := strings.TrimPrefix(aws.ToString(object.Key), s.prefix)
+				if strings.HasPrefix(name, tempPrefix) {
+					continue
+				}
+
+				hashValue, err := hash.ValueFromString(name)
+				if err != nil {
+					yield(storage.Entry{}, wrapError("list", nil, err))
+					return
+				}
+
+				entry := storage.Entry{
+					Hash:    hashValue,
+					Size:    aws.ToInt64(object.Size),
+					ModTime: aws.ToTime(object.LastModified),
+				}
+				if !yield(entry, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
+	return storage.Pull(s.All(context.Background()))
+}
+
+// ListPage uses StartAfter to resume, s3 lists keys in lexicographic order
+// which is the same order as the bytes of the hash
+func (s *Storage) ListPage(ctx context.Context, opts storage.ListOptions) (*storage.Page, error) {
+	after, err := storage.ParseToken(opts.Token)
+	if err != nil {
+		return nil, wrapError("list", nil, err)
+	}
+
+	pageSize := storage.PageSize(opts.PageSize)
+
+	input := &awss3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		// a non nil prefix is needed, hash.Format returns "nil" for nil values.
+		// It also skips the temporary objects
+		Prefix:  aws.String(s.prefix + hash.Format(append([]byte{}, opts.Prefix...))),
+		MaxKeys: aws.Int32(int32(pageSize + 1)),
+	}
+	if after != nil {
+		input.StartAfter = aws.String(s.prefix + hash.Format(after))
+	}
+
+	hashes := make([][]byte, 0, pageSize+1)
+
+	paginator := awss3.NewListObjectsV2Paginator(s.client, input)
+	for paginator.HasMorePages() && len(hashes) <= pageSize {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, wrapError("list", nil, err)
+		}
+
+		for _, object := range page.Contents {
+			hashValue, err := hash.ValueFromString(strings.TrimPrefix(aws.ToString(object.Key), s.prefix))
+			if err != nil {
+				return nil, wrapError("list", nil, err)
+			}
+
+			hashes = append(hashes, hashValue)
+		}
+	}
+
+	return storage.NewPage(hashes, pageSize), nil
+}
+
+// upload streams a multipart upload into the given key, buffer holds
+// the first part and is reused for the next ones
+func (s *Storage) upload(ctx context.Context, key string, r io.Reader, buffer []byte) (int64, error) {
+	create, err := s.client.CreateMultipartUpload(ctx, &awss3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, mapError(err)
+	}
+
+	total, err := s.uploadParts(ctx, key, create.UploadId, r, buffer, len(buffer))
+	if err != nil {
+		s.client.AbortMultipartUpload(context.Background(), &awss3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: create.UploadId,
+		})
+		return 0, err
+	}
+
+	return total, nil
+}
+
+func (s *Storage) uploadParts(ctx context.Context, key string, uploadID *string, r io.Reader, buffer []byte, n int) (int64, error) {
+	var parts []types.CompletedPart
+	var total int64
+
+	for partNumber := int32(1); n > 0; partNumber++ {
+		out, err := s.client.UploadPart(ctx, &awss3.UploadPartInput{
+			Bucket:        aws.String(s.bucket),
+			Key:           aws.String(key),
+			UploadId:      uploadID,
+			PartNumber:    aws.Int32(partNumber),
+			Body:          bytes.NewReader(buffer[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		})
+		if err != nil {
+			return 0, mapError(err)
+		}
+
+		parts = append(parts, types.CompletedPart{
+			ETag:       out.ETag,
+			PartNumber: aws.Int32(partNumber),
+		})
+		total += int64(n)
+
+		n, err = io.ReadFull(r, buffer)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// the last part, if any, is uploaded in the next iteration
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err := s.client.CompleteMultipartUpload(ctx, &awss3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return 0, mapError(err)
+	}
+
+	return total, nil
+}
+
+// copy moves the uploaded temporary object to its final name, S3 doesn't
+// support renaming objects
+func (s *Storage) copy(ctx context.Context, src string, dst string, size int64) error {
+	source := s.bucket + "/" + src
+
+	if size <= maxCopySize {
+		_, err := s.client.CopyObject(ctx, &awss3.CopyObjectInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(dst),
+			CopySource: aws.String(source),
+		})
+		return mapError(err)
+	}
+
+	create, err := s.client.CreateMultipartUpload(ctx, &awss3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(dst),
+	})
+	if err != nil {
+		return mapError(err)
+	}
+
+	var parts []types.CompletedPart
+	partNumber := int32(1)
+
+	for offset := int64(0); offset < size; offset += maxCopySize {
+		end := offset + maxCopySize - 1
+		if end > size-1 {
+			end = size - 1
+		}
+
+		out, err := s.client.UploadPartCopy(ctx, &awss3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(dst),
+			UploadId:        create.UploadId,
+			PartNumber:      aws.Int32(partNumber),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+		})
+		if err != nil {
+			s.client.AbortMultipartUpload(context.Background(), &awss3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.bucket),
+				Key:      aws.String(dst),
+				UploadId: create.UploadId,
+			})
+			return mapError(err)
+		}
+
+		parts = append(parts, types.CompletedPart{
+			ETag:       out.CopyPartResult.ETag,
+			PartNumber: aws.Int32(partNumber),
+		})
+		partNumber++
+	}
+
+	_, err = s.client.CompleteMultipartUpload(ctx, &awss3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(dst),
+		UploadId:        create.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+
+	return mapError(err)
+}
+
+func (s *Storage) exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.HeadObject(ctx, &awss3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+
+	err = mapError(err)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *Storage) delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &awss3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return mapError(err)
+}
+
+func (s *Storage) key(hashValue []byte) string {
+	return s.prefix + hash.Format(hashValue)
+}
+
+func (s *Storage) tempKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return s.prefix + tempPrefix + hex.EncodeToString(b), nil
+}
+
+func New(client *awss3.Client, bucket string, opts ...Option) *Storage {
+	s := &Storage{
+		client:   client,
+		bucket:   bucket,
+		partSize: MinPartSize,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.parts.New = func() any {
+		buffer := make([]byte, s.partSize)
+		return &buffer
+	}
+
+	return s
+}
+
+// wrapError maps the error of the client and adds the operation and the hash
+func wrapError(op string, hashValue []byte, err error) error {
+	return storage.NewError(op, hashValue, mapError(err))
+}
+
+func mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return storage.ErrNotFound
+	}
+
+	var kind error
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return storage.ErrNotFound
+		case "NoSuchBucket":
+			kind = ErrNoSuchBucket
+		case "EntityTooLarge":
+			kind = storage.ErrTooLarge
+		case "SlowDown", "ServiceUnavailable", "InternalError", "RequestTimeout":
+			kind = storage.ErrUnavailable
+		}
+	}
+
+	if kind != nil {
+		return fmt.Errorf("%w: %w", kind, err)
+	}
+
+	return err
+}
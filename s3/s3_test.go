@@ -0,0 +1,221 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alinz/hash.go"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/internal/tests"
+	"github.com/alinz/storage.go/merkle"
+	"github.com/alinz/storage.go/s3"
+	"github.com/alinz/storage.go/storagetest"
+)
+
+func newClient(t *testing.T, bucket string) *awss3.Client {
+	return newClientWithHandler(t, bucket, func(h http.Handler) http.Handler { return h })
+}
+
+func newClientWithHandler(t *testing.T, bucket string, wrap func(http.Handler) http.Handler) *awss3.Client {
+	backend := s3mem.New()
+	assert.NoError(t, backend.CreateBucket(bucket))
+
+	ts := httptest.NewServer(wrap(gofakes3.New(backend).Server()))
+	t.Cleanup(ts.Close)
+
+	return awss3.New(awss3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(ts.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	})
+}
+
+func count(t *testing.T, lister storage.Lister) int {
+	next, cancel := lister.List()
+	defer cancel()
+
+	n := 0
+	for {
+		_, err := next(context.Background())
+		if errors.Is(err, storage.ErrIteratorDone) {
+			break
+		}
+		assert.NoError(t, err)
+		n++
+	}
+
+	return n
+}
+
+func TestS3Storage(t *testing.T) {
+	client := newClient(t, "blobs")
+	backend := s3.New(client, "blobs", s3.WithPrefix("store"))
+
+	content := []byte("hello world")
+	expectedHash := hash.Bytes(content)
+
+	t.Run("put and get a content", func(t *testing.T) {
+		hashValue, n, err := backend.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), n)
+		assert.Equal(t, expectedHash, hash.Value(hashValue))
+
+		// putting the same content again is a no-op
+		_, _, err = backend.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err)
+
+		rc, err := backend.Get(context.Background(), hashValue)
+		assert.NoError(t, err)
+		defer rc.Close()
+		assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
+
+		assert.Equal(t, 1, count(t, backend))
+	})
+
+	t.Run("put a content bigger than a single part", func(t *testing.T) {
+		content := make([]byte, s3.MinPartSize+1024)
+		for i := range content {
+			content[i] = byte(i % 251)
+		}
+
+		hashValue, n, err := backend.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), n)
+		assert.Equal(t, hash.Bytes(content), hash.Value(hashValue))
+
+		rc, err := backend.Get(context.Background(), hashValue)
+		assert.NoError(t, err)
+		defer rc.Close()
+		assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
+
+		assert.Equal(t, 2, count(t, backend))
+	})
+
+	t.Run("get a range of the content", func(t *testing.T) {
+		rc, err := backend.GetRange(context.Background(), expectedHash, 6, 5)
+		assert.NoError(t, err)
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("world"), b)
+
+		rc, err = backend.GetRange(context.Background(), expectedHash, 20, -1)
+		assert.NoError(t, err)
+		b, err = io.ReadAll(rc)
+		rc.Close()
+		assert.NoError(t, err)
+		assert.Empty(t, b)
+	})
+
+	t.Run("list pages sorted by hash", func(t *testing.T) {
+		page, err := backend.ListPage(context.Background(), storage.ListOptions{PageSize: 1})
+		assert.NoError(t, err)
+		assert.Len(t, page.Hashes, 1)
+		assert.NotEmpty(t, page.Next)
+
+		next, err := backend.ListPage(context.Background(), storage.ListOptions{PageSize: 1, Token: page.Next})
+		assert.NoError(t, err)
+		assert.Len(t, next.Hashes, 1)
+		assert.Empty(t, next.Next)
+		assert.Equal(t, -1, bytes.Compare(page.Hashes[0], next.Hashes[0]))
+
+		page, err = backend.ListPage(context.Background(), storage.ListOptions{Prefix: expectedHash[:2]})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{expectedHash}, page.Hashes)
+	})
+
+	t.Run("prefixes isolate stores in the same bucket", func(t *testing.T) {
+		other := s3.New(client, "blobs", s3.WithPrefix("other"))
+		_, err := other.Get(context.Background(), expectedHash)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+		assert.Equal(t, 0, count(t, other))
+	})
+
+	t.Run("remove a content", func(t *testing.T) {
+		assert.NoError(t, backend.Remove(context.Background(), expectedHash))
+
+		_, err := backend.Get(context.Background(), expectedHash)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		assert.ErrorIs(t, backend.Remove(context.Background(), expectedHash), storage.ErrNotFound)
+	})
+
+	t.Run("merkle on top of s3", func(t *testing.T) {
+		merkleStorage := merkle.New(backend, backend, backend, 4)
+
+		content := "hello world from a merkle tree in s3"
+		root, n, err := merkleStorage.Put(context.Background(), strings.NewReader(content))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), n)
+
+		rc, err := merkleStorage.Get(context.Background(), root)
+		assert.NoError(t, err)
+		defer rc.Close()
+		assert.NoError(t, tests.EqualReaders(strings.NewReader(content), rc))
+	})
+}
+
+func TestS3SmallPut(t *testing.T) {
+	var requests []string
+	client := newClientWithHandler(t, "blobs", func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			request := r.Method + " " + r.URL.Path
+			if r.Header.Get("X-Amz-Copy-Source") != "" {
+				request += " copy"
+			}
+			requests = append(requests, request)
+			h.ServeHTTP(w, r)
+		})
+	})
+	backend := s3.New(client, "blobs")
+
+	hashValue, _, err := backend.Put(context.Background(), strings.NewReader("small content"))
+	assert.NoError(t, err)
+
+	// a HEAD for the dedup and a single upload under the final name
+	assert.Equal(t, []string{
+		"HEAD /blobs/" + hash.Format(hashValue),
+		"PUT /blobs/" + hash.Format(hashValue),
+	}, requests)
+}
+
+func TestS3Errors(t *testing.T) {
+	backend := s3.New(newClient(t, "blobs"), "missing")
+
+	_, _, err := backend.Put(context.Background(), strings.NewReader("hello"))
+	assert.ErrorIs(t, err, s3.ErrNoSuchBucket)
+	assert.False(t, errors.Is(err, storage.ErrNotFound))
+
+	var storageErr *storage.Error
+	assert.True(t, errors.As(err, &storageErr))
+	assert.Equal(t, "put", storageErr.Op)
+
+	backend = s3.New(newClient(t, "blobs"), "blobs")
+
+	hashValue := hash.Bytes([]byte("missing"))
+	_, err = backend.Get(context.Background(), hashValue)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.True(t, errors.As(err, &storageErr))
+	assert.Equal(t, []byte(hashValue), storageErr.Hash)
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		return s3.New(newClient(t, "blobs"), "blobs")
+	}, storagetest.WithLargeSize(1<<20), storagetest.WithSequences(5))
+}
@@ -8,42 +8,64 @@ import (
 	"github.com/alinz/hash.go"
 
 	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/decorator"
 )
 
-// Storage implements Encryption and Decryption of content into the storage
-// it only support storage.Getter and storage.Putter as deletion and listing
-// does not require encryption
+// Storage implements Encryption and Decryption of content into the storage,
+// if it is built with Wrap every other method (Remove, List, Close, ...) is
+// forwarded as deletion and listing do not require encryption
 type Storage struct {
-	putter    storage.Putter
-	getter    storage.Getter
-	secretKey []byte
+	*decorator.Storage
 }
 
-var _ storage.Putter = (*Storage)(nil)
-var _ storage.Getter = (*Storage)(nil)
+// Layer encrypts contents on Put and decrypts them on Get, it
+// can be used in a decorator.Chain
+func Layer(secretKey []byte) decorator.Layer {
+	secretKey = hash.Bytes(secretKey)
 
-func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
-	r, err := crypto.NewChaCha20Stream(r, s.secretKey)
-	if err != nil {
-		return nil, 0, err
-	}
+	return decorator.Layer{
+		Put: func(ctx context.Context, r io.Reader, next storage.Putter) ([]byte, int64, error) {
+			r, err := crypto.NewChaCha20Stream(r, secretKey)
+			if err != nil {
+				return nil, 0, storage.NewError("put", nil, err)
+			}
 
-	return s.putter.Put(ctx, r)
-}
+			return next.Put(ctx, r)
+		},
+		Get: func(ctx context.Context, hash []byte, next storage.Getter) (io.ReadCloser, error) {
+			rc, err := next.Get(ctx, hash)
+			if err != nil {
+				return nil, err
+			}
 
-func (s *Storage) Get(ctx context.Context, hash []byte) (io.ReadCloser, error) {
-	rc, err := s.getter.Get(ctx, hash)
-	if err != nil {
-		return nil, err
-	}
+			plaintext, err := crypto.NewChaCha20Stream(rc, secretKey)
+			if err != nil {
+				rc.Close()
+				return nil, storage.NewError("get", hash, err)
+			}
 
-	return crypto.NewChaCha20Stream(rc, s.secretKey)
+			return plaintext, nil
+		},
+	}
 }
 
+// New encrypts contents put to putter and decrypts contents read from
+// getter, every other method is not supported
 func New(putter storage.Putter, getter storage.Getter, secretKey []byte) *Storage {
+	return Wrap(pair{putter, getter}, secretKey)
+}
+
+// Wrap encrypts and decrypts the contents of next, every other method of
+// next is forwarded
+func Wrap(next any, secretKey []byte) *Storage {
 	return &Storage{
-		putter:    putter,
-		getter:    getter,
-		secretKey: hash.Bytes(secretKey),
+		Storage: decorator.Wrap(next, Layer(secretKey)),
 	}
 }
+
+// pair only exposes Put and Get, so New doesn't serve any other
+// interface putter or getter might implement
+type pair struct {
+	storage.Putter
+	storage.Getter
+}
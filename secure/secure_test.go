@@ -9,6 +9,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/alinz/storage.go"
 	"github.com/alinz/storage.go/memory"
 	"github.com/alinz/storage.go/secure"
 )
@@ -44,3 +45,28 @@ func TestSecureStorage(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotEqual(t, expectedContent, b)
 }
+
+func TestSecureWrap(t *testing.T) {
+	ctx := context.Background()
+
+	memoryStorage := memory.New()
+	secureStorage := secure.Wrap(memoryStorage, []byte("my secret key"))
+
+	hashValue, _, err := secureStorage.Put(ctx, bytes.NewReader([]byte("hello world")))
+	assert.NoError(t, err)
+
+	rc, err := secureStorage.Get(ctx, hashValue)
+	assert.NoError(t, err)
+	plaintext, err := ioutil.ReadAll(rc)
+	rc.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello world"), plaintext)
+
+	// deletion is forwarded to the backend
+	assert.NoError(t, secureStorage.Remove(ctx, hashValue))
+	_, err = memoryStorage.Get(ctx, hashValue)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// New only serves Put and Get
+	assert.ErrorIs(t, secure.New(memoryStorage, memoryStorage, []byte("key")).Remove(ctx, hashValue), storage.ErrNotSupported)
+}
@@ -0,0 +1,204 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/server/grpc/pb"
+)
+
+const (
+	chunkSize     = 32 * 1024
+	listBatchSize = 100
+)
+
+// Server implements pb.StorageServer on top of any storage backend. Any of
+// the given interfaces can be nil, in that case the related rpc returns
+// UNIMPLEMENTED
+type Server struct {
+	pb.UnimplementedStorageServer
+
+	putter  storage.Putter
+	getter  storage.Getter
+	remover storage.Remover
+	lister  storage.Lister
+}
+
+var _ pb.StorageServer = (*Server)(nil)
+
+func (s *Server) Put(stream pb.Storage_PutServer) error {
+	if s.putter == nil {
+		return toStatus(storage.NewError("put", nil, storage.ErrNotSupported))
+	}
+
+	hashValue, n, err := s.putter.Put(stream.Context(), &putReader{stream: stream})
+	if err != nil {
+		return toStatus(err)
+	}
+
+	return stream.SendAndClose(&pb.PutResponse{Hash: hashValue, Size: n})
+}
+
+func (s *Server) Get(req *pb.GetRequest, stream pb.Storage_GetServer) error {
+	if s.getter == nil {
+		return toStatus(storage.NewError("get", nil, storage.ErrNotSupported))
+	}
+
+	rc, err := s.getter.Get(stream.Context(), req.Hash)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer rc.Close()
+
+	buffer := make([]byte, chunkSize)
+	for {
+		n, err := rc.Read(buffer)
+		if n > 0 {
+			if err := stream.Send(&pb.GetResponse{Chunk: buffer[:n]}); err != nil {
+				return err
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return toStatus(err)
+		}
+	}
+}
+
+func (s *Server) Remove(ctx context.Context, req *pb.RemoveRequest) (*pb.RemoveResponse, error) {
+	if s.remover == nil {
+		return nil, toStatus(storage.NewError("remove", nil, storage.ErrNotSupported))
+	}
+
+	if err := s.remover.Remove(ctx, req.Hash); err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &pb.RemoveResponse{}, nil
+}
+
+func (s *Server) List(req *pb.ListRequest, stream pb.Storage_ListServer) error {
+	if s.lister == nil {
+		return toStatus(storage.NewError("list", nil, storage.ErrNotSupported))
+	}
+
+	batch := &pb.ListResponse{}
+	for hashValue, err := range storage.All(stream.Context(), s.lister) {
+		if err != nil {
+			return toStatus(err)
+		}
+
+		batch.Hashes = append(batch.Hashes, hashValue)
+		if len(batch.Hashes) == listBatchSize {
+			if err := stream.Send(batch); err != nil {
+				return err
+			}
+			batch = &pb.ListResponse{}
+		}
+	}
+
+	if len(batch.Hashes) > 0 {
+		return stream.Send(batch)
+	}
+
+	return nil
+}
+
+func New(putter storage.Putter, getter storage.Getter, remover storage.Remover, lister storage.Lister) *Server {
+	return &Server{
+		putter:  putter,
+		getter:  getter,
+		remover: remover,
+		lister:  lister,
+	}
+}
+
+// Domain is the domain of the ErrorInfo detail of every status sent for a
+// storage error, its reason names the sentinel error of the storage package
+// so a client doesn't have to guess it from the status code
+const Domain = "github.com/alinz/storage.go"
+
+const (
+	ReasonEmpty        = "EMPTY"
+	ReasonNotFound     = "NOT_FOUND"
+	ReasonInvalidToken = "INVALID_TOKEN"
+	ReasonInvalidRange = "INVALID_RANGE"
+	ReasonTooLarge     = "TOO_LARGE"
+	ReasonReadOnly     = "READ_ONLY"
+	ReasonNotSupported = "NOT_SUPPORTED"
+	ReasonUnavailable  = "UNAVAILABLE"
+	ReasonClosed       = "CLOSED"
+	ReasonCorrupted    = "CORRUPTED"
+)
+
+// statuses are checked in order, the first sentinel err wraps
+// decides the code and the reason of the status
+var statuses = []struct {
+	err    error
+	code   codes.Code
+	reason string
+}{
+	{storage.ErrNotFound, codes.NotFound, ReasonNotFound},
+	{context.Canceled, codes.Canceled, ""},
+	{context.DeadlineExceeded, codes.DeadlineExceeded, ""},
+	{storage.ErrEmpty, codes.InvalidArgument, ReasonEmpty},
+	{storage.ErrInvalidToken, codes.InvalidArgument, ReasonInvalidToken},
+	{storage.ErrInvalidRange, codes.OutOfRange, ReasonInvalidRange},
+	{storage.ErrTooLarge, codes.ResourceExhausted, ReasonTooLarge},
+	{storage.ErrReadOnly, codes.PermissionDenied, ReasonReadOnly},
+	{storage.ErrNotSupported, codes.Unimplemented, ReasonNotSupported},
+	{storage.ErrUnavailable, codes.Unavailable, ReasonUnavailable},
+	{storage.ErrClosed, codes.Unavailable, ReasonClosed},
+	{storage.ErrCorrupted, codes.DataLoss, ReasonCorrupted},
+}
+
+func toStatus(err error) error {
+	for _, s := range statuses {
+		if !errors.Is(err, s.err) {
+			continue
+		}
+
+		st := status.New(s.code, err.Error())
+		if s.reason == "" {
+			return st.Err()
+		}
+
+		withReason, detailErr := st.WithDetails(&errdetails.ErrorInfo{Reason: s.reason, Domain: Domain})
+		if detailErr != nil {
+			return st.Err()
+		}
+
+		return withReason.Err()
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+// putReader turns the incoming stream of chunks into an io.Reader
+type putReader struct {
+	stream pb.Storage_PutServer
+	chunk  []byte
+}
+
+func (p *putReader) Read(b []byte) (int, error) {
+	for len(p.chunk) == 0 {
+		req, err := p.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		p.chunk = req.Chunk
+	}
+
+	n := copy(b, p.chunk)
+	p.chunk = p.chunk[n:]
+
+	return n, nil
+}
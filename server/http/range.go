@@ -0,0 +1,96 @@
+package http
+
+import (
+	"strconv"
+	"strings"
+)
+
+// byteRange represents a single range of the Range header, start or end
+// can be -1 which means they were not present, e.g. "bytes=10-" or the
+// suffix form "bytes=-10"
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// resolve converts the range into offset and length for the given size,
+// it returns false if the range can not be satisfied
+func (r byteRange) resolve(size int64) (int64, int64, bool) {
+	var start, end int64
+
+	switch {
+	case r.start == -1:
+		// suffix range, last n bytes
+		if r.end == 0 {
+			return 0, 0, false
+		}
+		start = size - r.end
+		if start < 0 {
+			start = 0
+		}
+		end = size - 1
+	case r.end == -1:
+		start = r.start
+		end = size - 1
+	default:
+		start = r.start
+		end = r.end
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+
+	if start >= size || start > end {
+		return 0, 0, false
+	}
+
+	return start, end - start + 1, true
+}
+
+// parseRange only supports a single range, multiple ranges are ignored and
+// the whole content is returned which is allowed by RFC 7233
+func parseRange(header string) (byteRange, bool) {
+	const prefix = "bytes="
+
+	if !strings.HasPrefix(header, prefix) {
+		return byteRange{}, false
+	}
+
+	spec := strings.TrimSpace(strings.TrimPrefix(header, prefix))
+	if strings.Contains(spec, ",") {
+		return byteRange{}, false
+	}
+
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return byteRange{}, false
+	}
+
+	rng := byteRange{start: -1, end: -1}
+
+	if parts[0] != "" {
+		start, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || start < 0 {
+			return byteRange{}, false
+		}
+		rng.start = start
+	}
+
+	if parts[1] != "" {
+		end, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || end < 0 {
+			return byteRange{}, false
+		}
+		rng.end = end
+	}
+
+	if rng.start == -1 && rng.end == -1 {
+		return byteRange{}, false
+	}
+
+	if rng.start != -1 && rng.end != -1 && rng.end < rng.start {
+		return byteRange{}, false
+	}
+
+	return rng, true
+}
@@ -0,0 +1,386 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alinz/hash.go"
+
+	"github.com/alinz/storage.go"
+)
+
+const (
+	blobsPath = "/blobs"
+
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+var (
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	ErrInvalidHash      = errors.New("invalid hash")
+)
+
+type PutResponse struct {
+	Hash hash.Value `json:"hash"`
+	Size int64      `json:"size"`
+}
+
+type ListResponse struct {
+	Hashes []hash.Value `json:"hashes"`
+	Next   string       `json:"next,omitempty"`
+}
+
+// ErrorResponse carries the message of the error and a code naming the
+// sentinel error of the storage package behind it, if any
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+const (
+	CodeEmpty          = "empty"
+	CodeNotFound       = "not_found"
+	CodeInvalidHash    = "invalid_hash"
+	CodeInvalidToken   = "invalid_token"
+	CodeInvalidRange   = "invalid_range"
+	CodeInvalidRequest = "invalid_request"
+	CodeTooLarge       = "too_large"
+	CodeReadOnly       = "read_only"
+	CodeNotSupported   = "not_supported"
+	CodeUnavailable    = "unavailable"
+)
+
+// Server exposes any storage backend over HTTP. Any of the given interfaces
+// can be nil, in that case the related endpoints respond with 405
+//
+//	PUT    /blobs                        stores the body and returns its hash
+//	GET    /blobs?limit=100&token=next   lists hashes sorted by value,
+//	                                     prefix=hex filters them
+//	GET    /blobs/{hash}                 streams the content, supports Range
+//	HEAD   /blobs/{hash}                 checks if the content exists
+//	DELETE /blobs/{hash}                 removes the content
+//
+// Errors are sent as an ErrorResponse, its code tells the errors
+// sharing a status apart
+type Server struct {
+	putter  storage.Putter
+	getter  storage.Getter
+	remover storage.Remover
+	lister  storage.Lister
+}
+
+var _ http.Handler = (*Server)(nil)
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == blobsPath || r.URL.Path == blobsPath+"/" {
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+			s.put(w, r)
+		case http.MethodGet:
+			s.list(w, r)
+		default:
+			writeError(w, ErrMethodNotAllowed)
+		}
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, blobsPath+"/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	hashValue, err := parseHash(strings.TrimPrefix(r.URL.Path, blobsPath+"/"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.get(w, r, hashValue)
+	case http.MethodDelete:
+		s.remove(w, r, hashValue)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request) {
+	if s.putter == nil {
+		writeError(w, ErrMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	hashValue, n, err := s.putter.Put(r.Context(), r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, PutResponse{Hash: hashValue, Size: n})
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, hashValue []byte) {
+	if s.getter == nil {
+		writeError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+
+	if r.Method == http.MethodHead {
+		s.head(w, r, hashValue)
+		return
+	}
+
+	rng, hasRange := parseRange(r.Header.Get("Range"))
+	if hasRange {
+		s.getRange(w, r, hashValue, rng)
+		return
+	}
+
+	rc, err := s.open(ctx, hashValue)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+
+	io.Copy(w, rc)
+}
+
+func (s *Server) head(w http.ResponseWriter, r *http.Request, hashValue []byte) {
+	info, err := storage.Stat(r.Context(), s.getter, hashValue)
+	if err != nil {
+		w.WriteHeader(statusCode(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) getRange(w http.ResponseWriter, r *http.Request, hashValue []byte, rng byteRange) {
+	ctx := r.Context()
+
+	info, err := storage.Stat(ctx, s.getter, hashValue)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	size := info.Size
+
+	start, length, ok := rng.resolve(size)
+	if !ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		writeJSON(w, http.StatusRequestedRangeNotSatisfiable, ErrorResponse{Error: "range not satisfiable"})
+		return
+	}
+
+	rc, err := storage.GetRange(ctx, s.getter, hashValue, start, length)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	w.WriteHeader(http.StatusPartialContent)
+
+	io.Copy(w, rc)
+}
+
+// open gets the content and peeks the first byte. Some getters, e.g. merkle,
+// return a reader right away and report errors on the first Read, peeking
+// lets us respond with a proper status code before writing any headers
+func (s *Server) open(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	rc, err := s.getter.Get(ctx, hashValue)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(rc)
+	_, err = br.Peek(1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		rc.Close()
+		return nil, err
+	}
+
+	return &readCloser{Reader: br, closer: rc}, nil
+}
+
+func (s *Server) remove(w http.ResponseWriter, r *http.Request, hashValue []byte) {
+	if s.remover == nil {
+		writeError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	err := s.remover.Remove(r.Context(), hashValue)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	if s.lister == nil {
+		writeError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+
+	limit := DefaultPageSize
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid limit", Code: CodeInvalidRequest})
+			return
+		}
+		limit = n
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	var prefix []byte
+	if value := query.Get("prefix"); value != "" {
+		var err error
+		prefix, err = hex.DecodeString(value)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid prefix", Code: CodeInvalidRequest})
+			return
+		}
+	}
+
+	page, err := storage.ListPage(r.Context(), s.lister, storage.ListOptions{
+		Prefix:   prefix,
+		PageSize: limit,
+		Token:    query.Get("token"),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := ListResponse{Hashes: make([]hash.Value, 0, len(page.Hashes)), Next: page.Next}
+	for _, hashValue := range page.Hashes {
+		resp.Hashes = append(resp.Hashes, hashValue)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func New(putter storage.Putter, getter storage.Getter, remover storage.Remover, lister storage.Lister) *Server {
+	return &Server{
+		putter:  putter,
+		getter:  getter,
+		remover: remover,
+		lister:  lister,
+	}
+}
+
+func parseHash(value string) ([]byte, error) {
+	hashValue, err := hash.ValueFromString(value)
+	if err != nil || len(hashValue) == 0 {
+		return nil, ErrInvalidHash
+	}
+	return hashValue, nil
+}
+
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidHash), errors.Is(err, storage.ErrInvalidToken), errors.Is(err, storage.ErrEmpty):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, io.EOF):
+		// backends which don't accept empty content
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, storage.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, storage.ErrNotSupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, storage.ErrUnavailable), errors.Is(err, storage.ErrClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, storage.ErrEmpty), errors.Is(err, io.EOF):
+		return CodeEmpty
+	case errors.Is(err, storage.ErrNotFound):
+		return CodeNotFound
+	case errors.Is(err, ErrInvalidHash):
+		return CodeInvalidHash
+	case errors.Is(err, storage.ErrInvalidToken):
+		return CodeInvalidToken
+	case errors.Is(err, storage.ErrInvalidRange):
+		return CodeInvalidRange
+	case errors.Is(err, storage.ErrTooLarge):
+		return CodeTooLarge
+	case errors.Is(err, storage.ErrReadOnly):
+		return CodeReadOnly
+	case errors.Is(err, storage.ErrNotSupported):
+		return CodeNotSupported
+	case errors.Is(err, storage.ErrUnavailable), errors.Is(err, storage.ErrClosed):
+		return CodeUnavailable
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return CodeUnavailable
+	default:
+		return ""
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, statusCode(err), ErrorResponse{Error: err.Error(), Code: errorCode(err)})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+type readCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *readCloser) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,191 @@
+package http_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alinz/hash.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alinz/storage.go/memory"
+	"github.com/alinz/storage.go/merkle"
+	server "github.com/alinz/storage.go/server/http"
+)
+
+func do(t *testing.T, method string, url string, body io.Reader, headers ...string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, body)
+	assert.NoError(t, err)
+
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	return resp, b
+}
+
+func TestServer(t *testing.T) {
+	backend := memory.New()
+	ts := httptest.NewServer(server.New(backend, backend, backend, backend))
+	defer ts.Close()
+
+	content := []byte("hello world")
+	expectedHash := hash.Bytes(content)
+	blobURL := ts.URL + "/blobs/" + hash.Format(expectedHash)
+
+	t.Run("put a content", func(t *testing.T) {
+		resp, body := do(t, http.MethodPut, ts.URL+"/blobs", bytes.NewReader(content))
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var putResp server.PutResponse
+		assert.NoError(t, json.Unmarshal(body, &putResp))
+		assert.Equal(t, expectedHash, putResp.Hash)
+		assert.Equal(t, int64(len(content)), putResp.Size)
+	})
+
+	t.Run("get the content", func(t *testing.T) {
+		resp, body := do(t, http.MethodGet, blobURL, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, content, body)
+	})
+
+	t.Run("get a range of the content", func(t *testing.T) {
+		testCases := []struct {
+			header       string
+			status       int
+			body         []byte
+			contentRange string
+		}{
+			{"bytes=0-4", http.StatusPartialContent, []byte("hello"), "bytes 0-4/11"},
+			{"bytes=6-", http.StatusPartialContent, []byte("world"), "bytes 6-10/11"},
+			{"bytes=-3", http.StatusPartialContent, []byte("rld"), "bytes 8-10/11"},
+			{"bytes=6-100", http.StatusPartialContent, []byte("world"), "bytes 6-10/11"},
+			{"bytes=20-", http.StatusRequestedRangeNotSatisfiable, nil, "bytes */11"},
+			{"bytes=0-1,3-4", http.StatusOK, content, ""},
+		}
+
+		for _, testCase := range testCases {
+			resp, body := do(t, http.MethodGet, blobURL, nil, "Range", testCase.header)
+			assert.Equal(t, testCase.status, resp.StatusCode, testCase.header)
+			assert.Equal(t, testCase.contentRange, resp.Header.Get("Content-Range"), testCase.header)
+			if testCase.body != nil {
+				assert.Equal(t, testCase.body, body, testCase.header)
+			}
+		}
+	})
+
+	t.Run("invalid and unknown hashes", func(t *testing.T) {
+		resp, body := do(t, http.MethodGet, ts.URL+"/blobs/not-a-hash", nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		var errResp server.ErrorResponse
+		assert.NoError(t, json.Unmarshal(body, &errResp))
+		assert.Equal(t, server.CodeInvalidHash, errResp.Code)
+
+		resp, body = do(t, http.MethodGet, ts.URL+"/blobs/"+hash.Format(hash.Bytes([]byte("missing"))), nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.NoError(t, json.Unmarshal(body, &errResp))
+		assert.Equal(t, server.CodeNotFound, errResp.Code)
+	})
+
+	t.Run("list with pagination", func(t *testing.T) {
+		for i := 0; i < 9; i++ {
+			resp, _ := do(t, http.MethodPut, ts.URL+"/blobs", bytes.NewReader([]byte(fmt.Sprintf("content %d", i))))
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		}
+
+		var all []hash.Value
+		url := ts.URL + "/blobs?limit=3"
+		pages := 0
+
+		for {
+			resp, body := do(t, http.MethodGet, url, nil)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			var listResp server.ListResponse
+			assert.NoError(t, json.Unmarshal(body, &listResp))
+			all = append(all, listResp.Hashes...)
+			pages++
+
+			if listResp.Next == "" {
+				break
+			}
+			url = ts.URL + "/blobs?limit=3&token=" + listResp.Next
+		}
+
+		assert.Len(t, all, 10)
+		assert.Equal(t, 4, pages)
+		for i := 1; i < len(all); i++ {
+			assert.True(t, hash.Format(all[i-1]) < hash.Format(all[i]))
+		}
+	})
+
+	t.Run("list with a prefix", func(t *testing.T) {
+		resp, body := do(t, http.MethodGet, ts.URL+"/blobs?prefix="+hex.EncodeToString(expectedHash[:1]), nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var listResp server.ListResponse
+		assert.NoError(t, json.Unmarshal(body, &listResp))
+		assert.Contains(t, listResp.Hashes, expectedHash)
+		for _, hashValue := range listResp.Hashes {
+			assert.Equal(t, expectedHash[0], hashValue[0])
+		}
+
+		resp, _ = do(t, http.MethodGet, ts.URL+"/blobs?token=!", nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("delete the content", func(t *testing.T) {
+		resp, _ := do(t, http.MethodDelete, blobURL, nil)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp, _ = do(t, http.MethodGet, blobURL, nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp, _ = do(t, http.MethodDelete, blobURL, nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestServerWithMerkle(t *testing.T) {
+	backend := memory.New()
+	merkleStorage := merkle.New(backend, backend, backend, 4)
+
+	ts := httptest.NewServer(server.New(merkleStorage, merkleStorage, nil, merkleStorage))
+	defer ts.Close()
+
+	content := []byte("hello world from merkle")
+
+	resp, body := do(t, http.MethodPut, ts.URL+"/blobs", bytes.NewReader(content))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var putResp server.PutResponse
+	assert.NoError(t, json.Unmarshal(body, &putResp))
+	assert.Equal(t, int64(len(content)), putResp.Size)
+
+	resp, body = do(t, http.MethodGet, ts.URL+"/blobs/"+hash.Format(putResp.Hash), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, body)
+
+	resp, body = do(t, http.MethodGet, ts.URL+"/blobs/"+hash.Format(putResp.Hash), nil, "Range", "bytes=6-10")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, []byte("world"), body)
+
+	resp, _ = do(t, http.MethodGet, ts.URL+"/blobs/"+hash.Format(hash.Bytes([]byte("missing"))), nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = do(t, http.MethodDelete, ts.URL+"/blobs/"+hash.Format(putResp.Hash), nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
@@ -0,0 +1,295 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/alinz/storage.go"
+)
+
+var ErrNameExists = errors.New("name is used by another content")
+
+// errNoMetadata is returned by the metadata methods if the file
+// has no metadata tables
+var errNoMetadata = fmt.Errorf("%w: metadata is not enabled, open with WithMetadata", storage.ErrNotSupported)
+
+// WithMetadata creates the tables of the metadata, a file which
+// already has them uses them without this option
+func WithMetadata() Option {
+	return func(o *options) {
+		o.metadata = true
+	}
+}
+
+// Metadata describes a stored content, a sqlite file holding merkle nodes
+// can name its roots and so act as a catalog of its trees
+type Metadata struct {
+	Hash     []byte
+	Name     string
+	MIMEType string
+	Labels   map[string]string
+}
+
+// MetadataOption sets a field of the metadata given to SetMetadata, given
+// to Find it only yields the contents having that field
+type MetadataOption func(*Metadata)
+
+// WithName names a content, a name belongs to a single content
+func WithName(name string) MetadataOption {
+	return func(m *Metadata) {
+		m.Name = name
+	}
+}
+
+func WithMIMEType(mimeType string) MetadataOption {
+	return func(m *Metadata) {
+		m.MIMEType = mimeType
+	}
+}
+
+// WithLabel adds a label, a content has a single value for every key
+func WithLabel(key, value string) MetadataOption {
+	return func(m *Metadata) {
+		m.Labels[key] = value
+	}
+}
+
+func newMetadata(hashValue []byte, opts []MetadataOption) Metadata {
+	m := Metadata{Hash: hashValue, Labels: make(map[string]string)}
+	for _, opt := range opts {
+		opt(&m)
+	}
+	return m
+}
+
+// metadataMigrations bring the metadata schema to its latest version, it
+// is optional so its version is kept in the schemas table rather than in
+// user_version. Released migrations never change
+var metadataMigrations = []func(conn *sqlite.Conn) error{
+	migrateMetadata,
+}
+
+// openMetadata migrates the metadata schema of a file which has it, or
+// creates it if create is set, and reports whether the file has it
+func openMetadata(conn *sqlite.Conn, create bool) (bool, error) {
+	return migrateOptional(conn, "metadata", metadataMigrations, create)
+}
+
+// migrateMetadata adds the tables of the metadata, they are keyed by hash
+// so they don't depend on how blobs stores the contents
+func migrateMetadata(conn *sqlite.Conn) error {
+	return sqlitex.ExecScript(conn, strings.TrimSpace(`
+		CREATE TABLE metadata (
+			hash BLOB PRIMARY KEY,
+			name TEXT UNIQUE,
+			mime_type TEXT NOT NULL DEFAULT ''
+		);
+
+		CREATE TABLE labels (
+			hash BLOB NOT NULL,
+			key TEXT NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (hash, key)
+		);
+
+		CREATE INDEX labels_key_value ON labels (key, value);
+	`))
+}
+
+// SetMetadata replaces the metadata of an existing content
+func (s *Storage) SetMetadata(ctx context.Context, hashValue []byte, opts ...MetadataOption) (err error) {
+	if !s.metadata {
+		return wrapError("set metadata", hashValue, errNoMetadata)
+	}
+
+	m := newMetadata(hashValue, opts)
+
+	conn, closeConn, err := s.conn(ctx)
+	if err != nil {
+		return wrapError("set metadata", hashValue, err)
+	}
+	defer closeConn()
+
+	release, err := transaction(conn)
+	if err != nil {
+		return wrapError("set metadata", hashValue, err)
+	}
+	defer release(&err)
+
+	exists, err := s.hashValueExists(conn, hashValue)
+	if err != nil {
+		return wrapError("set metadata", hashValue, err)
+	} else if !exists {
+		return wrapError("set metadata", hashValue, storage.ErrNotFound)
+	}
+
+	// unnamed contents have a NULL name, UNIQUE ignores them
+	var name any
+	if m.Name != "" {
+		name = m.Name
+	}
+
+	err = sqlitex.Exec(conn, strings.TrimSpace(`
+		INSERT INTO metadata (hash, name, mime_type) VALUES (?, ?, ?)
+		ON CONFLICT (hash) DO UPDATE SET name = excluded.name, mime_type = excluded.mime_type;
+	`), nil, hashValue, name, m.MIMEType)
+	if sqlite.ErrCode(err).ToPrimary() == sqlite.ResultConstraint {
+		return wrapError("set metadata", hashValue, fmt.Errorf("%w: %s", ErrNameExists, m.Name))
+	} else if err != nil {
+		return wrapError("set metadata", hashValue, err)
+	}
+
+	if err := sqlitex.Exec(conn, "DELETE FROM labels WHERE hash = ?;", nil, hashValue); err != nil {
+		return wrapError("set metadata", hashValue, err)
+	}
+
+	for key, value := range m.Labels {
+		err := sqlitex.Exec(conn, "INSERT INTO labels (hash, key, value) VALUES (?, ?, ?);", nil, hashValue, key, value)
+		if err != nil {
+			return wrapError("set metadata", hashValue, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) Metadata(ctx context.Context, hashValue []byte) (Metadata, error) {
+	if !s.metadata {
+		return Metadata{}, wrapError("metadata", hashValue, errNoMetadata)
+	}
+
+	conn, closeConn, err := s.conn(ctx)
+	if err != nil {
+		return Metadata{}, wrapError("metadata", hashValue, err)
+	}
+	defer closeConn()
+
+	m := newMetadata(hashValue, nil)
+	found := false
+
+	err = sqlitex.Exec(conn, "SELECT name, mime_type FROM metadata WHERE hash = ?;", func(stmt *sqlite.Stmt) error {
+		found = true
+		m.Name = stmt.GetText("name")
+		m.MIMEType = stmt.GetText("mime_type")
+		return nil
+	}, hashValue)
+	if err != nil {
+		return Metadata{}, wrapError("metadata", hashValue, err)
+	} else if !found {
+		return Metadata{}, wrapError("metadata", hashValue, storage.ErrNotFound)
+	}
+
+	if err := s.readLabels(conn, &m); err != nil {
+		return Metadata{}, wrapError("metadata", hashValue, err)
+	}
+
+	return m, nil
+}
+
+func (s *Storage) readLabels(conn *sqlite.Conn, m *Metadata) error {
+	return sqlitex.Exec(conn, "SELECT key, value FROM labels WHERE hash = ?;", func(stmt *sqlite.Stmt) error {
+		m.Labels[stmt.GetText("key")] = stmt.GetText("value")
+		return nil
+	}, m.Hash)
+}
+
+func (s *Storage) RemoveMetadata(ctx context.Context, hashValue []byte) error {
+	if !s.metadata {
+		return wrapError("remove metadata", hashValue, errNoMetadata)
+	}
+
+	conn, closeConn, err := s.conn(ctx)
+	if err != nil {
+		return wrapError("remove metadata", hashValue, err)
+	}
+	defer closeConn()
+
+	return s.removeMetadata(conn, hashValue, true)
+}
+
+// removeMetadata reports storage.ErrNotFound if the content has no
+// metadata and mustExist is set, Remove doesn't need it
+func (s *Storage) removeMetadata(conn *sqlite.Conn, hashValue []byte, mustExist bool) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	if err := sqlitex.Exec(conn, "DELETE FROM labels WHERE hash = ?;", nil, hashValue); err != nil {
+		return wrapError("remove metadata", hashValue, err)
+	}
+
+	if err := sqlitex.Exec(conn, "DELETE FROM metadata WHERE hash = ?;", nil, hashValue); err != nil {
+		return wrapError("remove metadata", hashValue, err)
+	}
+
+	if mustExist && conn.Changes() == 0 {
+		return wrapError("remove metadata", hashValue, storage.ErrNotFound)
+	}
+
+	return nil
+}
+
+// Find yields the metadata of every content matching all the options,
+// sorted by hash. Without options it yields every metadata. It holds a
+// connection of the pool until the loop is done
+func (s *Storage) Find(ctx context.Context, opts ...MetadataOption) iter.Seq2[Metadata, error] {
+	filter := newMetadata(nil, opts)
+
+	conditions := []string{"1"}
+	var args []any
+
+	if filter.Name != "" {
+		conditions = append(conditions, "name = ?")
+		args = append(args, filter.Name)
+	}
+
+	if filter.MIMEType != "" {
+		conditions = append(conditions, "mime_type = ?")
+		args = append(args, filter.MIMEType)
+	}
+
+	for key, value := range filter.Labels {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM labels WHERE labels.hash = metadata.hash AND key = ? AND value = ?)")
+		args = append(args, key, value)
+	}
+
+	query := fmt.Sprintf("SELECT hash, name, mime_type FROM metadata WHERE %s ORDER BY hash;", strings.Join(conditions, " AND "))
+
+	return func(yield func(Metadata, error) bool) {
+		if !s.metadata {
+			yield(Metadata{}, wrapError("find", nil, errNoMetadata))
+			return
+		}
+
+		conn, closeConn, err := s.conn(ctx)
+		if err != nil {
+			yield(Metadata{}, wrapError("find", nil, err))
+			return
+		}
+		defer closeConn()
+
+		errStop := errors.New("stop")
+
+		err = sqlitex.Exec(conn, query, func(stmt *sqlite.Stmt) error {
+			m := newMetadata(columnHash(stmt), nil)
+			m.Name = stmt.GetText("name")
+			m.MIMEType = stmt.GetText("mime_type")
+
+			if err := s.readLabels(conn, &m); err != nil {
+				return err
+			}
+
+			if !yield(m, nil) {
+				return errStop
+			}
+			return nil
+		}, args...)
+		if err != nil && !errors.Is(err, errStop) {
+			yield(Metadata{}, wrapError("find", nil, err))
+		}
+	}
+}
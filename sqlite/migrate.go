@@ -0,0 +1,182 @@
+package sqlite
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alinz/hash.go"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"github.com/alinz/storage.go"
+)
+
+// migrations bring the schema from the version kept in user_version to
+// the latest one, migrations[n] moves it from version n to n+1. Released
+// migrations never change, a new schema is a new migration
+var migrations = []func(conn *sqlite.Conn) error{
+	migrateChunks,
+	migrateBinaryHash,
+	migrateSchemas,
+}
+
+// migrate runs the missing migrations in a single transaction, the write
+// lock keeps two processes opening the same file from both running them
+func migrate(conn *sqlite.Conn) (err error) {
+	release, err := immediate(conn)
+	if err != nil {
+		return err
+	}
+	defer release(&err)
+
+	var version int
+	err = sqlitex.ExecTransient(conn, "PRAGMA user_version;", func(stmt *sqlite.Stmt) error {
+		version = stmt.ColumnInt(0)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("%w: schema version %d is newer than %d", storage.ErrNotSupported, version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		if err := migrations[version](conn); err != nil {
+			return fmt.Errorf("migrate to version %d: %w", version+1, err)
+		}
+
+		// pragmas don't take parameters
+		if err := sqlitex.ExecTransient(conn, fmt.Sprintf("PRAGMA user_version = %d;", version+1), nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateChunks creates the first schema, or moves the contents stored
+// inline in blobs.data by older versions into a single chunk
+func migrateChunks(conn *sqlite.Conn) error {
+	return sqlitex.ExecScript(conn, strings.TrimSpace(`
+		CREATE TABLE IF NOT EXISTS blobs (
+			hash_value TEXT,
+			data blob
+		);
+
+		CREATE INDEX IF NOT EXISTS blobs_hash_value ON blobs (hash_value);
+
+		CREATE TABLE IF NOT EXISTS chunks (
+			blob_id INTEGER NOT NULL,
+			seq INTEGER NOT NULL,
+			data BLOB NOT NULL
+		);
+
+		CREATE UNIQUE INDEX IF NOT EXISTS chunks_blob_id_seq ON chunks (blob_id, seq);
+
+		INSERT INTO chunks (blob_id, seq, data)
+		SELECT rowid, 0, data FROM blobs WHERE length(data) > 0;
+
+		DELETE FROM blobs WHERE length(data) = 0;
+
+		UPDATE blobs SET data = NULL WHERE data IS NOT NULL;
+	`))
+}
+
+// migrateBinaryHash keys blobs by the bytes of the hash, a NULL hash is a
+// Put which is still streaming its chunks. Rows of a Put which never
+// finished and duplicated hashes are dropped along with their chunks
+func migrateBinaryHash(conn *sqlite.Conn) error {
+	err := sqlitex.ExecScript(conn, strings.TrimSpace(`
+		CREATE TABLE blobs_binary (
+			id INTEGER PRIMARY KEY,
+			hash BLOB UNIQUE,
+			size INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL DEFAULT 0
+		);
+	`))
+	if err != nil {
+		return err
+	}
+
+	// the creation time of older contents is unknown, the migration time is
+	// the closest to it
+	now := time.Now().Unix()
+
+	query := strings.TrimSpace(`
+		SELECT rowid, hash_value, (SELECT SUM(length(data)) FROM chunks WHERE blob_id = blobs.rowid) AS size
+		FROM blobs WHERE hash_value IS NOT NULL ORDER BY rowid;
+	`)
+	err = sqlitex.Exec(conn, query, func(stmt *sqlite.Stmt) error {
+		hashValue, err := hash.ValueFromString(stmt.GetText("hash_value"))
+		if err != nil {
+			return fmt.Errorf("%w: %w", storage.ErrCorrupted, err)
+		}
+
+		return sqlitex.Exec(conn, "INSERT OR IGNORE INTO blobs_binary (id, hash, size, created_at) VALUES (?, ?, ?, ?);", nil,
+			stmt.GetInt64("rowid"), []byte(hashValue), stmt.GetInt64("size"), now)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sqlitex.ExecScript(conn, strings.TrimSpace(`
+		DROP TABLE blobs;
+
+		ALTER TABLE blobs_binary RENAME TO blobs;
+
+		DELETE FROM chunks WHERE blob_id NOT IN (SELECT id FROM blobs);
+	`))
+}
+
+// migrateSchemas adds the table keeping the versions of the optional
+// schemas, which are only created for the files using them
+func migrateSchemas(conn *sqlite.Conn) error {
+	return sqlitex.ExecScript(conn, strings.TrimSpace(`
+		CREATE TABLE schemas (
+			name TEXT PRIMARY KEY,
+			version INTEGER NOT NULL
+		);
+	`))
+}
+
+// migrateOptional runs the missing migrations of the optional schema name
+// in a single transaction. A file without the schema only gets it if create
+// is set, the result reports whether the file has it
+func migrateOptional(conn *sqlite.Conn, name string, migrations []func(conn *sqlite.Conn) error, create bool) (exists bool, err error) {
+	release, err := immediate(conn)
+	if err != nil {
+		return false, err
+	}
+	defer release(&err)
+
+	version := 0
+	err = sqlitex.Exec(conn, "SELECT version FROM schemas WHERE name = ?;", func(stmt *sqlite.Stmt) error {
+		version = stmt.ColumnInt(0)
+		return nil
+	}, name)
+	if err != nil {
+		return false, err
+	}
+
+	if version == 0 && !create {
+		return false, nil
+	} else if version > len(migrations) {
+		return false, fmt.Errorf("%w: %s schema version %d is newer than %d", storage.ErrNotSupported, name, version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		if err := migrations[version](conn); err != nil {
+			return false, fmt.Errorf("migrate %s to version %d: %w", name, version+1, err)
+		}
+	}
+
+	err = sqlitex.Exec(conn, "INSERT INTO schemas (name, version) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET version = excluded.version;", nil, name, version)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
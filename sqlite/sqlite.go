@@ -3,9 +3,13 @@ package sqlite
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/alinz/hash.go"
 	"zombiezen.com/go/sqlite"
@@ -14,167 +18,491 @@ import (
 	"github.com/alinz/storage.go"
 )
 
+var (
+	errRollback = errors.New("rollback")
+	errTxClosed = fmt.Errorf("%w: transaction is closed", storage.ErrClosed)
+)
+
+// chunkSize is the size of the rows a content is split into, neither
+// Put nor Get holds more than a chunk in memory
+const chunkSize = 1 << 20
+
+// Storage keeps a row in blobs for every content and its bytes in rows of
+// chunks. Each Put has a chunk buffer of its own so Puts can run from
+// many goroutines
 type Storage struct {
-	buffer      *bytes.Buffer
+	buffers     sync.Pool
 	pool        *sqlitex.Pool
 	maxDataSize int64
+	metadata    bool
 }
 
+type options struct {
+	metadata bool
+}
+
+type Option func(*options)
+
 var _ storage.Putter = (*Storage)(nil)
 var _ storage.Getter = (*Storage)(nil)
 var _ storage.Remover = (*Storage)(nil)
 var _ storage.Lister = (*Storage)(nil)
+var _ storage.SeqLister = (*Storage)(nil)
+var _ storage.EntryLister = (*Storage)(nil)
 var _ storage.Closer = (*Storage)(nil)
+var _ storage.Stater = (*Storage)(nil)
+var _ storage.Haser = (*Storage)(nil)
+var _ storage.RangeGetter = (*Storage)(nil)
+var _ storage.BatchPutter = (*Storage)(nil)
+var _ storage.BatchGetter = (*Storage)(nil)
+var _ storage.BatchRemover = (*Storage)(nil)
+var _ storage.Transactioner = (*Storage)(nil)
+var _ storage.PageLister = (*Storage)(nil)
 
 func (s *Storage) hashValueExists(conn *sqlite.Conn, hashValue []byte) (bool, error) {
-	stmt, err := conn.Prepare("SELECT hash_value FROM blobs WHERE hash_value = $hash_value AND length(data) > 0;")
+	stmt, err := conn.Prepare("SELECT id FROM blobs WHERE hash = $hash;")
 	if err != nil {
 		return false, err
 	}
-	defer stmt.Finalize()
+	defer stmt.Reset()
 
-	stmt.SetText("$hash_value", hash.Format(hashValue))
+	stmt.SetBytes("$hash", hashValue)
 
 	return stmt.Step()
 }
 
-func (s *Storage) put(ctx context.Context, conn *sqlite.Conn, r io.Reader) (hashValue []byte, n int64, err error) {
-	defer sqlitex.Save(conn)(&err)
-	defer s.buffer.Reset()
+// put stores a content which fits in a chunk with a single short
+// transaction, larger contents are streamed by putChunks
+func (s *Storage) put(ctx context.Context, conn *sqlite.Conn, r io.Reader) ([]byte, int64, error) {
+	buf := s.buffers.Get().([]byte)
+	defer s.buffers.Put(buf)
 
 	hr := hash.NewReader(r)
-	n, err = io.Copy(s.buffer, hr)
+	read, done, err := s.readChunk(hr, buf, 0)
 	if err != nil {
+		return nil, 0, wrapError("put", nil, err)
+	} else if read == 0 {
+		return nil, 0, wrapError("put", nil, storage.ErrEmpty)
+	}
+
+	if !done {
+		return s.putChunks(ctx, conn, hr, buf, read)
+	}
+
+	hashValue := hr.Hash()
+	if err := s.putChunk(conn, hashValue, buf[:read]); err != nil {
 		return nil, 0, err
 	}
 
-	hashValue = hr.Hash()
+	return hashValue, int64(read), nil
+}
+
+// readChunk fills buf, done reports whether the content ended. n is the
+// size of the content before buf, it is used to enforce maxDataSize
+func (s *Storage) readChunk(r io.Reader, buf []byte, n int64) (read int, done bool, err error) {
+	read, err = io.ReadFull(r, buf)
+	if s.maxDataSize > 0 && n+int64(read) > s.maxDataSize {
+		return 0, false, fmt.Errorf("%w: content is larger than %d bytes", storage.ErrTooLarge, s.maxDataSize)
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return read, true, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	return read, false, nil
+}
+
+// putChunk stores a content of a single chunk, the check and the inserts
+// hold the write lock so the same content is never stored twice
+func (s *Storage) putChunk(conn *sqlite.Conn, hashValue []byte, data []byte) (err error) {
+	release, err := transaction(conn)
+	if err != nil {
+		return wrapError("put", hashValue, err)
+	}
+	defer release(&err)
 
 	exists, err := s.hashValueExists(conn, hashValue)
 	if err != nil {
-		return nil, 0, err
+		return wrapError("put", hashValue, err)
 	} else if exists {
-		// if the hash value already exists, we don't need to do anything
-		return hashValue, n, nil
+		return nil
 	}
 
-	stmt, err := conn.Prepare("INSERT INTO blobs (hash_value, data) VALUES ($hash_value, $data);")
+	err = sqlitex.Exec(conn, "INSERT INTO blobs (hash, size, created_at) VALUES (?, ?, ?);", nil, hashValue, len(data), time.Now().Unix())
 	if err != nil {
-		return nil, 0, err
+		return wrapError("put", hashValue, err)
 	}
-	defer stmt.Finalize()
 
-	stmt.SetZeroBlob("$data", n)
-	stmt.SetText("$hash_value", hash.Format(hashValue))
+	err = sqlitex.Exec(conn, "INSERT INTO chunks (blob_id, seq, data) VALUES (?, 0, ?);", nil, conn.LastInsertRowID(), data)
+	return wrapError("put", hashValue, err)
+}
+
+// putChunks streams a content into chunk rows of a blob row without a
+// hash, such rows are never listed. Every chunk is written by a short
+// transaction of its own, so the write lock is never held while the
+// content is read. The first read bytes of buf are the first chunk. A
+// failed Put removes its rows, the rows of a crashed one are swept by New
+func (s *Storage) putChunks(ctx context.Context, conn *sqlite.Conn, r *hash.Reader, buf []byte, read int) (hashValue []byte, n int64, err error) {
+	if err := sqlitex.Exec(conn, "INSERT INTO blobs (hash) VALUES (NULL);", nil); err != nil {
+		return nil, 0, wrapError("put", nil, err)
+	}
+	id := conn.LastInsertRowID()
+
+	defer func() {
+		if err != nil {
+			s.removeBlob(conn, id)
+		}
+	}()
+
+	done := false
+	for seq := 0; ; seq++ {
+		if read > 0 {
+			err := sqlitex.Exec(conn, "INSERT INTO chunks (blob_id, seq, data) VALUES (?, ?, ?);", nil, id, seq, buf[:read])
+			if err != nil {
+				return nil, 0, wrapError("put", nil, err)
+			}
+			n += int64(read)
+		}
+
+		if done {
+			break
+		}
+
+		read, done, err = s.readChunk(r, buf, n)
+		if err != nil {
+			return nil, 0, wrapError("put", nil, err)
+		}
+
+		// reading may have taken long, a canceled Put stops here
+		if err := ctx.Err(); err != nil {
+			return nil, 0, wrapError("put", nil, err)
+		}
+	}
 
-	if _, err := stmt.Step(); err != nil {
+	hashValue = r.Hash()
+	if err := s.setHash(conn, id, hashValue, n); err != nil {
 		return nil, 0, err
 	}
-	rowid := conn.LastInsertRowID()
 
-	b, err := conn.OpenBlob("", "blobs", "data", rowid, true)
+	return hashValue, n, nil
+}
+
+// setHash makes the blob row id visible under hashValue, the check and
+// the update hold the write lock so the same content is never stored twice
+func (s *Storage) setHash(conn *sqlite.Conn, id int64, hashValue []byte, size int64) (err error) {
+	release, err := transaction(conn)
 	if err != nil {
-		return nil, 0, err
+		return wrapError("put", hashValue, err)
 	}
-	defer b.Close()
+	defer release(&err)
 
-	n, err = io.Copy(b, s.buffer)
+	exists, err := s.hashValueExists(conn, hashValue)
 	if err != nil {
-		return nil, n, err
+		return wrapError("put", hashValue, err)
+	} else if exists {
+		// the content is already stored, the streamed rows are not needed
+		return wrapError("put", hashValue, s.removeBlob(conn, id))
 	}
 
-	return hashValue, n, nil
+	err = sqlitex.Exec(conn, "UPDATE blobs SET hash = ?, size = ?, created_at = ? WHERE id = ?;", nil, hashValue, size, time.Now().Unix(), id)
+	return wrapError("put", hashValue, err)
 }
 
+// removeBlob removes a blob row and its chunks, it runs even if the
+// context of the connection is done so a failed Put leaves nothing behind
+func (s *Storage) removeBlob(conn *sqlite.Conn, id int64) (err error) {
+	done := conn.SetInterrupt(nil)
+	defer conn.SetInterrupt(done)
+
+	defer sqlitex.Save(conn)(&err)
+
+	if err := sqlitex.Exec(conn, "DELETE FROM chunks WHERE blob_id = ?;", nil, id); err != nil {
+		return err
+	}
+
+	return sqlitex.Exec(conn, "DELETE FROM blobs WHERE id = ?;", nil, id)
+}
+
+// sweep removes the rows of Puts which never set their hash, e.g. because
+// the process crashed while a content was streamed
+func sweep(conn *sqlite.Conn) error {
+	return sqlitex.ExecScript(conn, strings.TrimSpace(`
+		DELETE FROM chunks WHERE blob_id IN (SELECT id FROM blobs WHERE hash IS NULL);
+		DELETE FROM blobs WHERE hash IS NULL;
+	`))
+}
+
+// Put holds a connection of the pool while the content is read, see put
+// for when the write lock is taken
 func (s *Storage) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
 	conn, closeConn, err := s.conn(ctx)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapError("put", nil, err)
 	}
 	defer closeConn()
 
 	return s.put(ctx, conn, r)
 }
 
-func (s *Storage) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+// PutBatch stores every content inside a single transaction, a failed
+// content only removes its own rows
+func (s *Storage) PutBatch(ctx context.Context, rs []io.Reader) (results []storage.PutResult, err error) {
+	conn, closeConn, err := s.conn(ctx)
+	if err != nil {
+		return nil, wrapError("put", nil, err)
+	}
+	defer closeConn()
+
+	release, err := immediate(conn)
+	if err != nil {
+		return nil, wrapError("put", nil, err)
+	}
+	defer release(&err)
+
+	results = make([]storage.PutResult, len(rs))
+	for i, r := range rs {
+		if err := ctx.Err(); err != nil {
+			return nil, wrapError("put", nil, err)
+		}
+
+		hashValue, n, err := s.put(ctx, conn, r)
+		results[i] = storage.PutResult{Hash: hashValue, N: n, Err: err}
+	}
+
+	return results, nil
+}
+
+// GetBatch reads every content with a single connection, the contents
+// are copied into memory so the connection can be returned to the pool
+func (s *Storage) GetBatch(ctx context.Context, hashes [][]byte) ([]storage.GetResult, error) {
 	conn, closeConn, err := s.conn(ctx)
+	if err != nil {
+		return nil, wrapError("get", nil, err)
+	}
+	defer closeConn()
+
+	results := make([]storage.GetResult, len(hashes))
+	for i, hashValue := range hashes {
+		if err := ctx.Err(); err != nil {
+			return nil, wrapError("get", nil, err)
+		}
+
+		data, err := s.readAll(conn, hashValue)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		results[i].Reader = io.NopCloser(bytes.NewReader(data))
+	}
+
+	return results, nil
+}
+
+func (s *Storage) readAll(conn *sqlite.Conn, hashValue []byte) ([]byte, error) {
+	r, err := s.openChunks(conn, hashValue, 0)
 	if err != nil {
 		return nil, err
 	}
+	defer r.Close()
 
-	stmt, err := conn.Prepare("SELECT rowid, data FROM blobs WHERE hash_value = $hash_value;")
+	return io.ReadAll(r)
+}
+
+func (s *Storage) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	return s.GetRange(ctx, hashValue, 0, -1)
+}
+
+// GetRange skips the chunks before offset and seeks into the first
+// one, so the bytes before offset are never read
+func (s *Storage) GetRange(ctx context.Context, hashValue []byte, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, wrapError("get", hashValue, storage.ErrInvalidRange)
+	}
+
+	conn, closeConn, err := s.conn(ctx)
+	if err != nil {
+		return nil, wrapError("get", hashValue, err)
+	}
+
+	r, err := s.openChunks(conn, hashValue, offset)
 	if err != nil {
 		closeConn()
 		return nil, err
 	}
+
+	return &customReadCloser{rc: storage.LimitReadCloser(r, length), closeConn: closeConn}, nil
+}
+
+// openChunks finalizes its statement before returning, the connection
+// may go back to the pool as soon as the reader is closed. The reader holds
+// a read transaction until it is closed, so the chunks it found can't be
+// removed or reused by another content while they are read
+func (s *Storage) openChunks(conn *sqlite.Conn, hashValue []byte, offset int64) (_ *chunkReader, err error) {
+	end, err := snapshot(conn)
+	if err != nil {
+		return nil, wrapError("get", hashValue, err)
+	}
+	defer func() {
+		if err != nil {
+			end()
+		}
+	}()
+
+	stmt, err := conn.Prepare(strings.TrimSpace(`
+		SELECT chunks.rowid AS rowid, length(chunks.data) AS size
+		FROM blobs JOIN chunks ON chunks.blob_id = blobs.id
+		WHERE blobs.hash = $hash
+		ORDER BY chunks.seq;
+	`))
+	if err != nil {
+		return nil, wrapError("get", hashValue, err)
+	}
 	defer stmt.Finalize()
 
-	stmt.SetText("$hash_value", hash.Format(hashValue))
+	stmt.SetBytes("$hash", hashValue)
+
+	r := &chunkReader{conn: conn, hashValue: hashValue, end: end}
+	found := false
+	for {
+		rowReturned, err := stmt.Step()
+		if err != nil {
+			return nil, wrapError("get", hashValue, err)
+		}
+
+		if !rowReturned {
+			break
+		}
+		found = true
+
+		size := stmt.GetInt64("size")
+		if offset >= size {
+			offset -= size
+			continue
+		}
+
+		r.chunks = append(r.chunks, stmt.GetInt64("rowid"))
+		if len(r.chunks) == 1 {
+			r.offset = offset
+		}
+	}
+
+	if !found {
+		return nil, wrapError("get", hashValue, storage.ErrNotFound)
+	}
+
+	return r, nil
+}
+
+func (s *Storage) Stat(ctx context.Context, hashValue []byte) (storage.Info, error) {
+	conn, closeConn, err := s.conn(ctx)
+	if err != nil {
+		return storage.Info{}, wrapError("stat", hashValue, err)
+	}
+	defer closeConn()
+
+	stmt, err := conn.Prepare("SELECT size, created_at FROM blobs WHERE hash = $hash;")
+	if err != nil {
+		return storage.Info{}, wrapError("stat", hashValue, err)
+	}
+	defer stmt.Finalize()
+
+	stmt.SetBytes("$hash", hashValue)
 
 	rowReturned, err := stmt.Step()
 	if err != nil {
-		closeConn()
-		return nil, err
+		return storage.Info{}, wrapError("stat", hashValue, err)
 	}
 
 	if !rowReturned {
-		closeConn()
-		return nil, storage.ErrNotFound
+		return storage.Info{}, wrapError("stat", hashValue, storage.ErrNotFound)
 	}
 
-	rowid := stmt.GetInt64("rowid")
+	return storage.Info{Size: stmt.GetInt64("size"), ModTime: time.Unix(stmt.GetInt64("created_at"), 0)}, nil
+}
 
-	b, err := conn.OpenBlob("", "blobs", "data", rowid, false)
-	if err != nil {
-		closeConn()
-		return nil, err
+func (s *Storage) Has(ctx context.Context, hashValue []byte) (bool, error) {
+	_, err := s.Stat(ctx, hashValue)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
 	}
 
-	return &customReadCloser{rc: b, closeConn: closeConn}, nil
+	return true, nil
 }
 
 func (s *Storage) remove(conn *sqlite.Conn, hashValue []byte) (err error) {
 	defer sqlitex.Save(conn)(&err)
 
-	stmt, err := conn.Prepare("DELETE FROM blobs WHERE hash_value = $hash_value;")
+	err = sqlitex.Exec(conn, "DELETE FROM chunks WHERE blob_id IN (SELECT id FROM blobs WHERE hash = ?);", nil, hashValue)
 	if err != nil {
-		return err
+		return wrapError("remove", hashValue, err)
 	}
-	defer stmt.Finalize()
-
-	stmt.SetText("$hash_value", hash.Format(hashValue))
 
-	_, err = stmt.Step()
+	err = sqlitex.Exec(conn, "DELETE FROM blobs WHERE hash = ?;", nil, hashValue)
 	if err != nil {
-		return err
+		return wrapError("remove", hashValue, err)
 	}
 
-	return nil
+	if conn.Changes() == 0 {
+		return wrapError("remove", hashValue, storage.ErrNotFound)
+	}
+
+	if !s.metadata {
+		return nil
+	}
+
+	return s.removeMetadata(conn, hashValue, false)
 }
 
 func (s *Storage) Remove(ctx context.Context, hashValue []byte) error {
 	conn, closeConn, err := s.conn(ctx)
 	if err != nil {
-		return err
+		return wrapError("remove", hashValue, err)
 	}
 	defer closeConn()
 
 	return s.remove(conn, hashValue)
 }
 
-func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
-	mapper := func(yield storage.YieldFunc) {
-		ctx := context.Background()
+// RemoveBatch removes every hash inside a single savepoint
+func (s *Storage) RemoveBatch(ctx context.Context, hashes [][]byte) (errs []error, err error) {
+	conn, closeConn, err := s.conn(ctx)
+	if err != nil {
+		return nil, wrapError("remove", nil, err)
+	}
+	defer closeConn()
+
+	defer sqlitex.Save(conn)(&err)
+
+	errs = make([]error, len(hashes))
+	for i, hashValue := range hashes {
+		if err := ctx.Err(); err != nil {
+			return nil, wrapError("remove", nil, err)
+		}
+
+		errs[i] = s.remove(conn, hashValue)
+	}
+
+	return errs, nil
+}
+
+// All holds a connection of the pool until the loop is done
+func (s *Storage) All(ctx context.Context) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
 		conn, closeConn, err := s.conn(ctx)
 		if err != nil {
-			yield(nil, err)
+			yield(nil, wrapError("list", nil, err))
 			return
 		}
 		defer closeConn()
 
-		stmt, err := conn.Prepare("SELECT hash_value FROM blobs;")
+		stmt, err := conn.Prepare("SELECT hash FROM blobs WHERE hash IS NOT NULL;")
 		if err != nil {
-			yield(nil, err)
+			yield(nil, wrapError("list", nil, err))
 			return
 		}
 		defer stmt.Finalize()
@@ -182,89 +510,464 @@ func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
 		for {
 			rowReturned, err := stmt.Step()
 			if err != nil {
-				yield(nil, err)
+				yield(nil, wrapError("list", nil, err))
 				return
 			}
 
 			if !rowReturned {
-				yield(nil, storage.ErrIteratorDone)
-				break
+				return
 			}
 
-			value := stmt.GetText("hash_value")
-			hashValue, err := hash.ValueFromString(value)
+			if !yield(columnHash(stmt), nil) {
+				return
+			}
+		}
+	}
+}
+
+// Entries reads the size and, if the file has metadata, the MIME type
+// in the same query
+func (s *Storage) Entries(ctx context.Context) iter.Seq2[storage.Entry, error] {
+	query := "SELECT hash, size, created_at, '' AS mime_type FROM blobs WHERE hash IS NOT NULL;"
+	if s.metadata {
+		query = strings.TrimSpace(`
+			SELECT blobs.hash AS hash, size, created_at, mime_type
+			FROM blobs LEFT JOIN metadata ON metadata.hash = blobs.hash
+			WHERE blobs.hash IS NOT NULL;
+		`)
+	}
+
+	return func(yield func(storage.Entry, error) bool) {
+		conn, closeConn, err := s.conn(ctx)
+		if err != nil {
+			yield(storage.Entry{}, wrapError("list", nil, err))
+			return
+		}
+		defer closeConn()
+
+		stmt, err := conn.Prepare(query)
+		if err != nil {
+			yield(storage.Entry{}, wrapError("list", nil, err))
+			return
+		}
+		defer stmt.Finalize()
+
+		for {
+			rowReturned, err := stmt.Step()
 			if err != nil {
-				yield(nil, err)
+				yield(storage.Entry{}, wrapError("list", nil, err))
+				return
+			}
+
+			if !rowReturned {
 				return
 			}
 
-			yield(hashValue, nil)
+			entry := storage.Entry{
+				Hash:     columnHash(stmt),
+				Size:     stmt.GetInt64("size"),
+				MIMEType: stmt.GetText("mime_type"),
+				ModTime:  time.Unix(stmt.GetInt64("created_at"), 0),
+			}
+
+			if !yield(entry, nil) {
+				return
+			}
 		}
 	}
+}
 
-	return storage.Iterator(mapper)
+func (s *Storage) List() (storage.IteratorFunc, storage.CancelFunc) {
+	return storage.Pull(s.All(context.Background()))
 }
 
+// Begin holds a connection of the pool with an open transaction
+// until the transaction is committed or rolled back
+func (s *Storage) Begin(ctx context.Context) (storage.Tx, error) {
+	conn, closeConn, err := s.conn(ctx)
+	if err != nil {
+		return nil, wrapError("begin", nil, err)
+	}
+
+	release, err := immediate(conn)
+	if err != nil {
+		closeConn()
+		return nil, wrapError("begin", nil, err)
+	}
+
+	return &tx{
+		storage:   s,
+		conn:      conn,
+		closeConn: closeConn,
+		release:   release,
+	}, nil
+}
+
+// ListPage uses the unique index of hash, blobs are sorted by their bytes
+// and a prefix is the range of hashes from the prefix to the next prefix
+func (s *Storage) ListPage(ctx context.Context, opts storage.ListOptions) (*storage.Page, error) {
+	after, err := storage.ParseToken(opts.Token)
+	if err != nil {
+		return nil, wrapError("list", nil, err)
+	}
+
+	conn, closeConn, err := s.conn(ctx)
+	if err != nil {
+		return nil, wrapError("list", nil, err)
+	}
+	defer closeConn()
+
+	pageSize := storage.PageSize(opts.PageSize)
+
+	conditions := []string{"hash IS NOT NULL"}
+	args := []any{}
+	if after != nil {
+		conditions = append(conditions, "hash > ?")
+		args = append(args, after)
+	}
+
+	if len(opts.Prefix) > 0 {
+		conditions = append(conditions, "hash >= ?")
+		args = append(args, opts.Prefix)
+
+		if end := prefixEnd(opts.Prefix); end != nil {
+			conditions = append(conditions, "hash < ?")
+			args = append(args, end)
+		}
+	}
+	args = append(args, pageSize+1)
+
+	query := fmt.Sprintf("SELECT hash FROM blobs WHERE %s ORDER BY hash LIMIT ?;", strings.Join(conditions, " AND "))
+
+	hashes := make([][]byte, 0, pageSize+1)
+	err = sqlitex.Exec(conn, query, func(stmt *sqlite.Stmt) error {
+		hashes = append(hashes, columnHash(stmt))
+		return nil
+	}, args...)
+	if err != nil {
+		return nil, wrapError("list", nil, err)
+	}
+
+	return storage.NewPage(hashes, pageSize), nil
+}
+
+// prefixEnd returns the smallest value larger than every value starting
+// with prefix, nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return nil
+}
+
+// columnHash copies the hash column of the current row
+func columnHash(stmt *sqlite.Stmt) []byte {
+	hashValue := make([]byte, stmt.GetLen("hash"))
+	stmt.GetBytes("hash", hashValue)
+	return hashValue
+}
+
+// conn returns a connection of the pool, the pool hands out connections
+// even if ctx is done, they would only fail later with an interrupt
 func (s *Storage) conn(ctx context.Context) (*sqlite.Conn, func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
 	conn := s.pool.Get(ctx)
-	if conn == nil {
-		return nil, nil, context.Canceled
+	if conn == nil && ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	} else if conn == nil {
+		return nil, nil, storage.ErrClosed
 	}
 
 	return conn, func() { s.pool.Put(conn) }, nil
 }
 
-func (s *Storage) createTable() (err error) {
+// snapshot begins a read transaction, the returned function ends it.
+// Inside a transaction conn already reads a stable state, so nothing
+// is begun
+func snapshot(conn *sqlite.Conn) (func(), error) {
+	if !conn.AutocommitEnabled() {
+		return func() {}, nil
+	}
+
+	if err := sqlitex.ExecTransient(conn, "BEGIN;", nil); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if conn.AutocommitEnabled() {
+			return
+		}
+
+		// the connection goes back to the pool, the rollback has to
+		// run even if the context of the connection is done
+		done := conn.SetInterrupt(nil)
+		defer conn.SetInterrupt(done)
+
+		sqlitex.ExecTransient(conn, "ROLLBACK;", nil)
+	}, nil
+}
+
+// transaction begins a transaction, or a savepoint if conn is
+// already inside one
+func transaction(conn *sqlite.Conn) (func(errp *error), error) {
+	if !conn.AutocommitEnabled() {
+		return sqlitex.Save(conn), nil
+	}
+
+	return immediate(conn)
+}
+
+// immediate begins a transaction which takes the write lock up front, a
+// savepoint only takes it on its first write and fails right away with
+// SQLITE_BUSY if another connection wrote since its first read. The
+// returned function commits, or rolls back if *errp is not nil
+func immediate(conn *sqlite.Conn) (func(errp *error), error) {
+	if err := sqlitex.ExecTransient(conn, "BEGIN IMMEDIATE;", nil); err != nil {
+		return nil, err
+	}
 
-	conn, close, err := s.conn(context.Background())
+	return func(errp *error) {
+		// an interrupted statement already rolled back the transaction
+		if conn.AutocommitEnabled() {
+			return
+		}
+
+		if *errp == nil {
+			*errp = wrapError("commit", nil, sqlitex.ExecTransient(conn, "COMMIT;", nil))
+			if *errp == nil || conn.AutocommitEnabled() {
+				return
+			}
+		}
+
+		// the connection goes back to the pool, the rollback has to
+		// run even if the context of the connection is done
+		done := conn.SetInterrupt(nil)
+		defer conn.SetInterrupt(done)
+
+		sqlitex.ExecTransient(conn, "ROLLBACK;", nil)
+	}, nil
+}
+
+func (s *Storage) migrate(o options) error {
+	conn, closeConn, err := s.conn(context.Background())
 	if err != nil {
 		return err
 	}
-	defer close()
+	defer closeConn()
 
-	sql := strings.TrimSpace(`
-		CREATE TABLE IF NOT EXISTS blobs (
-			hash_value TEXT, 
-			data blob
-		);
+	if err := migrate(conn); err != nil {
+		return err
+	}
 
-		CREATE INDEX IF NOT EXISTS blobs_hash_value ON blobs (hash_value);
-	`)
+	if err := sweep(conn); err != nil {
+		return err
+	}
 
-	return sqlitex.ExecScript(conn, sql)
+	s.metadata, err = openMetadata(conn, o.metadata)
+	return err
 }
 
 func (s *Storage) Close() error {
-	return s.pool.Close()
+	return wrapError("close", nil, s.pool.Close())
 }
 
-func New(stringConn string, poolSize int, maxDataSize int64) (*Storage, error) {
+// New opens the database, a Put larger than maxDataSize bytes fails with
+// storage.ErrTooLarge and 0 means no limit. Nodes of merkle are larger than
+// its block size, use merkle.NodeSize(blockSize) for a merkle backend. The
+// rows of unfinished Puts are removed, so a file should not be opened while
+// another process is writing to it
+func New(stringConn string, poolSize int, maxDataSize int64, opts ...Option) (*Storage, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	pool, err := sqlitex.Open(stringConn, 0, poolSize)
 	if err != nil {
-		return nil, err
+		return nil, wrapError("open", nil, err)
 	}
 
 	s := &Storage{
 		pool:        pool,
 		maxDataSize: maxDataSize,
-		buffer:      bytes.NewBuffer(make([]byte, 0, maxDataSize)),
+	}
+	s.buffers.New = func() any {
+		return make([]byte, chunkSize)
 	}
 
-	err = s.createTable()
+	err = s.migrate(o)
 	if err != nil {
-		return nil, err
+		pool.Close()
+		return nil, wrapError("open", nil, err)
 	}
 
 	return s, nil
 }
 
-func NewFile(dbPath string, poolSize int, maxDataSize int64) (*Storage, error) {
+func NewFile(dbPath string, poolSize int, maxDataSize int64, opts ...Option) (*Storage, error) {
 	stringConn := fmt.Sprintf("file:%s", dbPath)
-	return New(stringConn, poolSize, maxDataSize)
+	return New(stringConn, poolSize, maxDataSize, opts...)
+}
+
+func NewMemory(poolSize int, maxDataSize int64, opts ...Option) (*Storage, error) {
+	return New("file::memory:?cache=shared", poolSize, maxDataSize, opts...)
 }
 
-func NewMemory(poolSize int, maxDataSize int64) (*Storage, error) {
-	return New("file::memory:?cache=shared", poolSize, maxDataSize)
+type tx struct {
+	storage   *Storage
+	conn      *sqlite.Conn
+	closeConn func()
+	release   func(*error)
+	done      bool
+}
+
+var _ storage.Tx = (*tx)(nil)
+
+func (t *tx) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	if t.done {
+		return nil, 0, errTxClosed
+	}
+
+	return t.storage.put(ctx, t.conn, r)
+}
+
+// Get reads the whole blob, the connection belongs to
+// the transaction and can not be handed to the reader
+func (t *tx) Get(ctx context.Context, hashValue []byte) (io.ReadCloser, error) {
+	if t.done {
+		return nil, errTxClosed
+	}
+
+	data, err := t.storage.readAll(t.conn, hashValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (t *tx) Commit() error {
+	if t.done {
+		return errTxClosed
+	}
+
+	return t.finish(nil)
+}
+
+func (t *tx) Rollback() error {
+	return t.finish(errRollback)
+}
+
+func (t *tx) finish(reason error) (err error) {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	defer t.closeConn()
+
+	err = reason
+	t.release(&err)
+	if errors.Is(err, errRollback) {
+		return nil
+	} else if reason != nil {
+		return wrapError("rollback", nil, err)
+	}
+
+	return wrapError("commit", nil, err)
+}
+
+// wrapError maps the result codes of sqlite to the errors of the storage
+// package, errors which are already wrapped are returned as they are
+func wrapError(op string, hashValue []byte, err error) error {
+	var storageErr *storage.Error
+	if errors.As(err, &storageErr) {
+		return err
+	}
+
+	var kind error
+
+	switch sqlite.ErrCode(err).ToPrimary() {
+	case sqlite.ResultBusy, sqlite.ResultLocked:
+		kind = storage.ErrUnavailable
+	case sqlite.ResultReadOnly:
+		kind = storage.ErrReadOnly
+	case sqlite.ResultTooBig, sqlite.ResultFull:
+		kind = storage.ErrTooLarge
+	case sqlite.ResultCorrupt, sqlite.ResultNotADB:
+		kind = storage.ErrCorrupted
+	}
+
+	if kind != nil {
+		err = fmt.Errorf("%w: %w", kind, err)
+	}
+
+	return storage.NewError(op, hashValue, err)
+}
+
+// chunkReader reads the chunks of a content one after the other,
+// a single chunk is open at a time. end is called once by Close
+type chunkReader struct {
+	conn      *sqlite.Conn
+	hashValue []byte
+	chunks    []int64
+	offset    int64
+	blob      *sqlite.Blob
+	end       func()
+}
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	for {
+		if c.blob == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			blob, err := c.conn.OpenBlob("", "chunks", "data", c.chunks[0], false)
+			if err != nil {
+				return 0, wrapError("get", c.hashValue, err)
+			}
+			c.blob = blob
+			c.chunks = c.chunks[1:]
+
+			if _, err := blob.Seek(c.offset, io.SeekStart); err != nil {
+				return 0, wrapError("get", c.hashValue, err)
+			}
+			c.offset = 0
+		}
+
+		n, err := c.blob.Read(b)
+		if errors.Is(err, io.EOF) {
+			err = c.blob.Close()
+			c.blob = nil
+		}
+
+		if n > 0 || err != nil {
+			return n, wrapError("get", c.hashValue, err)
+		}
+	}
+}
+
+func (c *chunkReader) Close() error {
+	var err error
+	if c.blob != nil {
+		err = c.blob.Close()
+		c.blob = nil
+	}
+
+	if c.end != nil {
+		c.end()
+		c.end = nil
+	}
+
+	return wrapError("get", c.hashValue, err)
 }
 
 type customReadCloser struct {
@@ -5,14 +5,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/alinz/hash.go"
 	"github.com/stretchr/testify/assert"
+	sqlite3 "zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
 
 	"github.com/alinz/storage.go"
 	"github.com/alinz/storage.go/internal/tests"
+	"github.com/alinz/storage.go/merkle"
 	"github.com/alinz/storage.go/sqlite"
+	"github.com/alinz/storage.go/storagetest"
 )
 
 func TestSqlitePut(t *testing.T) {
@@ -38,6 +45,17 @@ func TestSqlitePut(t *testing.T) {
 	assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
 	rc.Close()
 
+	info, err := backend.Stat(context.TODO(), expectedHashValue)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+
+	exists, err := backend.Has(context.TODO(), expectedHashValue)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	_, err = backend.Stat(context.TODO(), hash.Bytes([]byte("missing")))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
 	next, cancel := backend.List()
 	defer cancel()
 	count := 0
@@ -60,3 +78,498 @@ func TestSqlitePut(t *testing.T) {
 	assert.ErrorIs(t, err, storage.ErrNotFound)
 	assert.Nil(t, rc)
 }
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		db, err := sqlite.NewFile(filepath.Join(t.TempDir(), "sqlite.db"), 10, 8<<20)
+		assert.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+
+		return db
+	})
+}
+
+func TestSqliteMaxDataSize(t *testing.T) {
+	backend, err := sqlite.NewFile(filepath.Join(t.TempDir(), "sqlite.db"), 2, 8)
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	_, _, err = backend.Put(context.TODO(), bytes.NewReader([]byte("more than 8 bytes")))
+	assert.ErrorIs(t, err, storage.ErrTooLarge)
+
+	_, n, err := backend.Put(context.TODO(), bytes.NewReader([]byte("8 bytes!")))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), n)
+
+	hashes, err := storage.ListPage(context.TODO(), backend, storage.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, hashes.Hashes, 1)
+}
+
+func TestSqliteChunks(t *testing.T) {
+	backend, err := sqlite.NewFile(filepath.Join(t.TempDir(), "sqlite.db"), 2, 0)
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	// a few chunks and a half
+	content := make([]byte, 3<<20+1<<19)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	hashValue, n, err := backend.Put(context.TODO(), bytes.NewReader(content))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+
+	info, err := backend.Stat(context.TODO(), hashValue)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+
+	// the range starts in a chunk and ends in the next one
+	offset := int64(1<<20 - 10)
+	rc, err := backend.GetRange(context.TODO(), hashValue, offset, 20)
+	assert.NoError(t, err)
+	assert.NoError(t, tests.EqualReaders(bytes.NewReader(content[offset:offset+20]), rc))
+	rc.Close()
+
+	rc, err = backend.Get(context.TODO(), hashValue)
+	assert.NoError(t, err)
+	assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
+	rc.Close()
+
+	// a failed put leaves none of its chunks behind
+	_, _, err = backend.Put(context.TODO(), io.MultiReader(bytes.NewReader(content), brokenReader{}))
+	assert.Error(t, err)
+
+	entries := 0
+	for entry, err := range backend.Entries(context.TODO()) {
+		assert.NoError(t, err)
+		assert.Equal(t, hash.Format(hashValue), hash.Format(entry.Hash))
+		entries++
+	}
+	assert.Equal(t, 1, entries)
+}
+
+func TestSqlitePutBatchSavepoints(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "sqlite.db")
+	backend, err := sqlite.NewFile(dbPath, 2, 0)
+	assert.NoError(t, err)
+
+	large := bytes.Repeat([]byte("large"), 1<<19)
+
+	results, err := backend.PutBatch(context.TODO(), []io.Reader{
+		bytes.NewReader([]byte("small")),
+		io.MultiReader(bytes.NewReader(large), brokenReader{}),
+		bytes.NewReader(large),
+		bytes.NewReader(large),
+		brokenReader{},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, results[0].Err)
+	assert.Error(t, results[1].Err)
+	assert.NoError(t, results[2].Err)
+	assert.Equal(t, results[2].Hash, results[3].Hash)
+	assert.Error(t, results[4].Err)
+	assert.NoError(t, backend.Close())
+
+	conn, err := sqlite3.OpenConn(dbPath, 0)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// only the rows of the stored contents are left, none without a hash
+	count := func(query string) int {
+		var n int
+		err := sqlitex.Exec(conn, query, func(stmt *sqlite3.Stmt) error {
+			n = stmt.ColumnInt(0)
+			return nil
+		})
+		assert.NoError(t, err)
+		return n
+	}
+	assert.Equal(t, 2, count("SELECT COUNT(*) FROM blobs;"))
+	assert.Equal(t, 0, count("SELECT COUNT(*) FROM blobs WHERE hash IS NULL;"))
+	// small is a chunk, large is two and a half
+	assert.Equal(t, 1+3, count("SELECT COUNT(*) FROM chunks;"))
+}
+
+// brokenReader fails along with its bytes, a (0, err) read would look like
+// the end of the content to hash.Reader
+type brokenReader struct{}
+
+func (brokenReader) Read(b []byte) (int, error) {
+	return copy(b, "tail"), errors.New("broken")
+}
+
+func TestSqliteMigrateInlineData(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "sqlite.db")
+	content := []byte("stored by an older version")
+
+	conn, err := sqlite3.OpenConn(dbPath, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sqlitex.ExecScript(conn, strings.TrimSpace(`
+		CREATE TABLE blobs (hash_value TEXT, data blob);
+		CREATE INDEX blobs_hash_value ON blobs (hash_value);
+	`)))
+	assert.NoError(t, sqlitex.Exec(conn, "INSERT INTO blobs (hash_value, data) VALUES (?, ?);", nil, hash.Format(hash.Bytes(content)), content))
+	assert.NoError(t, conn.Close())
+
+	backend, err := sqlite.NewFile(dbPath, 2, 0)
+	assert.NoError(t, err)
+
+	rc, err := backend.Get(context.TODO(), hash.Bytes(content))
+	assert.NoError(t, err)
+	assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
+	rc.Close()
+
+	info, err := backend.Stat(context.TODO(), hash.Bytes(content))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+	assert.False(t, info.ModTime.IsZero())
+	assert.NoError(t, backend.Close())
+
+	conn, err = sqlite3.OpenConn(dbPath, 0)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, 3, userVersion(t, conn))
+
+	// the hash is unique and kept as bytes
+	err = sqlitex.Exec(conn, "INSERT INTO blobs (hash, size) VALUES (?, 1);", nil, []byte(hash.Bytes(content)))
+	assert.Error(t, err)
+}
+
+func TestSqliteSchemaVersion(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "sqlite.db")
+
+	backend, err := sqlite.NewFile(dbPath, 2, 0)
+	assert.NoError(t, err)
+	_, _, err = backend.Put(context.TODO(), bytes.NewReader([]byte("hello")))
+	assert.NoError(t, err)
+	assert.NoError(t, backend.Close())
+
+	// opening again doesn't migrate again
+	backend, err = sqlite.NewFile(dbPath, 2, 0)
+	assert.NoError(t, err)
+	ok, err := backend.Has(context.TODO(), hash.Bytes([]byte("hello")))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, backend.Close())
+
+	conn, err := sqlite3.OpenConn(dbPath, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, userVersion(t, conn))
+	assert.NoError(t, sqlitex.ExecTransient(conn, "PRAGMA user_version = 99;", nil))
+	assert.NoError(t, conn.Close())
+
+	// a schema written by a newer version is not touched
+	_, err = sqlite.NewFile(dbPath, 2, 0)
+	assert.ErrorIs(t, err, storage.ErrNotSupported)
+}
+
+func userVersion(t *testing.T, conn *sqlite3.Conn) int {
+	var version int
+	err := sqlitex.ExecTransient(conn, "PRAGMA user_version;", func(stmt *sqlite3.Stmt) error {
+		version = stmt.ColumnInt(0)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	return version
+}
+
+func TestSqliteMetadata(t *testing.T) {
+	ctx := context.TODO()
+
+	backend, err := sqlite.NewFile(filepath.Join(t.TempDir(), "sqlite.db"), 2, 0, sqlite.WithMetadata())
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	// the same file holds the trees and names their roots
+	merkleStorage := merkle.New(backend, backend, backend, 16)
+
+	backup, _, err := merkleStorage.Put(ctx, bytes.NewReader([]byte("the content of the backup")))
+	assert.NoError(t, err)
+
+	photo, _, err := backend.Put(ctx, bytes.NewReader([]byte("not really a photo")))
+	assert.NoError(t, err)
+
+	err = backend.SetMetadata(ctx, backup, sqlite.WithName("backup"), sqlite.WithLabel("kind", "backup"), sqlite.WithLabel("host", "alpha"))
+	assert.NoError(t, err)
+
+	err = backend.SetMetadata(ctx, photo, sqlite.WithName("photo.jpg"), sqlite.WithMIMEType("image/jpeg"), sqlite.WithLabel("host", "alpha"))
+	assert.NoError(t, err)
+
+	t.Run("metadata", func(t *testing.T) {
+		m, err := backend.Metadata(ctx, backup)
+		assert.NoError(t, err)
+		assert.Equal(t, "backup", m.Name)
+		assert.Equal(t, map[string]string{"kind": "backup", "host": "alpha"}, m.Labels)
+
+		_, err = backend.Metadata(ctx, hash.Bytes([]byte("missing")))
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("find", func(t *testing.T) {
+		find := func(opts ...sqlite.MetadataOption) []string {
+			var names []string
+			for m, err := range backend.Find(ctx, opts...) {
+				assert.NoError(t, err)
+				names = append(names, m.Name)
+			}
+			return names
+		}
+
+		assert.ElementsMatch(t, []string{"backup", "photo.jpg"}, find(sqlite.WithLabel("host", "alpha")))
+		assert.Equal(t, []string{"backup"}, find(sqlite.WithLabel("host", "alpha"), sqlite.WithLabel("kind", "backup")))
+		assert.Equal(t, []string{"photo.jpg"}, find(sqlite.WithMIMEType("image/jpeg")))
+		assert.Empty(t, find(sqlite.WithLabel("host", "beta")))
+
+		// a root found by its name is read back with merkle
+		for m, err := range backend.Find(ctx, sqlite.WithName("backup")) {
+			assert.NoError(t, err)
+
+			rc, err := merkleStorage.Get(ctx, m.Hash)
+			assert.NoError(t, err)
+			assert.NoError(t, tests.EqualReaders(bytes.NewReader([]byte("the content of the backup")), rc))
+			rc.Close()
+		}
+	})
+
+	t.Run("entries have the mime type", func(t *testing.T) {
+		for entry, err := range backend.Entries(ctx) {
+			assert.NoError(t, err)
+			if bytes.Equal(entry.Hash, photo) {
+				assert.Equal(t, "image/jpeg", entry.MIMEType)
+				assert.Empty(t, entry.Type)
+			}
+		}
+	})
+
+	t.Run("names are unique", func(t *testing.T) {
+		err := backend.SetMetadata(ctx, photo, sqlite.WithName("backup"))
+		assert.ErrorIs(t, err, sqlite.ErrNameExists)
+
+		// the failed set keeps the previous metadata
+		m, err := backend.Metadata(ctx, photo)
+		assert.NoError(t, err)
+		assert.Equal(t, "photo.jpg", m.Name)
+	})
+
+	t.Run("missing content", func(t *testing.T) {
+		err := backend.SetMetadata(ctx, hash.Bytes([]byte("missing")), sqlite.WithName("missing"))
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		assert.NoError(t, backend.Remove(ctx, photo))
+
+		_, err := backend.Metadata(ctx, photo)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		assert.NoError(t, backend.RemoveMetadata(ctx, backup))
+		assert.ErrorIs(t, backend.RemoveMetadata(ctx, backup), storage.ErrNotFound)
+
+		ok, err := backend.Has(ctx, backup)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+}
+
+func TestSqliteWithoutMetadata(t *testing.T) {
+	ctx := context.TODO()
+	dbPath := filepath.Join(t.TempDir(), "sqlite.db")
+
+	backend, err := sqlite.NewFile(dbPath, 2, 0)
+	assert.NoError(t, err)
+
+	hashValue, _, err := backend.Put(ctx, bytes.NewReader([]byte("hello")))
+	assert.NoError(t, err)
+
+	err = backend.SetMetadata(ctx, hashValue, sqlite.WithName("hello"))
+	assert.ErrorIs(t, err, storage.ErrNotSupported)
+
+	for _, err := range backend.Find(ctx) {
+		assert.ErrorIs(t, err, storage.ErrNotSupported)
+	}
+
+	for entry, err := range backend.Entries(ctx) {
+		assert.NoError(t, err)
+		assert.Empty(t, entry.MIMEType)
+	}
+	assert.NoError(t, backend.Close())
+
+	conn, err := sqlite3.OpenConn(dbPath, 0)
+	assert.NoError(t, err)
+	tables := 0
+	err = sqlitex.Exec(conn, "SELECT 1 FROM sqlite_master WHERE name IN ('metadata', 'labels');", func(stmt *sqlite3.Stmt) error {
+		tables++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, tables)
+	assert.NoError(t, conn.Close())
+
+	backend, err = sqlite.NewFile(dbPath, 2, 0, sqlite.WithMetadata())
+	assert.NoError(t, err)
+	assert.NoError(t, backend.SetMetadata(ctx, hashValue, sqlite.WithName("hello"), sqlite.WithMIMEType("text/plain")))
+	assert.NoError(t, backend.Close())
+
+	// a file which has metadata keeps using it, removing a content removes its metadata
+	backend, err = sqlite.NewFile(dbPath, 2, 0)
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	m, err := backend.Metadata(ctx, hashValue)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", m.MIMEType)
+
+	assert.NoError(t, backend.Remove(ctx, hashValue))
+	_, err = backend.Metadata(ctx, hashValue)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestSqliteStreamingPut(t *testing.T) {
+	ctx := context.TODO()
+	dbPath := filepath.Join(t.TempDir(), "sqlite.db")
+
+	backend, err := sqlite.NewFile(dbPath, 4, 0)
+	assert.NoError(t, err)
+
+	// a Put which stalls after its first chunk doesn't hold the write lock
+	pr, pw := io.Pipe()
+	putCtx, cancel := context.WithCancel(ctx)
+	stalled := make(chan error, 1)
+	go func() {
+		_, _, err := backend.Put(putCtx, pr)
+		stalled <- err
+	}()
+	_, err = pw.Write(make([]byte, 1<<20+1))
+	assert.NoError(t, err)
+
+	_, _, err = backend.Put(ctx, bytes.NewReader([]byte("not blocked")))
+	assert.NoError(t, err)
+
+	// the canceled Put stops before its next chunk and removes its rows
+	cancel()
+	pw.Write([]byte("last"))
+	pw.Close()
+	assert.ErrorIs(t, <-stalled, context.Canceled)
+	assert.NoError(t, backend.Close())
+
+	conn, err := sqlite3.OpenConn(dbPath, 0)
+	assert.NoError(t, err)
+	count := func(query string) int {
+		var n int
+		err := sqlitex.Exec(conn, query, func(stmt *sqlite3.Stmt) error {
+			n = stmt.ColumnInt(0)
+			return nil
+		})
+		assert.NoError(t, err)
+		return n
+	}
+	assert.Equal(t, 1, count("SELECT COUNT(*) FROM blobs;"))
+
+	// rows of a crashed Put are swept on open
+	assert.NoError(t, sqlitex.Exec(conn, "INSERT INTO blobs (id, hash) VALUES (100, NULL);", nil))
+	assert.NoError(t, sqlitex.Exec(conn, "INSERT INTO chunks (blob_id, seq, data) VALUES (100, 0, x'00');", nil))
+	assert.NoError(t, conn.Close())
+
+	backend, err = sqlite.NewFile(dbPath, 2, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, backend.Close())
+
+	conn, err = sqlite3.OpenConn(dbPath, 0)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, 0, count("SELECT COUNT(*) FROM blobs WHERE hash IS NULL;"))
+	assert.Equal(t, 0, count("SELECT COUNT(*) FROM chunks WHERE blob_id = 100;"))
+}
+
+func TestSqliteReaderSnapshot(t *testing.T) {
+	ctx := context.TODO()
+
+	backend, err := sqlite.NewFile(filepath.Join(t.TempDir(), "sqlite.db"), 4, 0)
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	first := bytes.Repeat([]byte("a"), 2<<20+10)
+	second := bytes.Repeat([]byte("b"), 2<<20+10)
+
+	hashValue, _, err := backend.Put(ctx, bytes.NewReader(first))
+	assert.NoError(t, err)
+
+	rc, err := backend.Get(ctx, hashValue)
+	assert.NoError(t, err)
+	defer rc.Close()
+
+	head := make([]byte, 10)
+	_, err = io.ReadFull(rc, head)
+	assert.NoError(t, err)
+
+	// the rows of the removed content may be reused by the next Put, the
+	// open reader still reads the content it was opened for
+	assert.NoError(t, backend.Remove(ctx, hashValue))
+	_, _, err = backend.Put(ctx, bytes.NewReader(second))
+	assert.NoError(t, err)
+
+	rest, err := io.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(first, append(head, rest...)))
+}
+
+// cancelingReader cancels its context once its content is read, so
+// the statements storing the content are interrupted
+type cancelingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c cancelingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if errors.Is(err, io.EOF) {
+		c.cancel()
+	}
+	return n, err
+}
+
+func TestSqliteFailedPutResult(t *testing.T) {
+	backend, err := sqlite.NewFile(filepath.Join(t.TempDir(), "sqlite.db"), 2, 0)
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	hashValue, n, err := backend.Put(ctx, cancelingReader{r: strings.NewReader("hello"), cancel: cancel})
+	assert.Error(t, err)
+	assert.Nil(t, hashValue)
+	assert.Equal(t, int64(0), n)
+
+	ok, err := backend.Has(context.TODO(), hash.Bytes([]byte("hello")))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestSqliteMetadataSchemaVersion(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "sqlite.db")
+
+	backend, err := sqlite.NewFile(dbPath, 2, 0, sqlite.WithMetadata())
+	assert.NoError(t, err)
+	assert.NoError(t, backend.Close())
+
+	conn, err := sqlite3.OpenConn(dbPath, 0)
+	assert.NoError(t, err)
+
+	version := 0
+	err = sqlitex.Exec(conn, "SELECT version FROM schemas WHERE name = 'metadata';", func(stmt *sqlite3.Stmt) error {
+		version = stmt.ColumnInt(0)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+
+	assert.NoError(t, sqlitex.Exec(conn, "UPDATE schemas SET version = 99 WHERE name = 'metadata';", nil))
+	assert.NoError(t, conn.Close())
+
+	// a metadata schema written by a newer version is not touched
+	_, err = sqlite.NewFile(dbPath, 2, 0)
+	assert.ErrorIs(t, err, storage.ErrNotSupported)
+}
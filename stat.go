@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Stat returns the Info of the given hash, it uses Stater if getter
+// implements it, otherwise the content is read once to find out its size
+func Stat(ctx context.Context, getter Getter, hash []byte) (Info, error) {
+	if stater, ok := As[Stater](getter); ok {
+		return stater.Stat(ctx, hash)
+	}
+
+	rc, err := getter.Get(ctx, hash)
+	if err != nil {
+		return Info{}, err
+	}
+	defer rc.Close()
+
+	n, err := io.Copy(io.Discard, rc)
+	if err != nil {
+		return Info{}, err
+	}
+
+	return Info{Size: n}, nil
+}
+
+// Has reports whether the given hash exists, it uses Haser or Stater if
+// getter implements them, otherwise it falls back to Get
+func Has(ctx context.Context, getter Getter, hash []byte) (bool, error) {
+	if haser, ok := As[Haser](getter); ok {
+		return haser.Has(ctx, hash)
+	}
+
+	var err error
+
+	if stater, ok := As[Stater](getter); ok {
+		_, err = stater.Stat(ctx, hash)
+	} else {
+		var rc io.ReadCloser
+		rc, err = getter.Get(ctx, hash)
+		if err == nil {
+			rc.Close()
+		}
+	}
+
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
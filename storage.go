@@ -4,10 +4,26 @@ import (
 	"context"
 	"errors"
 	"io"
+	"iter"
+	"time"
 )
 
 var (
-	ErrNotFound = errors.New("not found")
+	ErrNotFound     = errors.New("not found")
+	ErrInvalidRange = errors.New("invalid range")
+	ErrInvalidToken = errors.New("invalid token")
+	ErrNotSupported = errors.New("not supported")
+	// ErrCorrupted is returned if a stored content or the backend
+	// itself can't be read back as it was written
+	ErrCorrupted = errors.New("corrupted")
+	ErrClosed    = errors.New("storage is closed")
+	ErrReadOnly  = errors.New("storage is read-only")
+	ErrTooLarge  = errors.New("content is too large")
+	// ErrEmpty is returned by Put if the reader has no content
+	ErrEmpty = errors.New("empty content")
+	// ErrUnavailable is returned if the backend is busy, locked or can't be
+	// reached for now, it is the only error worth retrying
+	ErrUnavailable = errors.New("storage is unavailable")
 )
 
 type Putter interface {
@@ -18,6 +34,12 @@ type Getter interface {
 	Get(ctx context.Context, hash []byte) (io.ReadCloser, error)
 }
 
+// RangeGetter returns length bytes of the content starting at offset,
+// a negative length reads until the end of the content
+type RangeGetter interface {
+	GetRange(ctx context.Context, hash []byte, offset int64, length int64) (io.ReadCloser, error)
+}
+
 type Remover interface {
 	Remove(ctx context.Context, hash []byte) error
 }
@@ -26,6 +48,145 @@ type Lister interface {
 	List() (IteratorFunc, CancelFunc)
 }
 
+// SeqLister lists hashes with a range-over-func iterator, breaking
+// out of the loop releases everything held by the listing
+type SeqLister interface {
+	All(ctx context.Context) iter.Seq2[[]byte, error]
+}
+
+// Entry describes a listed content, Size is -1 and ModTime is zero if the
+// backend doesn't know them. Type is only set by layers which understand
+// the content, e.g. merkle sets the node type. MIMEType is only set by
+// backends which keep it, e.g. sqlite with metadata
+type Entry struct {
+	Hash     []byte
+	Size     int64
+	Type     string
+	MIMEType string
+	ModTime  time.Time
+}
+
+// EntryLister lists every content along with what the backend
+// knows about it without reading the content
+type EntryLister interface {
+	Entries(ctx context.Context) iter.Seq2[Entry, error]
+}
+
+// ListOptions selects a page of hashes, Token is the Next value
+// of the previous page and is empty for the first page
+type ListOptions struct {
+	Prefix   []byte
+	PageSize int
+	Token    string
+}
+
+// Page holds hashes sorted by their bytes, Next is
+// empty if there are no more pages
+type Page struct {
+	Hashes [][]byte
+	Next   string
+}
+
+type PageLister interface {
+	ListPage(ctx context.Context, opts ListOptions) (*Page, error)
+}
+
+// Info describes a stored content, ModTime is zero if
+// the backend doesn't keep track of it
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+type Stater interface {
+	Stat(ctx context.Context, hash []byte) (Info, error)
+}
+
+type Haser interface {
+	Has(ctx context.Context, hash []byte) (bool, error)
+}
+
+// PutResult is the outcome of a single content in a batch, if Err is not
+// nil the content was not stored
+type PutResult struct {
+	Hash []byte
+	N    int64
+	Err  error
+}
+
+// GetResult is the outcome of a single hash in a batch, Reader is
+// nil if Err is not nil
+type GetResult struct {
+	Reader io.ReadCloser
+	Err    error
+}
+
+// BatchPutter stores many contents at once, usually in a single transaction.
+// The returned error is only for failures of the whole batch, errors of each
+// content are reported in its PutResult
+type BatchPutter interface {
+	PutBatch(ctx context.Context, rs []io.Reader) ([]PutResult, error)
+}
+
+type BatchGetter interface {
+	GetBatch(ctx context.Context, hashes [][]byte) ([]GetResult, error)
+}
+
+type BatchRemover interface {
+	RemoveBatch(ctx context.Context, hashes [][]byte) ([]error, error)
+}
+
+type Op int
+
+const (
+	OpPut Op = iota + 1
+	OpRemove
+	// OpRoot is emitted by layers which build a content out of many
+	// stored contents (e.g. merkle) once the whole content is stored
+	OpRoot
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpPut:
+		return "put"
+	case OpRemove:
+		return "remove"
+	case OpRoot:
+		return "root"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change of a store, Size is the size of the
+// content and is zero for OpRemove
+type Event struct {
+	Hash []byte
+	Op   Op
+	Size int64
+}
+
+// Watcher yields the changes made after Watch is called, the
+// loop ends once ctx is done
+type Watcher interface {
+	Watch(ctx context.Context) iter.Seq2[Event, error]
+}
+
+// Tx is a write session, contents put through it are only visible to
+// the session until Commit. Rollback after Commit does nothing, so it
+// can always be deferred. A Tx is not safe for concurrent use
+type Tx interface {
+	Putter
+	Getter
+	Commit() error
+	Rollback() error
+}
+
+type Transactioner interface {
+	Begin(ctx context.Context) (Tx, error)
+}
+
 type Closer interface {
 	Close() error
 }
@@ -0,0 +1,344 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alinz/hash.go"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/memory"
+)
+
+// contentsPerGoroutine is the size of the content pool of a goroutine,
+// it is small so gets and removes often find what was put before
+const contentsPerGoroutine = 6
+
+type opKind int
+
+const (
+	opPut opKind = iota
+	opGet
+	opRemove
+	opList
+)
+
+type op struct {
+	kind    opKind
+	content int
+}
+
+func (o op) String() string {
+	switch o.kind {
+	case opPut:
+		return fmt.Sprintf("put %d", o.content)
+	case opGet:
+		return fmt.Sprintf("get %d", o.content)
+	case opRemove:
+		return fmt.Sprintf("remove %d", o.content)
+	default:
+		return "list"
+	}
+}
+
+// sequence is what every goroutine does, contents and ops are indexed by
+// goroutine. Each goroutine has contents of its own so its steps can be
+// checked against a model of its own whatever the interleaving is
+type sequence struct {
+	contents [][][]byte
+	ops      [][]op
+}
+
+func newSequence(rng *rand.Rand, goroutines int, steps int) sequence {
+	var s sequence
+
+	for g := 0; g < goroutines; g++ {
+		contents := make([][]byte, contentsPerGoroutine)
+		for i := range contents {
+			content := []byte(fmt.Sprintf("goroutine %d content %d:", g, i))
+			for j := rng.IntN(4096); j > 0; j-- {
+				content = append(content, byte(rng.Uint32()))
+			}
+			contents[i] = content
+		}
+
+		ops := make([]op, steps)
+		for i := range ops {
+			// puts are the most common so the backend is rarely empty
+			kind := opPut
+			switch n := rng.IntN(10); {
+			case n >= 9:
+				kind = opList
+			case n >= 7:
+				kind = opRemove
+			case n >= 4:
+				kind = opGet
+			}
+
+			ops[i] = op{kind: kind, content: rng.IntN(contentsPerGoroutine)}
+		}
+
+		s.contents = append(s.contents, contents)
+		s.ops = append(s.ops, ops)
+	}
+
+	return s
+}
+
+func (s sequence) len() int {
+	n := 0
+	for _, ops := range s.ops {
+		n += len(ops)
+	}
+	return n
+}
+
+// without returns a copy of s without n ops of goroutine g from i
+func (s sequence) without(g, i, n int) sequence {
+	ops := make([][]op, len(s.ops))
+	copy(ops, s.ops)
+
+	end := min(i+n, len(ops[g]))
+	ops[g] = append(append([]op{}, ops[g][:i]...), ops[g][end:]...)
+
+	return sequence{contents: s.contents, ops: ops}
+}
+
+func (s sequence) String() string {
+	var sb strings.Builder
+	for g, ops := range s.ops {
+		if len(ops) == 0 {
+			continue
+		}
+
+		steps := make([]string, len(ops))
+		for i, op := range ops {
+			steps[i] = op.String()
+		}
+		fmt.Fprintf(&sb, "\n  goroutine %d: %s", g, strings.Join(steps, ", "))
+	}
+	return sb.String()
+}
+
+// run runs s against a new backend and returns the first difference
+// with the model
+func (s sequence) run(t *testing.T, newBackend NewBackend) error {
+	ctx := context.Background()
+	backend := newBackend(t)
+
+	models := make([]*memory.Storage, len(s.ops))
+	errs := make([]error, len(s.ops))
+
+	var wg sync.WaitGroup
+	for g := range s.ops {
+		models[g] = memory.New()
+
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			errs[g] = s.runGoroutine(ctx, backend, models[g], g)
+		}(g)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	// once every goroutine is done the backend holds what all the models hold
+	var expected [][]byte
+	for _, model := range models {
+		hashes, err := list(ctx, model)
+		if err != nil {
+			return err
+		}
+		expected = append(expected, hashes...)
+	}
+
+	hashes, err := list(ctx, backend)
+	if err != nil {
+		return fmt.Errorf("list at the end: %w", err)
+	}
+
+	if got, want := formatHashes(hashes), formatHashes(expected); got != want {
+		return fmt.Errorf("list at the end: backend listed [%s], model listed [%s]", got, want)
+	}
+
+	return nil
+}
+
+func (s sequence) runGoroutine(ctx context.Context, backend Backend, model *memory.Storage, g int) error {
+	// hashes of the contents of g, listings only compare them as
+	// other goroutines change the rest of the backend
+	owned := make(map[string]bool)
+	for _, content := range s.contents[g] {
+		owned[hash.Format(hash.Bytes(content))] = true
+	}
+
+	for i, op := range s.ops[g] {
+		got, want := apply(ctx, backend, op, s.contents[g], owned), apply(ctx, model, op, s.contents[g], owned)
+		if got != want {
+			return fmt.Errorf("goroutine %d step %d %s: backend returned %s, model returned %s", g, i, op, got, want)
+		}
+	}
+
+	return nil
+}
+
+// apply runs op and describes its outcome, the backend and the model
+// agree if they describe it the same way
+func apply(ctx context.Context, backend Backend, op op, contents [][]byte, owned map[string]bool) string {
+	switch op.kind {
+	case opPut:
+		hashValue, n, err := backend.Put(ctx, bytes.NewReader(contents[op.content]))
+		if err != nil {
+			return outcome(err)
+		}
+		return fmt.Sprintf("%s %d bytes", hash.Format(hashValue), n)
+
+	case opGet:
+		rc, err := backend.Get(ctx, hash.Bytes(contents[op.content]))
+		if err != nil {
+			return outcome(err)
+		}
+		defer rc.Close()
+
+		content, err := io.ReadAll(rc)
+		if err != nil {
+			return outcome(err)
+		} else if !bytes.Equal(content, contents[op.content]) {
+			return fmt.Sprintf("%d bytes which don't match the content", len(content))
+		}
+		return fmt.Sprintf("%d bytes", len(content))
+
+	case opRemove:
+		return outcome(backend.Remove(ctx, hash.Bytes(contents[op.content])))
+
+	default:
+		hashes, err := list(ctx, backend)
+		if err != nil {
+			return outcome(err)
+		}
+
+		var listed [][]byte
+		for _, hashValue := range hashes {
+			if owned[hash.Format(hashValue)] {
+				listed = append(listed, hashValue)
+			}
+		}
+		return fmt.Sprintf("[%s]", formatHashes(listed))
+	}
+}
+
+// outcome hides the messages of the sentinel errors, they differ
+// from one backend to another
+func outcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, storage.ErrNotFound):
+		return "not found"
+	default:
+		return fmt.Sprintf("error %q", err)
+	}
+}
+
+func formatHashes(hashes [][]byte) string {
+	formatted := make([]string, len(hashes))
+	for i, hashValue := range hashes {
+		formatted[i] = hash.Format(hashValue)
+	}
+	sort.Strings(formatted)
+
+	return strings.Join(formatted, " ")
+}
+
+// shrink removes ops from s as long as it still fails, first in large
+// chunks then one by one until no single op can be removed
+func shrink(s sequence, fails func(sequence) bool) sequence {
+	chunk := max(s.len()/2, 1)
+
+	for {
+		removed := false
+
+		for g := range s.ops {
+			for i := 0; i < len(s.ops[g]); {
+				candidate := s.without(g, i, chunk)
+				if fails(candidate) {
+					s = candidate
+					removed = true
+				} else {
+					i += chunk
+				}
+			}
+		}
+
+		if chunk > 1 {
+			chunk /= 2
+		} else if !removed {
+			return s
+		}
+	}
+}
+
+// testModel runs random sequences against new backends, first with one
+// goroutine then with o.concurrency goroutines, and reports the shrunk
+// sequence of the first failure
+func testModel(t *testing.T, newBackend NewBackend, o options) {
+	t.Run("Sequential", func(t *testing.T) {
+		testSequences(t, newBackend, o, 1)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		if o.concurrency < 2 {
+			t.Skipf("concurrency is %d", o.concurrency)
+		}
+
+		testSequences(t, newBackend, o, o.concurrency)
+	})
+}
+
+// testSequences runs o.sequences random sequences with n goroutines
+func testSequences(t *testing.T, newBackend NewBackend, o options, n int) {
+	// a concurrent failure depends on the interleaving, a shorter
+	// sequence is kept if any of a few runs fails
+	attempts := 1
+	if n > 1 {
+		attempts = 5
+	}
+
+	fails := func(s sequence) bool {
+		for i := 0; i < attempts; i++ {
+			if s.run(t, newBackend) != nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < o.sequences; i++ {
+		rng := rand.New(rand.NewPCG(o.seed, uint64(i)))
+		s := newSequence(rng, n, o.steps)
+
+		err := s.run(t, newBackend)
+		if err == nil {
+			continue
+		}
+
+		if shrunk := shrink(s, fails); shrunk.len() < s.len() {
+			if shrunkErr := shrunk.run(t, newBackend); shrunkErr != nil {
+				s, err = shrunk, shrunkErr
+			}
+		}
+
+		t.Fatalf("sequence %d of seed %d with %d goroutines failed, shrunk to %d steps:%s\n%v", i, o.seed, n, s.len(), s, err)
+	}
+}
@@ -0,0 +1,32 @@
+package storagetest
+
+import (
+	"math/rand/v2"
+	"testing"
+)
+
+func TestShrink(t *testing.T) {
+	s := newSequence(rand.New(rand.NewPCG(1, 1)), 2, 50)
+
+	// fails as long as goroutine 1 puts content 3 after it removes it
+	fails := func(s sequence) bool {
+		removed := false
+		for _, step := range s.ops[1] {
+			if step == (op{kind: opRemove, content: 3}) {
+				removed = true
+			} else if removed && step == (op{kind: opPut, content: 3}) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !fails(s) {
+		t.Fatal("the sequence doesn't fail, pick another seed")
+	}
+
+	shrunk := shrink(s, fails)
+	if len(shrunk.ops[0]) != 0 || len(shrunk.ops[1]) != 2 {
+		t.Errorf("shrunk to%s, expected remove 3, put 3", shrunk)
+	}
+}
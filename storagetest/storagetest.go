@@ -0,0 +1,472 @@
+// Package storagetest validates that a backend follows the contract of the
+// storage package, every in-tree backend runs it and third-party backends
+// can run it from their own tests
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/alinz/hash.go"
+
+	"github.com/alinz/storage.go"
+)
+
+// Backend is the part of the contract every backend has to implement
+type Backend interface {
+	storage.Putter
+	storage.Getter
+	storage.Remover
+	storage.Lister
+}
+
+// NewBackend returns an empty backend, it is called once for every
+// test so the tests don't see each other contents. Use t.Cleanup to
+// release it
+type NewBackend func(t *testing.T) Backend
+
+type options struct {
+	largeSize   int64
+	concurrency int
+	listSize    int
+	seed        uint64
+	sequences   int
+	steps       int
+}
+
+type Option func(*options)
+
+// WithLargeSize sets the size of the content used to test large
+// contents, the default is 4MB
+func WithLargeSize(size int64) Option {
+	return func(o *options) {
+		o.largeSize = size
+	}
+}
+
+// WithConcurrency sets how many goroutines use the backend at the
+// same time, the default is 8. Below 2 the concurrent tests are skipped
+// rather than passed, so a backend which isn't safe for concurrent use
+// shows up as such instead of being hidden
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		o.concurrency = n
+	}
+}
+
+// WithListSize sets how many contents are put before listing
+// them, the default is 50
+func WithListSize(n int) Option {
+	return func(o *options) {
+		o.listSize = n
+	}
+}
+
+// WithSeed sets the seed of the random sequences of the model test,
+// a failure reports its seed so it can be replayed. The default is 1
+func WithSeed(seed uint64) Option {
+	return func(o *options) {
+		o.seed = seed
+	}
+}
+
+// WithSequences sets how many random sequences the model test runs,
+// the default is 20
+func WithSequences(n int) Option {
+	return func(o *options) {
+		o.sequences = n
+	}
+}
+
+// WithSteps sets how many operations every goroutine of a sequence
+// runs, the default is 50
+func WithSteps(n int) Option {
+	return func(o *options) {
+		o.steps = n
+	}
+}
+
+// Run runs every test of the contract as a subtest of t, the Model
+// subtest compares random sequences of operations with the memory backend
+func Run(t *testing.T, newBackend NewBackend, opts ...Option) {
+	o := options{
+		largeSize:   4 << 20,
+		concurrency: 8,
+		listSize:    50,
+		seed:        1,
+		sequences:   20,
+		steps:       50,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T, backend Backend, o options)
+	}{
+		{"PutGet", testPutGet},
+		{"Dedup", testDedup},
+		{"NotFound", testNotFound},
+		{"Empty", testEmpty},
+		{"Remove", testRemove},
+		{"Large", testLarge},
+		{"List", testList},
+		{"Concurrent", testConcurrent},
+		{"Cancel", testCancel},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newBackend(t), o)
+		})
+	}
+
+	// the model test needs a new backend for every sequence it runs
+	t.Run("Model", func(t *testing.T) {
+		testModel(t, newBackend, o)
+	})
+}
+
+func testPutGet(t *testing.T, backend Backend, o options) {
+	ctx := context.Background()
+	content := []byte("hello world")
+
+	hashValue, n, err := backend.Put(ctx, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	if n != int64(len(content)) {
+		t.Errorf("put returned %d bytes, expected %d", n, len(content))
+	}
+
+	if expected := hash.Bytes(content); !bytes.Equal(hashValue, expected) {
+		t.Errorf("put returned hash %s, expected %s", hash.Format(hashValue), hash.Format(expected))
+	}
+
+	if err := checkContent(ctx, backend, hashValue, content); err != nil {
+		t.Error(err)
+	}
+}
+
+func testDedup(t *testing.T, backend Backend, o options) {
+	ctx := context.Background()
+	content := []byte("the same content")
+
+	first, _, err := backend.Put(ctx, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("first put: %v", err)
+	}
+
+	second, n, err := backend.Put(ctx, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("second put: %v", err)
+	}
+
+	if !bytes.Equal(first, second) {
+		t.Errorf("the same content got two hashes, %s and %s", hash.Format(first), hash.Format(second))
+	}
+
+	if n != int64(len(content)) {
+		t.Errorf("second put returned %d bytes, expected %d", n, len(content))
+	}
+
+	hashes, err := list(ctx, backend)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(hashes) != 1 {
+		t.Errorf("listed %d hashes after putting the same content twice, expected 1", len(hashes))
+	}
+
+	if err := checkContent(ctx, backend, first, content); err != nil {
+		t.Error(err)
+	}
+}
+
+func testNotFound(t *testing.T, backend Backend, o options) {
+	ctx := context.Background()
+	missing := hash.Bytes([]byte("missing"))
+
+	rc, err := backend.Get(ctx, missing)
+	if err == nil {
+		rc.Close()
+	}
+
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("get of a missing hash returned %v, expected storage.ErrNotFound", err)
+	}
+
+	if _, err := storage.Stat(ctx, backend, missing); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("stat of a missing hash returned %v, expected storage.ErrNotFound", err)
+	}
+
+	if ok, err := storage.Has(ctx, backend, missing); err != nil || ok {
+		t.Errorf("has of a missing hash returned %v, %v, expected false, nil", ok, err)
+	}
+}
+
+func testEmpty(t *testing.T, backend Backend, o options) {
+	ctx := context.Background()
+
+	_, _, err := backend.Put(ctx, bytes.NewReader(nil))
+	if !errors.Is(err, storage.ErrEmpty) {
+		t.Errorf("put of an empty content returned %v, expected storage.ErrEmpty", err)
+	}
+
+	hashes, err := list(ctx, backend)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(hashes) != 0 {
+		t.Errorf("listed %d hashes after putting an empty content, expected 0", len(hashes))
+	}
+}
+
+func testRemove(t *testing.T, backend Backend, o options) {
+	ctx := context.Background()
+
+	hashValue, _, err := backend.Put(ctx, bytes.NewReader([]byte("remove me")))
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	if err := backend.Remove(ctx, hashValue); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	rc, err := backend.Get(ctx, hashValue)
+	if err == nil {
+		rc.Close()
+	}
+
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("get of a removed hash returned %v, expected storage.ErrNotFound", err)
+	}
+
+	if err := backend.Remove(ctx, hashValue); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("removing a missing hash returned %v, expected storage.ErrNotFound", err)
+	}
+}
+
+func testLarge(t *testing.T, backend Backend, o options) {
+	ctx := context.Background()
+
+	content := make([]byte, o.largeSize)
+	rand.Read(content)
+
+	hashValue, n, err := backend.Put(ctx, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	if n != o.largeSize {
+		t.Errorf("put returned %d bytes, expected %d", n, o.largeSize)
+	}
+
+	if err := checkContent(ctx, backend, hashValue, content); err != nil {
+		t.Error(err)
+	}
+}
+
+func testList(t *testing.T, backend Backend, o options) {
+	ctx := context.Background()
+
+	expected := make(map[string]bool)
+	for i := 0; i < o.listSize; i++ {
+		hashValue, _, err := backend.Put(ctx, bytes.NewReader([]byte(fmt.Sprintf("content %d", i))))
+		if err != nil {
+			t.Fatalf("put: %v", err)
+		}
+
+		expected[hash.Format(hashValue)] = true
+	}
+
+	check := func(name string, hashes [][]byte) {
+		seen := make(map[string]bool)
+		for _, hashValue := range hashes {
+			key := hash.Format(hashValue)
+
+			if !expected[key] {
+				t.Errorf("%s yielded %s which was never put or was removed", name, key)
+			}
+
+			if seen[key] {
+				t.Errorf("%s yielded %s more than once", name, key)
+			}
+			seen[key] = true
+		}
+
+		if len(seen) != len(expected) {
+			t.Errorf("%s yielded %d hashes, expected %d", name, len(seen), len(expected))
+		}
+	}
+
+	hashes, err := list(ctx, backend)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	check("list", hashes)
+
+	hashes = hashes[:0]
+	for hashValue, err := range storage.All(ctx, backend) {
+		if err != nil {
+			t.Fatalf("all: %v", err)
+		}
+		hashes = append(hashes, hashValue)
+	}
+	check("all", hashes)
+
+	// removed contents are not listed anymore
+	for key := range expected {
+		hashValue, _ := hash.ValueFromString(key)
+		if err := backend.Remove(ctx, hashValue); err != nil {
+			t.Fatalf("remove: %v", err)
+		}
+
+		delete(expected, key)
+		break
+	}
+
+	hashes, err = list(ctx, backend)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	check("list after remove", hashes)
+}
+
+func testConcurrent(t *testing.T, backend Backend, o options) {
+	if o.concurrency < 2 {
+		t.Skipf("concurrency is %d", o.concurrency)
+	}
+
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, o.concurrency)
+
+	for i := 0; i < o.concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// every goroutine puts a content of its own and one shared by all of them
+			for _, content := range [][]byte{[]byte(fmt.Sprintf("goroutine %d", i)), []byte("shared")} {
+				hashValue, _, err := backend.Put(ctx, bytes.NewReader(content))
+				if err != nil {
+					errs <- fmt.Errorf("put: %w", err)
+					return
+				}
+
+				if err := checkContent(ctx, backend, hashValue, content); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	hashes, err := list(ctx, backend)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(hashes) != o.concurrency+1 {
+		t.Errorf("listed %d hashes, expected %d", len(hashes), o.concurrency+1)
+	}
+}
+
+func testCancel(t *testing.T, backend Backend, o options) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, err := backend.Put(ctx, bytes.NewReader([]byte("hello"))); !errors.Is(err, context.Canceled) {
+		t.Errorf("put with a canceled context returned %v, expected context.Canceled", err)
+	}
+
+	if _, err := backend.Get(ctx, hash.Bytes([]byte("hello"))); !errors.Is(err, context.Canceled) {
+		t.Errorf("get with a canceled context returned %v, expected context.Canceled", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := backend.Put(context.Background(), bytes.NewReader([]byte(fmt.Sprintf("content %d", i)))); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+
+	// a listing can be canceled before it is done
+	next, cancelList := backend.List()
+	if _, err := next(context.Background()); err != nil {
+		t.Errorf("list: %v", err)
+	}
+	cancelList()
+
+	next, cancelList = backend.List()
+	defer cancelList()
+
+	if _, err := next(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("list with a canceled context returned %v, expected context.Canceled", err)
+	}
+
+	for _, err := range storage.All(context.Background(), backend) {
+		if err != nil {
+			t.Errorf("all: %v", err)
+		}
+		// breaking out of the loop releases the listing
+		break
+	}
+}
+
+// list reads the whole listing with List
+func list(ctx context.Context, lister storage.Lister) ([][]byte, error) {
+	next, cancel := lister.List()
+	defer cancel()
+
+	var hashes [][]byte
+	for {
+		hashValue, err := next(ctx)
+		if errors.Is(err, storage.ErrIteratorDone) {
+			return hashes, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		hashes = append(hashes, hashValue)
+	}
+}
+
+func checkContent(ctx context.Context, getter storage.Getter, hashValue []byte, expected []byte) error {
+	rc, err := getter.Get(ctx, hashValue)
+	if err != nil {
+		return fmt.Errorf("get %s: %w", hash.Format(hashValue), err)
+	}
+	defer rc.Close()
+
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", hash.Format(hashValue), err)
+	}
+
+	if !bytes.Equal(content, expected) {
+		return fmt.Errorf("get %s returned %d bytes which don't match the %d bytes put", hash.Format(hashValue), len(content), len(expected))
+	}
+
+	return nil
+}
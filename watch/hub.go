@@ -0,0 +1,106 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"sync"
+
+	"github.com/alinz/storage.go"
+)
+
+// DefaultBufferSize is used if Hub.BufferSize is not set
+const DefaultBufferSize = 1024
+
+var (
+	ErrOverflow = errors.New("watcher fell behind and events were dropped")
+)
+
+// Hub delivers published events to every watcher, the zero value is ready
+// to use. Publish never blocks, a watcher which can't keep up with its
+// buffer gets ErrOverflow and has to list the store again
+type Hub struct {
+	BufferSize int
+
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+type watcher struct {
+	events   chan storage.Event
+	overflow bool
+}
+
+func (h *Hub) Publish(event storage.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watchers {
+		select {
+		case w.events <- event:
+		default:
+			w.overflow = true
+			h.remove(w)
+		}
+	}
+}
+
+// Watch subscribes right away, so no event published after Watch
+// returns is missed even if the loop starts later
+func (h *Hub) Watch(ctx context.Context) iter.Seq2[storage.Event, error] {
+	w := h.add()
+	stop := context.AfterFunc(ctx, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(w)
+	})
+
+	return func(yield func(storage.Event, error) bool) {
+		defer func() {
+			stop()
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			h.remove(w)
+		}()
+
+		for event := range w.events {
+			if !yield(event, nil) {
+				return
+			}
+		}
+
+		// events is closed by now, so reading overflow is safe
+		if w.overflow {
+			yield(storage.Event{}, ErrOverflow)
+		}
+	}
+}
+
+func (h *Hub) add() *watcher {
+	bufferSize := h.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
+	w := &watcher{events: make(chan storage.Event, bufferSize)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.watchers == nil {
+		h.watchers = make(map[*watcher]struct{})
+	}
+	h.watchers[w] = struct{}{}
+
+	return w
+}
+
+// remove must be called with mu held
+func (h *Hub) remove(w *watcher) {
+	if _, ok := h.watchers[w]; !ok {
+		return
+	}
+
+	delete(h.watchers, w)
+	close(w.events)
+}
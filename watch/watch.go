@@ -0,0 +1,121 @@
+package watch
+
+import (
+	"context"
+	"io"
+	"iter"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/decorator"
+)
+
+// Storage emits an event for every successful Put and Remove made
+// through it, changes made to the backend directly are not seen. Every
+// other method is forwarded to the backend, Puts made through a Tx are
+// emitted once it is committed
+type Storage struct {
+	*decorator.Storage
+	next any
+	hub  Hub
+}
+
+var _ storage.Watcher = (*Storage)(nil)
+var _ storage.Transactioner = (*Storage)(nil)
+var _ storage.Optional = (*Storage)(nil)
+
+func (s *Storage) Watch(ctx context.Context) iter.Seq2[storage.Event, error] {
+	return s.hub.Watch(ctx)
+}
+
+func (s *Storage) Begin(ctx context.Context) (storage.Tx, error) {
+	transactioner, ok := storage.As[storage.Transactioner](s.next)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+
+	t, err := transactioner.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tx{Tx: t, hub: &s.hub}, nil
+}
+
+// Implements always serves storage.Watcher, the rest is
+// served if the backend does
+func (s *Storage) Implements(target any) bool {
+	if _, ok := target.(*storage.Watcher); ok {
+		return true
+	}
+
+	return s.Storage.Implements(target)
+}
+
+func (s *Storage) put(ctx context.Context, r io.Reader, next storage.Putter) ([]byte, int64, error) {
+	hashValue, n, err := next.Put(ctx, r)
+	if err != nil {
+		return nil, n, err
+	}
+
+	s.hub.Publish(storage.Event{Hash: hashValue, Op: storage.OpPut, Size: n})
+
+	return hashValue, n, nil
+}
+
+func (s *Storage) remove(ctx context.Context, hashValue []byte, next storage.Remover) error {
+	if err := next.Remove(ctx, hashValue); err != nil {
+		return err
+	}
+
+	s.hub.Publish(storage.Event{Hash: hashValue, Op: storage.OpRemove})
+
+	return nil
+}
+
+// New wraps next, which should implement at least
+// storage.Putter or storage.Remover
+func New(next any) *Storage {
+	s := &Storage{next: next}
+	s.Storage = decorator.Wrap(next, decorator.Layer{
+		Put:    s.put,
+		Remove: s.remove,
+	})
+
+	return s
+}
+
+// tx holds back the events of its Puts until Commit succeeds
+type tx struct {
+	storage.Tx
+	hub    *Hub
+	events []storage.Event
+}
+
+func (t *tx) Put(ctx context.Context, r io.Reader) ([]byte, int64, error) {
+	hashValue, n, err := t.Tx.Put(ctx, r)
+	if err != nil {
+		return nil, n, err
+	}
+
+	t.events = append(t.events, storage.Event{Hash: hashValue, Op: storage.OpPut, Size: n})
+
+	return hashValue, n, nil
+}
+
+func (t *tx) Commit() error {
+	if err := t.Tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, event := range t.events {
+		t.hub.Publish(event)
+	}
+	t.events = nil
+
+	return nil
+}
+
+func (t *tx) Rollback() error {
+	t.events = nil
+	return t.Tx.Rollback()
+}
@@ -0,0 +1,165 @@
+package watch_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/alinz/hash.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alinz/storage.go"
+	"github.com/alinz/storage.go/kv/boltdb"
+	"github.com/alinz/storage.go/memory"
+	"github.com/alinz/storage.go/merkle"
+	"github.com/alinz/storage.go/watch"
+)
+
+func TestWatchStorage(t *testing.T) {
+	backend := memory.New()
+	watchStorage := watch.New(backend)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := watchStorage.Watch(ctx)
+
+	content := []byte("hello world")
+	hashValue, _, err := watchStorage.Put(context.Background(), bytes.NewReader(content))
+	assert.NoError(t, err)
+	assert.NoError(t, watchStorage.Remove(context.Background(), hashValue))
+
+	// failed calls don't emit anything
+	assert.Error(t, watchStorage.Remove(context.Background(), hashValue))
+
+	cancel()
+
+	var got []storage.Event
+	for event, err := range events {
+		assert.NoError(t, err)
+		got = append(got, event)
+	}
+
+	assert.Equal(t, []storage.Event{
+		{Hash: hashValue, Op: storage.OpPut, Size: int64(len(content))},
+		{Hash: hashValue, Op: storage.OpRemove},
+	}, got)
+}
+
+func TestWatchForwarding(t *testing.T) {
+	ctx := context.Background()
+
+	backend, err := boltdb.New(t.TempDir() + "/bolt.db")
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	watchStorage := watch.New(backend)
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	events := watchStorage.Watch(watchCtx)
+
+	content := []byte("hello world")
+	hashValue, _, err := watchStorage.Put(ctx, bytes.NewReader(content))
+	assert.NoError(t, err)
+
+	// reads and the optional interfaces go to the backend
+	rc, err := watchStorage.Get(ctx, hashValue)
+	assert.NoError(t, err)
+	rc.Close()
+
+	info, err := storage.Stat(ctx, watchStorage, hashValue)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+
+	_, ok := storage.As[storage.Stater](watchStorage)
+	assert.True(t, ok)
+	_, ok = storage.As[storage.Watcher](watchStorage)
+	assert.True(t, ok)
+
+	// puts of a Tx are only emitted once it is committed
+	tx, err := watchStorage.Begin(ctx)
+	assert.NoError(t, err)
+	_, _, err = tx.Put(ctx, bytes.NewReader([]byte("rolled back")))
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Rollback())
+
+	tx, err = watchStorage.Begin(ctx)
+	assert.NoError(t, err)
+	committed, _, err := tx.Put(ctx, bytes.NewReader([]byte("committed")))
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	cancel()
+
+	var got []storage.Event
+	for event, err := range events {
+		assert.NoError(t, err)
+		got = append(got, event)
+	}
+
+	assert.Equal(t, []storage.Event{
+		{Hash: hashValue, Op: storage.OpPut, Size: int64(len(content))},
+		{Hash: committed, Op: storage.OpPut, Size: int64(len("committed"))},
+	}, got)
+}
+
+func TestHubOverflow(t *testing.T) {
+	hub := &watch.Hub{BufferSize: 2}
+
+	slow := hub.Watch(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fast := hub.Watch(ctx)
+
+	for i := 0; i < 3; i++ {
+		hub.Publish(storage.Event{Hash: hash.Bytes([]byte{byte(i)}), Op: storage.OpPut})
+	}
+
+	var err error
+	count := 0
+	for _, err = range slow {
+		if err != nil {
+			break
+		}
+		count++
+	}
+	assert.ErrorIs(t, err, watch.ErrOverflow)
+	assert.Equal(t, 2, count)
+
+	// breaking out of the loop unsubscribes
+	for _, err := range fast {
+		assert.NoError(t, err)
+		break
+	}
+	cancel()
+	hub.Publish(storage.Event{Op: storage.OpPut})
+}
+
+func TestMerkleRootEvents(t *testing.T) {
+	backend := memory.New()
+	nodes := watch.New(backend)
+	merkleStorage := merkle.New(backend, nodes, backend, 4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	roots := merkleStorage.Watch(ctx)
+	writes := nodes.Watch(ctx)
+
+	content := []byte("hello world")
+	root, _, err := merkleStorage.Put(context.Background(), bytes.NewReader(content))
+	assert.NoError(t, err)
+
+	cancel()
+
+	var rootEvents []storage.Event
+	for event, err := range roots {
+		assert.NoError(t, err)
+		rootEvents = append(rootEvents, event)
+	}
+	assert.Equal(t, []storage.Event{{Hash: root, Op: storage.OpRoot, Size: int64(len(content))}}, rootEvents)
+
+	nodeWrites := 0
+	for event, err := range writes {
+		assert.NoError(t, err)
+		assert.Equal(t, storage.OpPut, event.Op)
+		nodeWrites++
+	}
+	assert.Greater(t, nodeWrites, 1)
+}
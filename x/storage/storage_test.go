@@ -4,14 +4,23 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/alinz/hash.go"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/alinz/storage.go"
 	"github.com/alinz/storage.go/internal/tests"
+	"github.com/alinz/storage.go/kv/boltdb"
 	"github.com/alinz/storage.go/kv/pogreb"
+	"github.com/alinz/storage.go/local"
+	"github.com/alinz/storage.go/memory"
 	"github.com/alinz/storage.go/merkle"
 	"github.com/alinz/storage.go/sqlite"
 )
@@ -59,7 +68,7 @@ func TestMerkleWithPogreb(t *testing.T) {
 func TestMerkleWithSqlite(t *testing.T) {
 	blockSize := int64(1 * 1024 * 1024)
 
-	backend, err := sqlite.NewMemory(10, blockSize)
+	backend, err := sqlite.NewMemory(10, merkle.NodeSize(blockSize))
 	assert.NoError(t, err)
 
 	merkleStorage := merkle.New(backend, backend, backend, blockSize)
@@ -94,3 +103,626 @@ func TestMerkleWithSqlite(t *testing.T) {
 		}
 	})
 }
+
+func TestMerkleWithSqliteMultiBlock(t *testing.T) {
+	ctx := context.Background()
+	blockSize := int64(100)
+	content := bytes.Repeat([]byte("0123456789"), 100)
+
+	backend, err := sqlite.NewFile(filepath.Join(t.TempDir(), "sqlite.db"), 2, merkle.NodeSize(blockSize))
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	merkleStorage := merkle.New(backend, backend, backend, blockSize)
+
+	hashValue, n, err := merkleStorage.Put(ctx, bytes.NewReader(content))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+
+	rc, err := merkleStorage.Get(ctx, hashValue)
+	assert.NoError(t, err)
+	defer rc.Close()
+	assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc))
+
+	// a data node doesn't fit if the limit is the block size
+	tight, err := sqlite.NewFile(filepath.Join(t.TempDir(), "sqlite.db"), 2, blockSize)
+	assert.NoError(t, err)
+	defer tight.Close()
+
+	_, _, err = merkle.New(tight, tight, tight, blockSize).Put(ctx, bytes.NewReader(content))
+	assert.ErrorIs(t, err, storage.ErrTooLarge)
+}
+
+// getterOnly hides every optional interface of the wrapped getter
+type getterOnly struct {
+	getter storage.Getter
+}
+
+func (g getterOnly) Get(ctx context.Context, hash []byte) (io.ReadCloser, error) {
+	return g.getter.Get(ctx, hash)
+}
+
+func TestGetRange(t *testing.T) {
+	tempDir := t.TempDir()
+
+	boltBackend, err := boltdb.New(filepath.Join(tempDir, "bolt.db"))
+	assert.NoError(t, err)
+	defer boltBackend.Close()
+
+	pogrebBackend, err := pogreb.New(filepath.Join(tempDir, "pogreb.db"))
+	assert.NoError(t, err)
+	defer pogrebBackend.Close()
+
+	sqliteBackend, err := sqlite.NewMemory(2, 1024)
+	assert.NoError(t, err)
+	defer sqliteBackend.Close()
+
+	localPath := filepath.Join(tempDir, "local")
+	assert.NoError(t, os.Mkdir(localPath, os.ModePerm))
+
+	memoryBackend := memory.New()
+
+	backends := map[string]interface {
+		storage.Putter
+		storage.Getter
+	}{
+		"memory": memoryBackend,
+		"local":  local.New(localPath),
+		"boltdb": boltBackend,
+		"pogreb": pogrebBackend,
+		"sqlite": sqliteBackend,
+	}
+
+	content := []byte("hello world")
+
+	testCases := []struct {
+		offset   int64
+		length   int64
+		expected []byte
+	}{
+		{0, -1, content},
+		{0, 5, []byte("hello")},
+		{6, -1, []byte("world")},
+		{6, 100, []byte("world")},
+		{4, 3, []byte("o w")},
+		{11, -1, []byte{}},
+		{20, 5, []byte{}},
+	}
+
+	for name, backend := range backends {
+		hashValue, _, err := backend.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err, name)
+
+		for _, getter := range []storage.Getter{backend, getterOnly{backend}} {
+			for _, testCase := range testCases {
+				rc, err := storage.GetRange(context.Background(), getter, hashValue, testCase.offset, testCase.length)
+				assert.NoError(t, err, name)
+
+				b, err := io.ReadAll(rc)
+				assert.NoError(t, err, name)
+				assert.Equal(t, testCase.expected, append([]byte{}, b...), "%s %d-%d", name, testCase.offset, testCase.length)
+				rc.Close()
+			}
+		}
+
+		_, err = storage.GetRange(context.Background(), backend, hashValue, -1, 1)
+		assert.ErrorIs(t, err, storage.ErrInvalidRange, name)
+
+		_, err = storage.GetRange(context.Background(), backend, []byte("missing"), 0, 1)
+		assert.ErrorIs(t, err, storage.ErrNotFound, name)
+	}
+}
+
+// brokenReader fails along with the first read bytes, so the
+// failure is not mistaken for the end of the content
+type brokenReader struct{}
+
+func (brokenReader) Read(b []byte) (int, error) {
+	b[0] = 'x'
+	return 1, errors.New("broken reader")
+}
+
+func TestBatch(t *testing.T) {
+	tempDir := t.TempDir()
+
+	boltBackend, err := boltdb.New(filepath.Join(tempDir, "bolt.db"))
+	assert.NoError(t, err)
+	defer boltBackend.Close()
+
+	pogrebBackend, err := pogreb.New(filepath.Join(tempDir, "pogreb.db"))
+	assert.NoError(t, err)
+	defer pogrebBackend.Close()
+
+	sqliteBackend, err := sqlite.NewMemory(2, 1024)
+	assert.NoError(t, err)
+	defer sqliteBackend.Close()
+
+	localPath := filepath.Join(tempDir, "local")
+	assert.NoError(t, os.Mkdir(localPath, os.ModePerm))
+
+	backends := map[string]interface {
+		storage.Putter
+		storage.Getter
+		storage.Remover
+	}{
+		"memory": memory.New(),
+		"local":  local.New(localPath),
+		"boltdb": boltBackend,
+		"pogreb": pogrebBackend,
+		"sqlite": sqliteBackend,
+	}
+
+	contents := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+
+	for name, backend := range backends {
+		rs := make([]io.Reader, 0, len(contents)+1)
+		for _, content := range contents {
+			rs = append(rs, bytes.NewReader(content))
+		}
+		rs = append(rs, brokenReader{})
+
+		results, err := storage.PutBatch(context.Background(), backend, rs)
+		assert.NoError(t, err, name)
+		assert.Len(t, results, len(rs), name)
+
+		hashes := make([][]byte, 0, len(contents)+1)
+		for i := range contents {
+			assert.NoError(t, results[i].Err, name)
+			assert.Equal(t, int64(len(contents[i])), results[i].N, name)
+			hashes = append(hashes, results[i].Hash)
+		}
+		assert.Error(t, results[len(contents)].Err, name)
+
+		hashes = append(hashes, []byte("missing"))
+
+		getResults, err := storage.GetBatch(context.Background(), backend, hashes)
+		assert.NoError(t, err, name)
+		for i := range contents {
+			assert.NoError(t, getResults[i].Err, name)
+			assert.NoError(t, tests.EqualReaders(bytes.NewReader(contents[i]), getResults[i].Reader), name)
+			getResults[i].Reader.Close()
+		}
+		assert.ErrorIs(t, getResults[len(contents)].Err, storage.ErrNotFound, name)
+
+		errs, err := storage.RemoveBatch(context.Background(), backend, hashes[:len(contents)])
+		assert.NoError(t, err, name)
+		for _, err := range errs {
+			assert.NoError(t, err, name)
+		}
+
+		for _, hashValue := range hashes[:len(contents)] {
+			_, err := backend.Get(context.Background(), hashValue)
+			assert.ErrorIs(t, err, storage.ErrNotFound, name)
+		}
+	}
+}
+
+// cancelOnRead cancels the context as soon as the content is read
+type cancelOnRead struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnRead) Read(b []byte) (int, error) {
+	c.cancel()
+	return c.r.Read(b)
+}
+
+func TestTransaction(t *testing.T) {
+	tempDir := t.TempDir()
+
+	boltBackend, err := boltdb.New(filepath.Join(tempDir, "bolt.db"))
+	assert.NoError(t, err)
+	defer boltBackend.Close()
+
+	sqliteBackend, err := sqlite.NewFile(filepath.Join(tempDir, "sqlite.db"), 2, 1024)
+	assert.NoError(t, err)
+	defer sqliteBackend.Close()
+
+	localPath := filepath.Join(tempDir, "local")
+	assert.NoError(t, os.Mkdir(localPath, os.ModePerm))
+
+	backends := map[string]interface {
+		storage.Transactioner
+		storage.Putter
+		storage.Getter
+		storage.Lister
+	}{
+		"local":  local.New(localPath),
+		"boltdb": boltBackend,
+		"sqlite": sqliteBackend,
+	}
+
+	count := func(lister storage.Lister) int {
+		next, cancel := lister.List()
+		defer cancel()
+
+		n := 0
+		for {
+			_, err := next(context.Background())
+			if errors.Is(err, storage.ErrIteratorDone) {
+				return n
+			}
+			assert.NoError(t, err)
+			n++
+		}
+	}
+
+	for name, backend := range backends {
+		content := []byte("hello " + name)
+
+		tx, err := backend.Begin(context.Background())
+		assert.NoError(t, err, name)
+
+		hashValue, _, err := tx.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err, name)
+
+		rc, err := tx.Get(context.Background(), hashValue)
+		assert.NoError(t, err, name)
+		assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc), name)
+		rc.Close()
+
+		assert.NoError(t, tx.Rollback(), name)
+
+		_, err = backend.Get(context.Background(), hashValue)
+		assert.ErrorIs(t, err, storage.ErrNotFound, name)
+		assert.Equal(t, 0, count(backend), name)
+
+		tx, err = backend.Begin(context.Background())
+		assert.NoError(t, err, name)
+
+		_, _, err = tx.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err, name)
+
+		assert.NoError(t, tx.Commit(), name)
+		assert.NoError(t, tx.Rollback(), name)
+
+		rc, err = backend.Get(context.Background(), hashValue)
+		assert.NoError(t, err, name)
+		assert.NoError(t, tests.EqualReaders(bytes.NewReader(content), rc), name)
+		rc.Close()
+
+		// a canceled merkle Put doesn't leave any node behind
+		merkleStorage := merkle.New(backend, backend, backend, 4)
+		ctx, cancel := context.WithCancel(context.Background())
+		_, _, err = merkleStorage.Put(ctx, &cancelOnRead{r: bytes.NewReader(content), cancel: cancel})
+		assert.Error(t, err, name)
+		assert.Equal(t, 1, count(backend), name)
+
+		_, _, err = merkleStorage.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err, name)
+		assert.Greater(t, count(backend), 1, name)
+	}
+}
+
+// listerOnly hides every optional interface of the wrapped lister
+type listerOnly struct {
+	lister storage.Lister
+}
+
+func (l listerOnly) List() (storage.IteratorFunc, storage.CancelFunc) {
+	return l.lister.List()
+}
+
+func TestListPage(t *testing.T) {
+	tempDir := t.TempDir()
+
+	boltBackend, err := boltdb.New(filepath.Join(tempDir, "bolt.db"))
+	assert.NoError(t, err)
+	defer boltBackend.Close()
+
+	pogrebBackend, err := pogreb.New(filepath.Join(tempDir, "pogreb.db"))
+	assert.NoError(t, err)
+	defer pogrebBackend.Close()
+
+	sqliteBackend, err := sqlite.NewFile(filepath.Join(tempDir, "sqlite.db"), 2, 1024)
+	assert.NoError(t, err)
+	defer sqliteBackend.Close()
+
+	localPath := filepath.Join(tempDir, "local")
+	assert.NoError(t, os.Mkdir(localPath, os.ModePerm))
+
+	backends := map[string]interface {
+		storage.Putter
+		storage.Lister
+	}{
+		"memory": memory.New(),
+		"local":  local.New(localPath),
+		"boltdb": boltBackend,
+		"pogreb": pogrebBackend,
+		"sqlite": sqliteBackend,
+	}
+
+	for name, backend := range backends {
+		var expected [][]byte
+		for i := 0; i < 20; i++ {
+			hashValue, _, err := backend.Put(context.Background(), bytes.NewReader([]byte{'a' + byte(i)}))
+			assert.NoError(t, err, name)
+			expected = append(expected, hashValue)
+		}
+
+		sort.Slice(expected, func(i, j int) bool {
+			return bytes.Compare(expected[i], expected[j]) < 0
+		})
+
+		for _, lister := range []storage.Lister{backend, listerOnly{backend}} {
+			var hashes [][]byte
+			opts := storage.ListOptions{PageSize: 3}
+			pages := 0
+
+			for {
+				page, err := storage.ListPage(context.Background(), lister, opts)
+				assert.NoError(t, err, name)
+				assert.LessOrEqual(t, len(page.Hashes), 3, name)
+
+				hashes = append(hashes, page.Hashes...)
+				pages++
+
+				if page.Next == "" {
+					break
+				}
+				opts.Token = page.Next
+			}
+
+			assert.Equal(t, expected, hashes, name)
+			assert.Equal(t, 7, pages, name)
+
+			prefix := expected[10][:1]
+			page, err := storage.ListPage(context.Background(), lister, storage.ListOptions{Prefix: prefix})
+			assert.NoError(t, err, name)
+			assert.NotEmpty(t, page.Hashes, name)
+			assert.Empty(t, page.Next, name)
+			for _, hashValue := range page.Hashes {
+				assert.True(t, bytes.HasPrefix(hashValue, prefix), name)
+			}
+
+			_, err = storage.ListPage(context.Background(), lister, storage.ListOptions{Token: "!"})
+			assert.ErrorIs(t, err, storage.ErrInvalidToken, name)
+		}
+	}
+}
+
+func TestAll(t *testing.T) {
+	tempDir := t.TempDir()
+
+	boltBackend, err := boltdb.New(filepath.Join(tempDir, "bolt.db"))
+	assert.NoError(t, err)
+	defer boltBackend.Close()
+
+	pogrebBackend, err := pogreb.New(filepath.Join(tempDir, "pogreb.db"))
+	assert.NoError(t, err)
+	defer pogrebBackend.Close()
+
+	sqliteBackend, err := sqlite.NewFile(filepath.Join(tempDir, "sqlite.db"), 2, 1024)
+	assert.NoError(t, err)
+	defer sqliteBackend.Close()
+
+	localPath := filepath.Join(tempDir, "local")
+	assert.NoError(t, os.Mkdir(localPath, os.ModePerm))
+
+	backends := map[string]interface {
+		storage.Putter
+		storage.Lister
+	}{
+		"memory": memory.New(),
+		"local":  local.New(localPath),
+		"boltdb": boltBackend,
+		"pogreb": pogrebBackend,
+		"sqlite": sqliteBackend,
+	}
+
+	for name, backend := range backends {
+		expected := map[string]bool{}
+		for i := 0; i < 5; i++ {
+			hashValue, _, err := backend.Put(context.Background(), bytes.NewReader([]byte{'a' + byte(i)}))
+			assert.NoError(t, err, name)
+			expected[hash.Format(hashValue)] = true
+		}
+
+		for _, lister := range []storage.Lister{backend, listerOnly{backend}} {
+			found := map[string]bool{}
+			for hashValue, err := range storage.All(context.Background(), lister) {
+				assert.NoError(t, err, name)
+				found[hash.Format(hashValue)] = true
+			}
+			assert.Equal(t, expected, found, name)
+
+			// breaking out of the loop releases the listing, otherwise
+			// sqlite would run out of connections
+			for i := 0; i < 3; i++ {
+				for _, err := range storage.All(context.Background(), lister) {
+					assert.NoError(t, err, name)
+					break
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			_, _, err := backend.Put(ctx, bytes.NewReader([]byte("after break")))
+			cancel()
+			assert.NoError(t, err, name)
+			expected[hash.Format(hash.Bytes([]byte("after break")))] = true
+
+			// converting back and forth keeps every value
+			next, cancelIterator := storage.Pull(storage.All(context.Background(), lister))
+			found = map[string]bool{}
+			for hashValue, err := range storage.Seq(context.Background(), next, cancelIterator) {
+				assert.NoError(t, err, name)
+				found[hash.Format(hashValue)] = true
+			}
+			assert.Equal(t, expected, found, name)
+
+			ctx, cancel = context.WithCancel(context.Background())
+			cancel()
+			next, cancelIterator = lister.List()
+			_, err = next(ctx)
+			assert.ErrorIs(t, err, context.Canceled, name)
+			cancelIterator()
+		}
+	}
+}
+
+func TestEntries(t *testing.T) {
+	tempDir := t.TempDir()
+
+	boltBackend, err := boltdb.New(filepath.Join(tempDir, "bolt.db"))
+	assert.NoError(t, err)
+	defer boltBackend.Close()
+
+	pogrebBackend, err := pogreb.New(filepath.Join(tempDir, "pogreb.db"))
+	assert.NoError(t, err)
+	defer pogrebBackend.Close()
+
+	sqliteBackend, err := sqlite.NewFile(filepath.Join(tempDir, "sqlite.db"), 2, 1024)
+	assert.NoError(t, err)
+	defer sqliteBackend.Close()
+
+	localPath := filepath.Join(tempDir, "local")
+	assert.NoError(t, os.Mkdir(localPath, os.ModePerm))
+
+	backends := map[string]interface {
+		storage.Putter
+		storage.Getter
+		storage.Lister
+	}{
+		"memory": memory.New(),
+		"local":  local.New(localPath),
+		"boltdb": boltBackend,
+		"pogreb": pogrebBackend,
+		"sqlite": sqliteBackend,
+	}
+
+	for name, backend := range backends {
+		content := []byte("hello world")
+		hashValue, _, err := backend.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err, name)
+
+		var entries []storage.Entry
+		for entry, err := range storage.Entries(context.Background(), backend) {
+			assert.NoError(t, err, name)
+			entries = append(entries, entry)
+		}
+
+		assert.Len(t, entries, 1, name)
+		assert.Equal(t, hashValue, entries[0].Hash, name)
+		assert.Equal(t, int64(len(content)), entries[0].Size, name)
+		assert.Empty(t, entries[0].Type, name)
+		if name == "local" {
+			assert.False(t, entries[0].ModTime.IsZero(), name)
+		}
+
+		// without Stater the size is unknown
+		for entry, err := range storage.Entries(context.Background(), listerOnly{backend}) {
+			assert.NoError(t, err, name)
+			assert.Equal(t, int64(-1), entry.Size, name)
+		}
+
+		merkleStorage := merkle.New(backend, backend, backend, 4)
+		root, _, err := merkleStorage.Put(context.Background(), bytes.NewReader(content))
+		assert.NoError(t, err, name)
+
+		types := map[string]int{}
+		for entry, err := range storage.Entries(context.Background(), merkleStorage) {
+			assert.NoError(t, err, name)
+			types[entry.Type]++
+
+			if bytes.Equal(entry.Hash, root) {
+				assert.Equal(t, merkle.RootType.String(), entry.Type, name)
+				assert.Equal(t, int64(65), entry.Size, name)
+			}
+		}
+
+		// the plain content put before is not a merkle node, memory
+		// and sqlite also keep the empty content of the last block
+		assert.GreaterOrEqual(t, types[""], 1, name)
+		assert.Equal(t, 1, types[merkle.RootType.String()], name)
+		assert.Equal(t, 3, types[merkle.DataType.String()], name)
+		assert.Greater(t, types[merkle.MetaType.String()], 0, name)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tempDir := t.TempDir()
+
+	boltBackend, err := boltdb.New(filepath.Join(tempDir, "bolt.db"))
+	assert.NoError(t, err)
+	defer boltBackend.Close()
+
+	pogrebBackend, err := pogreb.New(filepath.Join(tempDir, "pogreb.db"))
+	assert.NoError(t, err)
+	defer pogrebBackend.Close()
+
+	sqliteBackend, err := sqlite.NewFile(filepath.Join(tempDir, "sqlite.db"), 2, 1024)
+	assert.NoError(t, err)
+	defer sqliteBackend.Close()
+
+	localPath := filepath.Join(tempDir, "local")
+	assert.NoError(t, os.Mkdir(localPath, os.ModePerm))
+
+	backends := map[string]interface {
+		storage.Putter
+		storage.Getter
+	}{
+		"memory": memory.New(),
+		"local":  local.New(localPath),
+		"boltdb": boltBackend,
+		"pogreb": pogrebBackend,
+		"sqlite": sqliteBackend,
+	}
+
+	missing := []byte(hash.Bytes([]byte("missing")))
+
+	for name, backend := range backends {
+		_, err := backend.Get(context.Background(), missing)
+		assert.ErrorIs(t, err, storage.ErrNotFound, name)
+
+		var storageErr *storage.Error
+		if assert.ErrorAs(t, err, &storageErr, name) {
+			assert.Equal(t, "get", storageErr.Op, name)
+			assert.Equal(t, missing, storageErr.Hash, name)
+		}
+
+		_, err = storage.Stat(context.Background(), backend, missing)
+		assert.ErrorIs(t, err, storage.ErrNotFound, name)
+		assert.False(t, storage.IsRetryable(err), name)
+	}
+
+	t.Run("empty contents", func(t *testing.T) {
+		for _, name := range []string{"local", "boltdb", "pogreb"} {
+			_, _, err := backends[name].Put(context.Background(), bytes.NewReader(nil))
+			assert.ErrorIs(t, err, storage.ErrEmpty, name)
+		}
+	})
+
+	t.Run("closed backend", func(t *testing.T) {
+		closedBackend, err := boltdb.New(filepath.Join(tempDir, "closed.db"))
+		assert.NoError(t, err)
+		assert.NoError(t, closedBackend.Close())
+
+		_, _, err = closedBackend.Put(context.Background(), bytes.NewReader([]byte("hello")))
+		assert.ErrorIs(t, err, storage.ErrClosed)
+	})
+
+	t.Run("corrupted merkle node", func(t *testing.T) {
+		backend := memory.New()
+		merkleStorage := merkle.New(backend, backend, backend, 4)
+
+		// not a node of any tree
+		hashValue, _, err := backend.Put(context.Background(), bytes.NewReader([]byte("hello world")))
+		assert.NoError(t, err)
+
+		rc, err := merkleStorage.Get(context.Background(), hashValue)
+		assert.NoError(t, err)
+		defer rc.Close()
+
+		_, err = io.ReadAll(rc)
+		assert.ErrorIs(t, err, storage.ErrCorrupted)
+		assert.ErrorIs(t, err, merkle.ErrUnknownFileType)
+	})
+
+	t.Run("retryable errors", func(t *testing.T) {
+		err := storage.NewError("put", nil, fmt.Errorf("%w: database is locked", storage.ErrUnavailable))
+		assert.True(t, storage.IsRetryable(err))
+		assert.Equal(t, "put: storage is unavailable: database is locked", err.Error())
+		assert.Same(t, err, storage.NewError("get", nil, err))
+	})
+}